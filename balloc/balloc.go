@@ -3,6 +3,7 @@ package balloc
 import (
 	"fmt"
 	"log"
+	"pp2/bio"
 	"pp2/jrnl"
 )
 
@@ -10,15 +11,22 @@ var startData uint
 
 func InitBalloc(dataStart uint) {
 	startData = dataStart
+	bio.Bcache(startData, EndData())
 }
 
-// CANNOT be invoked more than once per run,
-// since changes don't hit the bitmap until txns
-// complete!
+// Just past the last block the bitmap can hand out
+func EndData() uint {
+	return startData + bio.BlockSize
+}
+
+// May be invoked more than once per transaction,
+// since the bitmap is read through the transaction.
+// Other clients still won't see changes until
+// the transaction commits!
 // Always succeeds.
 func AllocBlocks(t *jrnl.TxnHandle, cnt uint) []uint {
 retry:
-	btmp := getBitmap()
+	btmp := getBitmap(t)
 	blks := []uint{}
 	fmt.Printf("Trying to alloc %d blocks\n", cnt)
 
@@ -47,11 +55,47 @@ retry:
 	return blks
 }
 
-// CAN ONLY BE CALLED ONCE
+// AllocBlocks, but tries to hand out cnt blocks in a
+// row: from goal if they're all free there (pass 0 for
+// anywhere), or else the first free run long enough.
+// With no such run, it's whatever's free, first come
+// first served like AllocBlocks. Always succeeds.
+func AllocRun(t *jrnl.TxnHandle, cnt uint, goal uint) []uint {
+retry:
+	btmp := getBitmap(t)
+	start, found := uint(0), false
+	if goal >= startData && freeRun(btmp, goal-startData, cnt) {
+		start, found = goal-startData, true
+	}
+	for i := uint(0); !found && i+cnt <= uint(len(btmp)); i++ {
+		if freeRun(btmp, i, cnt) {
+			start, found = i, true
+		}
+	}
+
+	blks := []uint{}
+	for i := start; uint(len(blks)) < cnt && i < uint(len(btmp)); i++ {
+		if btmp[i] == 0 {
+			setBit(btmp, i)
+			blks = append(blks, i+startData)
+		}
+	}
+	if uint(len(blks)) < cnt {
+		log.Fatal("no blocks to alloc big sad")
+	}
+	if err := updateAndRelseBitmap(t, btmp); err != nil {
+		goto retry
+	}
+	fmt.Printf("allocated %d blocks from %d\n", cnt, blks[0])
+	return blks
+}
+
+// Like AllocBlocks, may be mixed with other
+// balloc calls in the same transaction.
 // Will always succeed.
 func RelseBlocks(t *jrnl.TxnHandle, bns []uint) {
 retry:
-	btmp := getBitmap()
+	btmp := getBitmap(t)
 	for _, bn := range bns {
 		if bn < startData {
 			log.Fatal("illegal block to relse")
@@ -66,3 +110,16 @@ retry:
 		goto retry
 	}
 }
+
+// Whether cnt blocks from start are all free
+func freeRun(b bitmap, start uint, cnt uint) bool {
+	if start+cnt > uint(len(b)) {
+		return false
+	}
+	for i := start; i < start+cnt; i++ {
+		if b[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
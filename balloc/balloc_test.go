@@ -14,6 +14,9 @@ import (
 //	-> Release
 //		-> 1 block, more than 1 block
 //		-> 1 alloc, many allocs
+//	-> AllocRun
+//		-> goal free, goal taken, no goal
+//		-> no run long enough
 
 func initUut() {
 	bio.Binit("", true)
@@ -103,3 +106,43 @@ func TestBigAlloc(tt *testing.T) {
 		tt.Errorf("4096 blocks not allocated: got %v\n", b)
 	}
 }
+
+// Covers:
+//	-> allocrun/goalfree, allocrun/goaltaken, allocrun/nogoal
+//	-> allocrun/norun
+func TestAllocRun(tt *testing.T) {
+	initUut()
+	t := jrnl.BeginTransaction()
+	b := AllocRun(t, 3, 0)
+	if b[0] != startData || b[2] != startData+2 {
+		tt.Errorf("got %v for the first run", b)
+	}
+
+	// Right after it, then past what's taken
+	b = AllocRun(t, 2, startData+3)
+	if b[0] != startData+3 || b[1] != startData+4 {
+		tt.Errorf("got %v from a free goal", b)
+	}
+	RelseBlocks(t, []uint{startData + 1})
+	b = AllocRun(t, 2, startData+1)
+	if b[0] != startData+5 || b[1] != startData+6 {
+		tt.Errorf("got %v for a goal with one free block", b)
+	}
+
+	// Every other block taken leaves no runs
+	t.EndTransaction(false)
+	t = jrnl.BeginTransaction()
+	all := AllocBlocks(t, 4096-7)
+	odd := []uint{}
+	for _, bn := range all {
+		if bn%2 == 1 {
+			odd = append(odd, bn)
+		}
+	}
+	RelseBlocks(t, odd)
+	b = AllocRun(t, 3, 0)
+	if len(b) != 3 || b[1]-b[0] < 2 {
+		tt.Errorf("got %v with nothing in a row free", b)
+	}
+	t.EndTransaction(false)
+}
@@ -9,8 +9,8 @@ const bitmapBlock = jrnl.EndJrnl + 1
 
 type bitmap []byte
 
-func getBitmap() bitmap {
-	blk := bio.Bget(bitmapBlock)
+func getBitmap(t *jrnl.TxnHandle) bitmap {
+	blk := t.ReadBlock(bitmapBlock)
 	if blk.Data == "" {
 		blk.Data = string(make([]byte, 4096))
 	}
@@ -38,3 +38,36 @@ func updateAndRelseBitmap(t *jrnl.TxnHandle, b bitmap) error {
 	blk.Brelse()
 	return nil
 }
+
+// For fsck: the first data block's number, and
+// whether the bitmap has each data block in use
+func Snapshot() (uint, []bool) {
+	blk := bio.Bget(bitmapBlock)
+	defer blk.Brelse()
+
+	used := make([]bool, bio.BlockSize)
+	for i := 0; i < len(blk.Data) && i < len(used); i++ {
+		used[i] = blk.Data[i] != 0
+	}
+	return startData, used
+}
+
+// For fsck: marks bns used or free, without the
+// sanity checks AllocBlocks and RelseBlocks make
+func Mark(t *jrnl.TxnHandle, bns []uint, used bool) {
+retry:
+	btmp := getBitmap(t)
+	for _, bn := range bns {
+		if bn < startData || bn-startData >= uint(len(btmp)) {
+			continue
+		}
+		if used {
+			setBit(btmp, bn-startData)
+		} else {
+			clearBit(btmp, bn-startData)
+		}
+	}
+	if err := updateAndRelseBitmap(t, btmp); err != nil {
+		goto retry
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"pp2/kvraft"
 	"pp2/netdrv"
+	"sync"
 )
 
 type Block struct {
@@ -33,6 +34,7 @@ func Binit(nsAddr string, test bool) {
 		conf := netdrv.MkDefaultNetConfig(false, false, nsAddr)
 		dsk = kvraft.MakeClerk(conf)
 	}
+	cache = newCache(dsk)
 }
 
 // Acquires a block along with its
@@ -42,6 +44,9 @@ func Binit(nsAddr string, test bool) {
 // inside the appropriately-numbered block
 // if it is currently empty
 func Bget(nr uint) *Block {
+	if cache.cached(nr) {
+		return cache.get(nr)
+	}
 	nstr := fmt.Sprintf("%d", nr)
 
 retry:
@@ -57,12 +62,32 @@ retry:
 	}
 }
 
+// Reads blocks without keeping them, fetching
+// them all at once. The caller mustn't hold
+// any of them
+func Bread(nrs []uint) []string {
+	res := make([]string, len(nrs))
+	var wg sync.WaitGroup
+	for k, nr := range nrs {
+		wg.Add(1)
+		go func(k int, nr uint) {
+			defer wg.Done()
+			blk := Bget(nr)
+			res[k] = blk.Data
+			blk.Brelse()
+		}(k, nr)
+	}
+	wg.Wait()
+	return res
+}
+
 // INVARIANT: lock must be held
 // otherwise an error will be returned
 func (b *Block) Bpush() BioError {
 	nstr := fmt.Sprintf("%d", b.Nr)
 
 	err := dsk.Put(nstr, b.Data)
+	cache.pushed(b.Nr, b.Data, err)
 	if err != nil {
 		return ErrNoLock
 	}
@@ -72,13 +97,18 @@ func (b *Block) Bpush() BioError {
 func (b *Block) Brenew() BioError {
 	nstr := fmt.Sprintf("%d", b.Nr)
 	err := dsk.Renew(nstr)
+	cache.renewed(b.Nr, err)
 	if err != nil {
 		return ErrNoLock
 	}
 	return OK
 }
 
+// Cached blocks stay ours for a while, see cache.go
 func (b *Block) Brelse() BioError {
+	if cache.release(b.Nr) {
+		return OK
+	}
 	nstr := fmt.Sprintf("%d", b.Nr)
 	err := dsk.Release(nstr)
 	if err != nil {
@@ -86,3 +116,41 @@ func (b *Block) Brelse() BioError {
 	}
 	return OK
 }
+
+// Named records live in the same key and lock
+// namespace as blocks, for shared state that isn't
+// part of the block device (e.g. file locks). Keys
+// must not be plain numbers, or they'd be blocks
+type Record struct {
+	Key  string
+	Data string
+}
+
+// Bget for a named record
+func Rget(key string) *Record {
+retry:
+	dsk.Acquire(key)
+	data, err := dsk.Get(key)
+	if err != nil {
+		log.Print("Warning: single operation too slow for lock lease")
+		goto retry
+	}
+	return &Record{
+		Key:  key,
+		Data: data,
+	}
+}
+
+func (r *Record) Rpush() BioError {
+	if err := dsk.Put(r.Key, r.Data); err != nil {
+		return ErrNoLock
+	}
+	return OK
+}
+
+func (r *Record) Rrelse() BioError {
+	if err := dsk.Release(r.Key); err != nil {
+		return ErrNoLock
+	}
+	return OK
+}
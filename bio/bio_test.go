@@ -2,10 +2,12 @@ package bio
 
 import (
 	"testing"
+	"time"
 )
 
 // Test the bio interface, Binit/Bget/Bpush/Brelse/Brenew,
-// in complete isolation assuming that the disk works.
+// and the block cache under it, in complete isolation
+// assuming that the disk works.
 
 // Partitions:
 // Bget:
@@ -26,6 +28,17 @@ import (
 //	-> b
 //		-> Block lock is held, isn't (=FAILURE)
 //		-> Block data does not persist independent of Bpush
+// Rget/Rpush/Rrelse:
+//	-> r
+//		-> Key shares a number's namespace, doesn't
+//		-> Lock is held, isn't (=FAILURE)
+// Cache:
+//	-> Nr
+//		-> In a cached range, isn't
+//		-> Parked, handed out to another goroutine, gone
+//		-> Lease fresh, old and still held, old and lost
+//	-> Hold
+//		-> Runs out, flushed, 0
 
 // Covers:
 //	- bget/nr/emptyb
@@ -224,3 +237,183 @@ func TestTransientUpdate(t *testing.T) {
 	}
 
 }
+
+// Covers:
+//	- rget/r/named
+//	- rpush/r/held
+//	- rpush/r/notheld
+func TestRecord(t *testing.T) {
+	Binit("", true)
+	b := Bget(7)
+	b.Data = "block"
+	b.Bpush()
+	b.Brelse()
+
+	r := Rget("flock_7")
+	if r.Data != "" {
+		t.Errorf("got %q in a fresh record\n", r.Data)
+	}
+	r.Data = "record"
+	if r.Rpush() != OK {
+		t.Errorf("got BioError pushing held record\n")
+	}
+	if r.Rrelse() != OK {
+		t.Errorf("got BioError releasing held record\n")
+	}
+	if r.Rpush() == OK {
+		t.Errorf("pushed a released record\n")
+	}
+
+	r = Rget("flock_7")
+	defer r.Rrelse()
+	b = Bget(7)
+	defer b.Brelse()
+	if r.Data != "record" || b.Data != "block" {
+		t.Errorf("got %q and %q back\n", r.Data, b.Data)
+	}
+}
+
+// Counts trips to the disk
+type countingDisk struct {
+	MockDisk
+	gets     int
+	acquires int
+	renews   int
+}
+
+func (d *countingDisk) Get(key string) (string, error) {
+	d.mu.Lock()
+	d.gets++
+	d.mu.Unlock()
+	return d.MockDisk.Get(key)
+}
+
+func (d *countingDisk) Acquire(lockk string) {
+	d.mu.Lock()
+	d.acquires++
+	d.mu.Unlock()
+	d.MockDisk.Acquire(lockk)
+}
+
+func (d *countingDisk) Renew(lockk string) error {
+	d.mu.Lock()
+	d.renews++
+	d.mu.Unlock()
+	return d.MockDisk.Renew(lockk)
+}
+
+func (d *countingDisk) held(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.kv["lock_"+key] == "1"
+}
+
+func initCache() *countingDisk {
+	d := &countingDisk{MockDisk: MockDisk{kv: make(map[string]string)}}
+	dsk = d
+	cache = newCache(d)
+	Bcache(10, 20)
+	return d
+}
+
+// Covers:
+//	- cache/nr/cached, cache/nr/uncached
+//	- cache/nr/parked, cache/nr/gone
+//	- cache/hold/runs, cache/hold/flushed
+func TestCacheHit(t *testing.T) {
+	d := initCache()
+	SetCacheHold(200 * time.Millisecond)
+
+	b := Bget(10)
+	b.Data = "cached"
+	b.Bpush()
+	b.Brelse()
+	if !d.held("10") {
+		t.Errorf("released a cached block straight away\n")
+	}
+	for k := 0; k < 5; k++ {
+		b = Bget(10)
+		if b.Data != "cached" {
+			t.Errorf("got %q from the cache\n", b.Data)
+		}
+		b.Data = "not pushed"
+		b.Brelse()
+	}
+	if d.gets != 1 || d.acquires != 1 {
+		t.Errorf("went to the disk %d times for data, %d for the lease\n", d.gets, d.acquires)
+	}
+
+	// Outside the range, every Bget is a trip
+	for k := 0; k < 2; k++ {
+		Bget(5).Brelse()
+	}
+	if d.held("5") || d.gets != 3 {
+		t.Errorf("cached a block out of range\n")
+	}
+
+	time.Sleep(time.Second)
+	if d.held("10") {
+		t.Errorf("still holding a block after the hold ran out\n")
+	}
+	if b = Bget(10); b.Data != "cached" || d.gets != 4 {
+		t.Errorf("got %q after the hold, %d trips\n", b.Data, d.gets)
+	}
+	b.Brelse()
+	Bget(11).Brelse()
+	Bflush()
+	if d.held("10") || d.held("11") {
+		t.Errorf("flushing kept blocks\n")
+	}
+}
+
+// Covers:
+//	- cache/nr/busy
+//	- cache/lease/fresh, cache/lease/held, cache/lease/lost
+//	- cache/hold/0
+func TestCacheLease(t *testing.T) {
+	d := initCache()
+
+	// A second Bget here waits for the first to let go
+	b := Bget(12)
+	got := make(chan string)
+	go func() {
+		b2 := Bget(12)
+		got <- b2.Data
+		b2.Brelse()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	b.Data = "first"
+	b.Bpush()
+	b.Brelse()
+	if data := <-got; data != "first" {
+		t.Errorf("waiter got %q\n", data)
+	}
+
+	// An old lease is renewed before it's trusted
+	cache.mu.Lock()
+	cache.ents[12].stamp = time.Now().Add(-time.Minute)
+	cache.mu.Unlock()
+	if b = Bget(12); b.Data != "first" || d.renews != 1 || d.gets != 1 {
+		t.Errorf("got %q with %d renews, %d gets\n", b.Data, d.renews, d.gets)
+	}
+	b.Brelse()
+
+	// If it's gone, so is the data
+	cache.mu.Lock()
+	cache.ents[12].stamp = time.Now().Add(-time.Minute)
+	cache.mu.Unlock()
+	d.Release("12")
+	d.mu.Lock()
+	d.kv["12"] = "changed"
+	d.mu.Unlock()
+	if b = Bget(12); b.Data != "changed" || d.gets != 2 {
+		t.Errorf("got %q after losing the lease\n", b.Data)
+	}
+	b.Brelse()
+
+	SetCacheHold(0)
+	Bget(13).Brelse()
+	if d.held("13") || d.held("12") {
+		t.Errorf("kept blocks with no hold\n")
+	}
+}
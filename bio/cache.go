@@ -0,0 +1,232 @@
+package bio
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Client-side block cache. Blocks in a cached range
+// aren't let go on Brelse: the lease stays with us,
+// parked, for a second or so, and a Bget in that time is
+// served from memory without going to the disk. Since
+// nobody else can write a block while we hold its lease,
+// the cached copy is good for as long as the lease is.
+// Leases are renewed before reusing a block once they
+// get old, and an entry whose lease is gone is dropped
+// and fetched again. Parking holds other clients off
+// a block for up to that long after we're done with it,
+// so only inodes and data blocks are cached; the log,
+// superblock and bitmaps are too contended
+
+// How long a released block stays ours
+const defaultHold = time.Second
+
+// Renew leases older than this before trusting
+// them again. Well under the disk's lease time
+const renewAfter = 10 * time.Second
+
+type centry struct {
+	data  string
+	busy  bool      // Handed out by Bget, not yet released
+	stamp time.Time // When the lease was last taken or renewed
+	idle  time.Time // When it was last released
+}
+
+type bcache struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	dsk     Disk
+	hold    time.Duration
+	ranges  [][2]uint
+	ents    map[uint]*centry
+	reaping bool
+}
+
+var cache *bcache
+
+func newCache(d Disk) *bcache {
+	c := &bcache{
+		dsk:  d,
+		hold: defaultHold,
+		ents: make(map[uint]*centry),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Caches blocks first through last-1
+func Bcache(first uint, last uint) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.ranges = append(cache.ranges, [2]uint{first, last})
+}
+
+// Sets how long released blocks are kept. With
+// 0, Brelse lets go of every block right away
+func SetCacheHold(d time.Duration) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.hold = d
+}
+
+// Lets go of every block the cache is holding
+// on to. Call before exiting, or other clients
+// wait out the leases
+func Bflush() {
+	cache.mu.Lock()
+	cache.hold = 0
+	cache.mu.Unlock()
+	cache.expire()
+}
+
+func (c *bcache) cached(nr uint) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range c.ranges {
+		if nr >= r[0] && nr < r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Bget for a cached block. Waits for anyone else
+// in this client using it to let go, rather than
+// contending on the disk against ourselves
+func (c *bcache) get(nr uint) *Block {
+	nstr := fmt.Sprintf("%d", nr)
+
+	c.mu.Lock()
+	e, ok := c.ents[nr]
+	for ok && e.busy {
+		c.cond.Wait()
+		e, ok = c.ents[nr]
+	}
+	if !ok {
+		e = &centry{}
+		c.ents[nr] = e
+	}
+	e.busy = true
+	reuse := ok && time.Since(e.stamp) < renewAfter
+	renew := ok && !reuse
+	c.mu.Unlock()
+
+	if reuse {
+		return &Block{Nr: nr, Data: e.data}
+	} else if renew && c.dsk.Renew(nstr) == nil {
+		c.mu.Lock()
+		e.stamp = time.Now()
+		c.mu.Unlock()
+		return &Block{Nr: nr, Data: e.data}
+	}
+
+retry:
+	stamp := time.Now()
+	c.dsk.Acquire(nstr)
+	data, err := c.dsk.Get(nstr)
+	if err != nil {
+		log.Print("Warning: single operation too slow for lock lease")
+		goto retry
+	}
+
+	c.mu.Lock()
+	e.data = data
+	e.stamp = stamp
+	c.mu.Unlock()
+	return &Block{Nr: nr, Data: data}
+}
+
+// Keeps the cached copy in step with
+// what was pushed, or distrusts the lease
+// if the push failed
+func (c *bcache) pushed(nr uint, data string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.ents[nr]; ok && err == nil {
+		e.data = data
+	} else if ok {
+		e.stamp = time.Time{}
+	}
+}
+
+func (c *bcache) renewed(nr uint, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.ents[nr]; ok && err == nil {
+		e.stamp = time.Now()
+	} else if ok {
+		e.stamp = time.Time{}
+	}
+}
+
+// Parks a cached block. Returns false if the
+// lease should go back to the disk now: when we
+// don't have the block, or it's already parked,
+// as when the journal lets go of a block after
+// writing it home
+func (c *bcache) release(nr uint) bool {
+	c.mu.Lock()
+	e, ok := c.ents[nr]
+	if !ok || !e.busy {
+		delete(c.ents, nr)
+		c.mu.Unlock()
+		return false
+	}
+
+	e.busy = false
+	e.idle = time.Now()
+	c.cond.Broadcast()
+	if c.hold == 0 {
+		c.mu.Unlock()
+		c.expire()
+		return true
+	} else if !c.reaping {
+		c.reaping = true
+		go c.reap()
+	}
+	c.mu.Unlock()
+	return true
+}
+
+// Lets go of blocks that have been parked
+// for long enough, until there are none
+func (c *bcache) reap() {
+	for {
+		c.mu.Lock()
+		wait := c.hold / 2
+		c.mu.Unlock()
+		if wait < 10*time.Millisecond {
+			wait = 10 * time.Millisecond
+		}
+		time.Sleep(wait)
+
+		c.expire()
+		c.mu.Lock()
+		if len(c.ents) == 0 {
+			c.reaping = false
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *bcache) expire() {
+	c.mu.Lock()
+	done := []uint{}
+	for nr, e := range c.ents {
+		if !e.busy && time.Since(e.idle) >= c.hold {
+			done = append(done, nr)
+			delete(c.ents, nr)
+		}
+	}
+	c.mu.Unlock()
+
+	// Once it's out of the map, a Bget for the
+	// block goes to the disk and waits for this
+	for _, nr := range done {
+		c.dsk.Release(fmt.Sprintf("%d", nr))
+	}
+}
@@ -2,6 +2,7 @@ package bio
 
 import (
 	"errors"
+	"sync"
 	"time"
 )
 
@@ -13,13 +14,17 @@ type Disk interface {
 	Renew(lockk string) error
 }
 
-// Fake disk
+// Fake disk. The mutex only covers the map, so
+// background goroutines (lease renewal) can share it
 
 type MockDisk struct {
+	mu sync.Mutex
 	kv map[string]string
 }
 
 func (m *MockDisk) Get(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.kv["lock_"+key] != "1" {
 		return "", errors.New("lock not held")
 	}
@@ -27,6 +32,8 @@ func (m *MockDisk) Get(key string) (string, error) {
 }
 
 func (m *MockDisk) Put(key string, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.kv["lock_"+key] != "1" {
 		return errors.New("lock not held")
 	}
@@ -35,15 +42,21 @@ func (m *MockDisk) Put(key string, value string) error {
 }
 
 func (m *MockDisk) Acquire(lockk string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for m.kv["lock_"+lockk] == "1" {
-		// This disk is single threaded, if this
-		// happens we have a serious problem
+		// Only another goroutine can let go
+		// of it, so we'll hang if it's us
+		m.mu.Unlock()
 		time.Sleep(500 * time.Millisecond)
+		m.mu.Lock()
 	}
 	m.kv["lock_"+lockk] = "1"
 }
 
 func (m *MockDisk) Release(lockk string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.kv["lock_"+lockk] == "0" {
 		return errors.New("lock not held")
 	}
@@ -52,6 +65,8 @@ func (m *MockDisk) Release(lockk string) error {
 }
 
 func (m *MockDisk) Renew(lockk string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if m.kv["lock_"+lockk] == "0" {
 		// This disk is single threaded, if this
 		// happens we have a serious problem
@@ -0,0 +1,207 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"pp2/inode"
+	"pp2/jrnl"
+	"strings"
+)
+
+// Directories are plain inodes whose data is dirMagic
+// followed by one record per entry: a big-endian uint16
+// inum, a one-byte name length, then the name itself.
+// Empty directories have no data at all. Anything not
+// starting with dirMagic is the old text format, see
+// migrate.go
+type dirent struct {
+	name string
+	inum uint16
+}
+
+// Text directories never contain a NUL
+const dirMagic = "\x00\x01"
+const maxNameLen = 255
+const direntHdrLen = 3
+
+func isLegacyDir(raw string) bool {
+	return raw != "" && !strings.HasPrefix(raw, dirMagic)
+}
+
+// Returns whatever entries could be decoded, and an
+// error if the data was malformed
+func parseDir(raw string) ([]dirent, error) {
+	ents := []dirent{}
+	if raw == "" {
+		return ents, nil
+	} else if isLegacyDir(raw) {
+		return parseLegacyDir(raw), nil
+	}
+
+	b := []byte(raw[len(dirMagic):])
+	ents, n, err := parseEntries(b, -1)
+	if err == nil && n < len(b) {
+		err = errors.New("truncated directory entry")
+	}
+	return ents, err
+}
+
+// Decodes up to max records (any number if max < 0)
+// from the front of b, which needn't end on a record
+// boundary. Returns how many bytes the records took
+func parseEntries(b []byte, max int) ([]dirent, int, error) {
+	ents := []dirent{}
+	n := 0
+	for len(ents) != max && len(b)-n >= direntHdrLen {
+		inum := binary.BigEndian.Uint16(b[n:])
+		nlen := int(b[n+2])
+		if len(b)-n-direntHdrLen < nlen {
+			break
+		}
+
+		name := string(b[n+direntHdrLen : n+direntHdrLen+nlen])
+		if err := checkName(name); err != nil {
+			return ents, n, fmt.Errorf("bad directory entry %q: %s", name, err)
+		}
+		ents = append(ents, dirent{
+			name: name,
+			inum: inum,
+		})
+		n += direntHdrLen + nlen
+	}
+	return ents, n, nil
+}
+
+// Names are checked before they get here, see writeDir
+func flattenDir(ents []dirent) string {
+	if len(ents) == 0 {
+		return ""
+	}
+
+	b := []byte(dirMagic)
+	for _, ent := range ents {
+		var hdr [direntHdrLen]byte
+		binary.BigEndian.PutUint16(hdr[:], ent.inum)
+		hdr[2] = byte(len(ent.name))
+		b = append(b, hdr[:]...)
+		b = append(b, ent.name...)
+	}
+	return string(b)
+}
+
+// Anything goes in a name except slashes and NULs,
+// so long as it fits in the length byte
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return errors.New("invalid file name")
+	} else if len(name) > maxNameLen {
+		return errors.New("file name too long")
+	} else if strings.ContainsAny(name, "/\x00") {
+		return errors.New("invalid file name")
+	}
+	return nil
+}
+
+// The caller must hold dir. Malformed entries
+// are dropped, fsck is the place to find them
+func readDir(dir *inode.Inode) []dirent {
+	return readDirIn(nil, dir)
+}
+
+// readDir through t, for directories
+// that t might already have changed
+func readDirIn(t *jrnl.TxnHandle, dir *inode.Inode) []dirent {
+	ents, err := parseDir(dir.ReadIn(t, 0, dir.Filesize))
+	if err != nil {
+		fmt.Printf("Directory %d is damaged: %s\n", dir.Serialnum, err)
+	}
+	return ents
+}
+
+func findEntry(ents []dirent, name string) (uint16, bool) {
+	for _, ent := range ents {
+		if ent.name == name {
+			return ent.inum, true
+		}
+	}
+	return 0, false
+}
+
+// The caller must hold dir
+func lookup(dir *inode.Inode, name string) (uint16, bool) {
+	return findEntry(readDir(dir), name)
+}
+
+// Appends an entry to the held directory dir.
+// Enqueues the directory changes into t
+func addEntry(t *jrnl.TxnHandle, dir *inode.Inode, ent dirent) error {
+	raw := dir.ReadIn(t, 0, dir.Filesize)
+	if isLegacyDir(raw) {
+		// Nobody migrated this one yet
+		return writeDir(t, dir, append(parseLegacyDir(raw), ent))
+	}
+
+	// Skip the magic unless we're the first entry
+	rec := flattenDir([]dirent{ent})
+	if dir.Filesize > 0 {
+		rec = rec[len(dirMagic):]
+	}
+	if _, err := dir.Write(t, dir.Filesize, rec); err != nil {
+		return err
+	}
+	return dir.Touch(t, inode.MTime|inode.CTime)
+}
+
+// Replaces the contents of the held directory dir
+// with ents. Enqueues the directory changes into t.
+// Text directories can hold names the binary format
+// can't, so those fail here instead of being mangled
+func writeDir(t *jrnl.TxnHandle, dir *inode.Inode, ents []dirent) error {
+	for _, ent := range ents {
+		if err := checkName(ent.name); err != nil {
+			return fmt.Errorf("bad directory entry %q: %s", ent.name, err)
+		}
+	}
+	dir.Truncate(t)
+	if _, err := dir.Write(t, 0, flattenDir(ents)); err != nil {
+		return err
+	}
+	return dir.Touch(t, inode.MTime|inode.CTime)
+}
+
+// Returns ents without the entry called name,
+// and whether there was one to drop
+func dropEntry(ents []dirent, name string) ([]dirent, bool) {
+	for idx, ent := range ents {
+		if ent.name == name {
+			res := append([]dirent{}, ents[:idx]...)
+			return append(res, ents[idx+1:]...), true
+		}
+	}
+	return ents, false
+}
+
+// Returns ents with name pointing at inum, replacing
+// the existing entry for name if there is one
+func setEntry(ents []dirent, name string, inum uint16) []dirent {
+	res := append([]dirent{}, ents...)
+	for idx, ent := range res {
+		if ent.name == name {
+			res[idx].inum = inum
+			return res
+		}
+	}
+	return append(res, dirent{name: name, inum: inum})
+}
+
+// Drops the entry called name from the held
+// directory dir, rewriting the directory in full.
+// Enqueues the directory changes into t
+func removeEntry(t *jrnl.TxnHandle, dir *inode.Inode, name string) error {
+	ents, found := dropEntry(readDirIn(t, dir), name)
+	if !found {
+		return ErrNotExist
+	}
+	return writeDir(t, dir, ents)
+}
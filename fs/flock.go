@@ -0,0 +1,280 @@
+package fs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"pp2/bio"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Advisory whole-file locks, as with flock(2). Each
+// file's holders are kept in a named bio record next
+// to the blocks, one line per holder:
+//	<mode> <holder> <last renewal, holder's unix nanos>
+// The record's own kv lock only guards changes to the
+// list, like a block's. Holders renew their leases in
+// the background, so a client that dies loses its
+// locks once the lease runs out, as with block locks.
+// Clients' clocks needn't agree: a renewal time is
+// only ever compared with the last one seen, and a
+// holder has expired once another client has watched
+// it go a whole lease, by its own clock, unchanged.
+// The record is named for the file's generation too,
+// so a file reusing an inode doesn't inherit its locks
+
+type LockMode byte
+
+const (
+	LockShared LockMode = iota
+	LockExclusive
+)
+
+// Matches the kv server's lockLeaseTime. Each
+// mount takes its own copy
+var flockLease = 30 * time.Second
+
+// How long a blocking Lock waits between tries
+const flockRetry = 500 * time.Millisecond
+
+type flockHolder struct {
+	mode    LockMode
+	id      string
+	renewed int64
+}
+
+type heldLock struct {
+	h    Handle
+	mode LockMode
+}
+
+// When we first saw a holder with a renewal time
+type flockSighting struct {
+	renewed int64
+	at      time.Time
+}
+
+// This client's locks, by fd, and what it's seen
+// of others', by record and holder. Shared with the
+// renewal goroutine, which runs while any are held
+type flocks struct {
+	mu       sync.Mutex
+	owner    string
+	held     map[int]heldLock
+	seen     map[string]map[string]flockSighting
+	renewing bool
+	lease    time.Duration
+}
+
+// Owners have to be unique across every client
+func mkFlocks() *flocks {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return &flocks{
+		owner: hex.EncodeToString(b),
+		held:  make(map[int]heldLock),
+		seen:  make(map[string]map[string]flockSighting),
+		lease: flockLease,
+	}
+}
+
+func flockKey(h Handle) string {
+	return fmt.Sprintf("flock_%d_%d", h.inum, h.gen)
+}
+
+// Locks belong to fds, not clients, so two fds
+// on the same file still exclude each other
+func (l *flocks) holderId(fd int) string {
+	return fmt.Sprintf("%s.%d", l.owner, fd)
+}
+
+func parseFlock(data string) []flockHolder {
+	hs := []flockHolder{}
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		mode, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		renewed, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		hs = append(hs, flockHolder{
+			mode:    LockMode(mode),
+			id:      fields[1],
+			renewed: renewed,
+		})
+	}
+	return hs
+}
+
+func flattenFlock(hs []flockHolder) string {
+	res := ""
+	for _, h := range hs {
+		res += fmt.Sprintf("%d %s %d\n", h.mode, h.id, h.renewed)
+	}
+	return res
+}
+
+// Rewrites the holder list of the file h, dropping
+// expired holders and id itself, then calls update on
+// what's left. update returns the new list, or false
+// to leave the record alone. Returns update's verdict.
+// Call with l.mu held
+func (l *flocks) editFlock(h Handle, id string, update func([]flockHolder) ([]flockHolder, bool)) bool {
+	key := flockKey(h)
+retry:
+	r := bio.Rget(key)
+	now := time.Now()
+	seen := make(map[string]flockSighting)
+	others := []flockHolder{}
+	for _, o := range parseFlock(r.Data) {
+		if o.id == id {
+			continue
+		}
+		s, ok := l.seen[key][o.id]
+		if !ok || s.renewed != o.renewed {
+			s = flockSighting{renewed: o.renewed, at: now}
+		}
+		if now.Sub(s.at) < l.lease {
+			seen[o.id] = s
+			others = append(others, o)
+		}
+	}
+	if len(seen) > 0 {
+		l.seen[key] = seen
+	} else {
+		delete(l.seen, key)
+	}
+
+	hs, ok := update(others)
+	if !ok {
+		r.Rrelse()
+		return false
+	}
+	r.Data = flattenFlock(hs)
+	if r.Rpush() != bio.OK {
+		// Took longer than the record's lease
+		goto retry
+	}
+	r.Rrelse()
+	return true
+}
+
+// Takes out a lock on the file behind fd, waiting for
+// conflicting holders to let go unless nonblock is
+// set. A shared lock can be held alongside other
+// shared locks, an exclusive one alongside nothing.
+// Locking an fd that already holds a lock converts it
+func (f *Filesystem) Lock(fd int, mode LockMode, nonblock bool) error {
+	if _, ok := f.fdTable[fd]; !ok {
+		return ErrBadFd
+	} else if mode != LockShared && mode != LockExclusive {
+		return fmt.Errorf("invalid lock mode %d", mode)
+	}
+
+	file := f.fdTable[fd]
+	l := f.locks
+	id := l.holderId(fd)
+	me := flockHolder{mode: mode, id: id}
+	for {
+		// Hold off the renewer, or it could put
+		// back our old mode after we convert
+		l.mu.Lock()
+		me.renewed = time.Now().UnixNano()
+		got := l.editFlock(file.handle(), id, func(others []flockHolder) ([]flockHolder, bool) {
+			for _, h := range others {
+				if mode == LockExclusive || h.mode == LockExclusive {
+					return nil, false
+				}
+			}
+			return append(others, me), true
+		})
+		if got {
+			break
+		}
+		l.mu.Unlock()
+
+		if nonblock {
+			return ErrWouldBlock
+		}
+		time.Sleep(flockRetry)
+	}
+	defer l.mu.Unlock()
+
+	l.held[fd] = heldLock{h: file.handle(), mode: mode}
+	if !l.renewing {
+		l.renewing = true
+		go l.renew()
+	}
+	return nil
+}
+
+// Drops fd's lock, if it has one
+func (f *Filesystem) Unlock(fd int) error {
+	if _, ok := f.fdTable[fd]; !ok {
+		return ErrBadFd
+	}
+
+	l := f.locks
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if hl, ok := l.held[fd]; ok {
+		l.editFlock(hl.h, l.holderId(fd), func(others []flockHolder) ([]flockHolder, bool) {
+			return others, true
+		})
+		delete(l.held, fd)
+	}
+	return nil
+}
+
+// Pushes out the lease on every lock this client
+// holds, a few times per lease. Exits once none are
+// held. If a lease ran out anyway (say we were
+// partitioned away) and somebody has since taken a
+// conflicting lock, ours is gone
+func (l *flocks) renew() {
+	for {
+		time.Sleep(l.lease / 3)
+
+		l.mu.Lock()
+		if len(l.held) == 0 {
+			l.renewing = false
+			l.mu.Unlock()
+			return
+		}
+
+		for fd, hl := range l.held {
+			id := l.holderId(fd)
+			me := flockHolder{
+				mode:    hl.mode,
+				id:      id,
+				renewed: time.Now().UnixNano(),
+			}
+			kept := l.editFlock(hl.h, id, func(others []flockHolder) ([]flockHolder, bool) {
+				for _, h := range others {
+					if hl.mode == LockExclusive || h.mode == LockExclusive {
+						// Somebody took over after we expired
+						return nil, false
+					}
+				}
+				return append(others, me), true
+			})
+			if !kept {
+				log.Printf("Warning: lost lock on inode %d", hl.h.inum)
+				delete(l.held, fd)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
@@ -3,21 +3,61 @@ package fs
 import (
 	"errors"
 	"fmt"
+	"io"
+	"os"
 	"pp2/inode"
 	"pp2/jrnl"
-	"strconv"
 	"strings"
 )
 
+var (
+	ErrNotExist   = errors.New("no such file or directory")
+	ErrExist      = errors.New("file exists")
+	ErrNotDir     = errors.New("not a directory")
+	ErrIsDir      = errors.New("is a directory")
+	ErrNotEmpty   = errors.New("directory not empty")
+	ErrBadFd      = errors.New("no such fd")
+	ErrLoop       = errors.New("too many levels of symbolic links")
+	ErrWouldBlock = errors.New("resource temporarily unavailable")
+	ErrPerm       = errors.New("permission denied")
+	ErrMlink      = errors.New("too many links")
+)
+
+// Flags for Open. Exactly one of O_RDONLY, O_WRONLY
+// or O_RDWR must be given, or'd with any of the rest
+const (
+	O_RDONLY = os.O_RDONLY
+	O_WRONLY = os.O_WRONLY
+	O_RDWR   = os.O_RDWR
+	O_APPEND = os.O_APPEND // Every write goes at the end of the file
+	O_CREAT  = os.O_CREATE // Make the file if it doesn't exist
+	O_EXCL   = os.O_EXCL   // With O_CREAT, fail if it does exist
+	O_TRUNC  = os.O_TRUNC  // Empty the file, if opened for writing
+
+	accMode = O_RDONLY | O_WRONLY | O_RDWR
+)
+
 type Filesystem struct {
 	rooti   uint16
 	fdTable map[int]*File // file desc -> inode num
 	maxFd   int
+	locks   *flocks
+	cred    Cred
 }
 
 type File struct {
 	inum   uint16
+	gen    uint32 // Of inum when opened, see Handle
 	offset uint
+	flags  int
+}
+
+func (file *File) readable() bool {
+	return file.flags&accMode != O_WRONLY
+}
+
+func (file *File) writable() bool {
+	return file.flags&accMode != O_RDONLY
 }
 
 func (f *Filesystem) mkFd() int {
@@ -25,93 +65,487 @@ func (f *Filesystem) mkFd() int {
 	return f.maxFd - 1
 }
 
-func Mount() *Filesystem {
-	f := new(Filesystem)
-	f.fdTable = make(map[int]*File)
-
+// Every check this mount makes is against cred. A
+// fresh volume's root belongs to uid 0, open to all
+func Mount(cred Cred) *Filesystem {
+	f := newFilesystem(cred)
 	if !inode.Probei(0) {
 		t := jrnl.BeginTransaction()
 		root := inode.Alloci(t, inode.Dir)
-		root.Relse()
+		RootCred.own(root, 0777)
+		root.Perm = 0777
+		root.Touch(t, inode.ATime|inode.MTime|inode.CTime)
 		t.EndTransaction(false)
+		root.Relse()
 	}
 
 	f.rooti = 0
+	f.migrate()
 	return f
 }
 
-func (f *Filesystem) Open(fname string) int {
-	// Read the root directory
-	// Of the form "filename,inum filename,inum filename,inum"
-	var inum uint16
+// Like Mount, but writes nothing to the volume: a
+// fresh one gets no root, and text directories stay
+// as they are. For checking a volume without touching
+// it, as fsck does; nothing stops writes through it
+func MountReadOnly(cred Cred) *Filesystem {
+	return newFilesystem(cred)
+}
+
+// Another mount of the same volume, acting as cred,
+// e.g. for a server with several users. It has its
+// own fds and locks, like a separate client
+func (f *Filesystem) As(cred Cred) *Filesystem {
+	g := newFilesystem(cred)
+	g.rooti = f.rooti
+	return g
+}
 
-	rawroot := inode.Readi(f.rooti, 0, ^uint(0))
-	entries := strings.Split(rawroot, " ")
-	found := false
-	for _, entry := range entries {
-		data := strings.Split(entry, ",")
-		if data[0] == fname {
-			found = true
-			fmt.Printf("Found file %s\n", fname)
+// Who this mount acts as
+func (f *Filesystem) Cred() Cred {
+	return f.cred
+}
 
-			inum64, _ := strconv.ParseUint(data[1], 10, 16)
-			inum = uint16(inum64)
-			break
-		}
+func newFilesystem(cred Cred) *Filesystem {
+	f := new(Filesystem)
+	f.fdTable = make(map[int]*File)
+	f.locks = mkFlocks()
+	f.cred = cred
+	f.rooti = 0
+	return f
+}
+
+// Opens the file at path with the given flags.
+// Symlinks are followed, and with O_CREAT one that
+// dangles gets its target created. Directories can
+// only be opened read-only
+func (f *Filesystem) Open(path string, flags int) (int, error) {
+	return f.OpenPerm(path, flags, 0666)
+}
+
+// Like Open, but a file it makes gets the bits
+// perm, less the umask, as with open(2)'s mode
+func (f *Filesystem) OpenPerm(path string, flags int, perm uint16) (int, error) {
+	acc := flags & accMode
+	if acc != O_RDONLY && acc != O_WRONLY && acc != O_RDWR {
+		return -1, errors.New("invalid access mode")
 	}
 
-	if !found {
-		// Create the file
-		fmt.Printf("File %s not found, making it\n", fname)
+	var h Handle
+	var made bool
+	var err error
+	if flags&O_CREAT != 0 && flags&O_EXCL != 0 {
+		// Whatever is at path makes this fail,
+		// even a symlink, so don't follow one
+		var pinum uint16
+		var name string
+		pinum, name, err = f.nameiparent(path)
+		if err == nil {
+			h, made, err = create(&f.cred, pinum, name, inode.File, perm, "")
+		}
+		if err == nil && !made {
+			err = ErrExist
+		}
+	} else {
+		var comps []string
+		h, comps, err = f.walk(splitPath(path), true)
+		if err == ErrNotExist && comps != nil && flags&O_CREAT != 0 {
+			// Either path or the symlink it ends
+			// in names something that isn't there
+			resolved := "/" + strings.Join(comps, "/")
+			pinum, name, perr := f.nameiparent(resolved)
+			if perr != nil {
+				return -1, perr
+			}
 
-		t := jrnl.BeginTransaction()
-		newi := inode.Alloci(t, inode.File)
-		inode.Writei(t, f.rooti, uint(len(rawroot)), fmt.Sprintf("%s,%d ", fname, newi.Serialnum))
-		inum = newi.Serialnum
+			h, made, err = create(&f.cred, pinum, name, inode.File, perm, "")
+			if err == nil && !made {
+				// Raced with another create, which
+				// might have made a symlink
+				h, _, err = f.walk(splitPath(resolved), true)
+			}
+		}
+	}
+	if err != nil {
+		return -1, err
+	} else if made {
+		fmt.Printf("Made new file %s\n", path)
+	} else {
+		fmt.Printf("Found file %s\n", path)
+	}
 
-		t.EndTransaction(false)
-		fmt.Printf("Made new file %s\n", fname)
+	// Whoever makes a file may open it however
+	// they like, whatever its bits say
+	// h is what the walk found, so if that's been
+	// removed since, this fails rather than opening
+	// whatever took its inode
+	if !made {
+		i, err := h.geti()
+		if err != nil {
+			return -1, err
+		}
+		err = f.cred.check(i, openPerms(flags))
+		i.Relse()
+		if err != nil {
+			return -1, err
+		}
+	}
+	if !made && (acc != O_RDONLY || flags&O_TRUNC != 0) {
+		if err := openForWrite(h, flags); err != nil {
+			return -1, err
+		}
 	}
 
 	newFd := f.mkFd()
 	f.fdTable[newFd] = &File{
-		inum: inum,
+		inum:  h.inum,
+		gen:   h.gen,
+		flags: flags,
 	}
 
-	return newFd
+	return newFd, nil
+}
+
+func openPerms(flags int) uint16 {
+	want := uint16(0)
+	if flags&accMode != O_WRONLY {
+		want |= permR
+	}
+	if flags&accMode != O_RDONLY || flags&O_TRUNC != 0 {
+		want |= permW
+	}
+	return want
+}
+
+// Checks an existing file can be opened for
+// writing, and applies O_TRUNC if it's set
+func openForWrite(h Handle, flags int) error {
+	i, err := h.geti()
+	if err != nil {
+		return err
+	}
+	defer i.Relse()
+	if i.Mode == inode.Dir {
+		return ErrIsDir
+	} else if flags&accMode == O_RDONLY {
+		return errors.New("can't truncate a file opened read-only")
+	} else if flags&O_TRUNC == 0 || i.Filesize == 0 {
+		return nil
+	}
+
+	t := jrnl.BeginTransaction()
+	i.Truncate(t)
+	if err := i.Touch(t, inode.MTime|inode.CTime); err != nil {
+		t.AbortTransaction()
+		return err
+	}
+	t.EndTransaction(false)
+	return nil
+}
+
+// Makes a new, empty directory at path
+func (f *Filesystem) Mkdir(path string) error {
+	return f.MkdirPerm(path, 0777)
+}
+
+// Like Mkdir, with the bits perm less the umask
+func (f *Filesystem) MkdirPerm(path string, perm uint16) error {
+	pinum, name, err := f.nameiparent(path)
+	if err != nil {
+		return err
+	}
+
+	_, made, err := create(&f.cred, pinum, name, inode.Dir, perm, "")
+	if err != nil {
+		return err
+	} else if !made {
+		return ErrExist
+	}
+	return nil
+}
+
+// Removes the empty directory at path
+func (f *Filesystem) Rmdir(path string) error {
+	return f.remove(path, true)
+}
+
+// Removes the directory entry at path and drops the
+// file's link count. Once nothing links to the file,
+// its inode and data blocks are freed along with the
+// entry, in the same transaction
+func (f *Filesystem) Unlink(path string) error {
+	return f.remove(path, false)
+}
+
+// Shared by Rmdir and Unlink. Holds the parent and
+// then the child while the entry is removed
+func (f *Filesystem) remove(path string, isDir bool) error {
+	pinum, name, err := f.nameiparent(path)
+	if err != nil {
+		return err
+	}
+
+	dir, err := getDir(pinum)
+	if err != nil {
+		return err
+	}
+	defer dir.Relse()
+	if err := f.cred.check(dir, permW|permX); err != nil {
+		return err
+	}
+
+	inum, found := lookup(dir, name)
+	if !found {
+		return ErrNotExist
+	}
+
+	child := inode.Geti(inum)
+	if isDir && child.Mode != inode.Dir {
+		child.Relse()
+		return ErrNotDir
+	} else if !isDir && child.Mode == inode.Dir {
+		child.Relse()
+		return ErrIsDir
+	} else if isDir && len(readDir(child)) > 0 {
+		child.Relse()
+		return ErrNotEmpty
+	}
+
+	t := jrnl.BeginTransaction()
+	if err := removeEntry(t, dir, name); err != nil {
+		t.AbortTransaction()
+		child.Relse()
+		return err
+	}
+	if err := child.Touch(t, inode.CTime); err != nil {
+		t.AbortTransaction()
+		child.Relse()
+		return err
+	}
+	if err := child.Free(t); err != nil {
+		t.AbortTransaction()
+		child.Relse()
+		return err
+	}
+
+	t.EndTransaction(false)
+	return nil
+}
+
+// Links a new inode of the given mode into directory
+// pinum under name, unless something is already there.
+// The new inode starts out holding data, with bits
+// perm less c's umask.
+// Returns a handle on what name ends up naming, and
+// whether we made it. The directory is held across the
+// final lookup and the link, so two clients can't both
+// create the same name. The new inode belongs to c,
+// who needs write and search permission on pinum,
+// and to pinum's quota tree
+func create(c *Cred, pinum uint16, name string, mode inode.IType, perm uint16, data string) (Handle, bool, error) {
+	dir, err := getDir(pinum)
+	if err != nil {
+		return Handle{}, false, err
+	}
+	inum, found := lookup(dir, name)
+	var h Handle
+	if found {
+		h, err = entryHandle(dir, inum)
+	} else {
+		err = c.check(dir, permW|permX)
+	}
+	tree := dir.Tree
+	dir.Relse()
+	if found || err != nil {
+		return h, false, err
+	}
+
+	// Alloci might have to scan past the directory's
+	// inode, so we can't be holding it while we allocate.
+	// The new inode is held until the transaction ends,
+	// or another client could be handed it too
+	t := jrnl.BeginTransaction()
+	newi := inode.Alloci(t, mode)
+	defer newi.Relse()
+	c.own(newi, perm)
+	newi.Tree = tree
+	if err := newi.Charge(t, 0, 1); err != nil {
+		t.AbortTransaction()
+		return Handle{}, false, err
+	}
+	if data != "" {
+		if _, err := newi.Write(t, 0, data); err != nil {
+			t.AbortTransaction()
+			return Handle{}, false, err
+		}
+	}
+	if err := newi.Touch(t, inode.ATime|inode.MTime|inode.CTime); err != nil {
+		t.AbortTransaction()
+		return Handle{}, false, err
+	}
+
+	dir, err = getDir(pinum)
+	if err != nil {
+		t.AbortTransaction()
+		return Handle{}, false, err
+	}
+	defer dir.Relse()
+
+	// Somebody might have beaten us to it
+	if inum, found := lookup(dir, name); found {
+		t.AbortTransaction()
+		h, err := entryHandle(dir, inum)
+		return h, false, err
+	}
+	if err := addEntry(t, dir, dirent{name: name, inum: newi.Serialnum}); err != nil {
+		t.AbortTransaction()
+		return Handle{}, false, err
+	}
+
+	t.EndTransaction(false)
+	return Handle{inum: newi.Serialnum, gen: newi.Gen}, true, nil
 }
 
 func (f *Filesystem) Read(fd int, count uint) (string, error) {
 	if _, ok := f.fdTable[fd]; !ok {
-		return "", errors.New("no such fd")
+		return "", ErrBadFd
 	}
 
 	file := f.fdTable[fd]
-	content := inode.Readi(file.inum, file.offset, count)
+	if !file.readable() {
+		return "", errors.New("fd not open for reading")
+	}
+	i, err := file.handle().geti()
+	if err != nil {
+		return "", err
+	}
+	content := i.Read(file.offset, count)
+	i.Relse()
 	file.offset += uint(len(content))
 	return content, nil
 }
 
+// Like Read, but from an explicit offset. Doesn't
+// move the fd's offset
+func (f *Filesystem) ReadAt(fd int, offset uint, count uint) (string, error) {
+	if _, ok := f.fdTable[fd]; !ok {
+		return "", ErrBadFd
+	}
+
+	file := f.fdTable[fd]
+	if !file.readable() {
+		return "", errors.New("fd not open for reading")
+	}
+	i, err := file.handle().geti()
+	if err != nil {
+		return "", err
+	}
+	defer i.Relse()
+	return i.Read(offset, count), nil
+}
+
 func (f *Filesystem) Write(fd int, data string) (uint, error) {
 	if _, ok := f.fdTable[fd]; !ok {
-		return 0, errors.New("no such fd")
+		return 0, ErrBadFd
 	}
 
 	file := f.fdTable[fd]
+	cnt, end, err := writeAt(file, file.offset, data)
+	if err != nil {
+		return 0, err
+	}
+
+	file.offset = end
+	return cnt, nil
+}
+
+// Like Write, but to an explicit offset. Doesn't
+// move the fd's offset. As on Linux, if the fd was
+// opened with O_APPEND the offset is ignored
+func (f *Filesystem) WriteAt(fd int, offset uint, data string) (uint, error) {
+	if _, ok := f.fdTable[fd]; !ok {
+		return 0, ErrBadFd
+	}
+
+	cnt, _, err := writeAt(f.fdTable[fd], offset, data)
+	return cnt, err
+}
+
+// Does one write in its own transaction. Returns
+// the count and the offset just past the write.
+// O_APPEND writes find the end of the file while
+// holding the inode, so that appends from other
+// clients can't land in between
+func writeAt(file *File, offset uint, data string) (uint, uint, error) {
+	if !file.writable() {
+		return 0, 0, errors.New("fd not open for writing")
+	}
+
+	// Unlinked since we opened it, or reused for
+	// something else. Writing now would hand blocks
+	// to a free inode, or scribble on another file
+	i, err := file.handle().geti()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer i.Relse()
+	if i.Mode == inode.Dir {
+		return 0, 0, ErrIsDir
+	}
+	if file.flags&O_APPEND != 0 {
+		offset = i.Filesize
+	}
 
 	t := jrnl.BeginTransaction()
-	cnt, err := inode.Writei(t, file.inum, file.offset, data)
+	cnt, err := i.Write(t, offset, data)
+	if err == nil {
+		err = i.Touch(t, inode.MTime|inode.CTime)
+	}
 	if err != nil {
 		t.AbortTransaction()
-		return 0, err
+		return 0, 0, err
 	}
 
 	t.EndTransaction(false)
-	file.offset += cnt
-	return cnt, nil
+	return cnt, offset + cnt, nil
+}
 
+// Moves the fd's offset, relative to whence as in
+// io.SeekStart, io.SeekCurrent or io.SeekEnd. Seeking
+// past the end of the file is fine, but seeking before
+// the start isn't. Returns the new offset
+func (f *Filesystem) Seek(fd int, offset int64, whence int) (uint, error) {
+	if _, ok := f.fdTable[fd]; !ok {
+		return 0, ErrBadFd
+	}
+
+	file := f.fdTable[fd]
+	var base int64
+	switch whence {
+	case io.SeekStart:
+		base = 0
+	case io.SeekCurrent:
+		base = int64(file.offset)
+	case io.SeekEnd:
+		i, err := file.handle().geti()
+		if err != nil {
+			return 0, err
+		}
+		base = int64(i.Filesize)
+		i.Relse()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if base+offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	file.offset = uint(base + offset)
+	return file.offset, nil
 }
 
+// Closing an fd drops any lock it holds
 func (f *Filesystem) Close(fd int) {
+	f.Unlock(fd)
 	delete(f.fdTable, fd)
 }
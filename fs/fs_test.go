@@ -0,0 +1,2147 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"pp2/balloc"
+	"pp2/bio"
+	"pp2/inode"
+	"pp2/jrnl"
+	"pp2/quota"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests the filesystem api on top of the mock disk:
+//	-> Open, Read, Write, Close, Mkdir, Rmdir, Unlink, Rename
+//	-> Seek, ReadAt, WriteAt, Stat, Fstat
+//	-> Link, Symlink, Readlink
+//	-> Open flags
+//	-> Truncate, Ftruncate
+//	-> ReadDir, ReadDirPage
+//	-> Lock, Unlock
+//	-> Begin, Txn
+//	-> Fsck
+//	-> Setxattr, Getxattr, Listxattr, Removexattr
+//	-> Permissions, Chmod, Chown
+//	-> Quotas, SetUserQuota, SetTreeQuota
+//	-> Handles, StatHandle, OpenHandle
+//	-> Directory format, migration on Mount
+
+// Partitions:
+//	-> Open
+//		-> path in root, in a subdirectory
+//		-> parent missing (=FAIL), parent is a file (=FAIL)
+//	-> Mkdir
+//		-> in root, nested
+//		-> name already exists (=FAIL)
+//	-> Rmdir
+//		-> empty dir, non-empty dir (=FAIL), file (=FAIL)
+//	-> Unlink
+//		-> file with data, missing (=FAIL), dir (=FAIL)
+//		-> file still open elsewhere
+//	-> Rename
+//		-> same dir, across dirs
+//		-> target missing, target exists
+//		-> dir into its own subtree (=FAIL), dir over file (=FAIL)
+//	-> Seek
+//		-> whence = start, current, end
+//		-> result < 0 (=FAIL), > len(file)
+//	-> ReadAt/WriteAt
+//		-> offset inside the file, at the end, past the end (a hole for write)
+//		-> offset past the direct blocks, gigabytes in (sparse)
+//		-> every block written, past the direct blocks
+//	-> Stat/Fstat
+//		-> new file, after a write, directory, missing (=FAIL)
+//	-> Names
+//		-> contain spaces/commas, contain NUL (=FAIL), too long (=FAIL)
+//	-> Mount
+//		-> fresh, text-format directories present
+//		-> text name too long for the new format (=FAIL)
+//		-> text entry for an inode never made, or past the last
+//	-> Link
+//		-> file, directory (=FAIL), name exists (=FAIL)
+//		-> unlink one name, unlink both
+//		-> too many links (=FAIL)
+//	-> Symlink
+//		-> absolute target, relative target, to a directory
+//		-> dangling, loop (=FAIL)
+//		-> renamed through a symlinked parent
+//		-> renamed through a link to a parent, or ".."
+//	-> Open flags
+//		-> missing without O_CREAT (=FAIL), O_CREAT|O_EXCL on existing (=FAIL)
+//		-> O_EXCL on a dangling symlink (=FAIL)
+//		-> read on O_WRONLY (=FAIL), write on O_RDONLY (=FAIL)
+//		-> O_TRUNC, O_TRUNC|O_RDONLY (=FAIL), dir for writing (=FAIL)
+//		-> O_APPEND from two fds
+//	-> Truncate/Ftruncate
+//		-> shrink, grow, directory (=FAIL), read-only fd (=FAIL)
+//	-> ReadDir/ReadDirPage
+//		-> empty dir, one page, many pages
+//		-> file (=FAIL), page size 0 (=FAIL)
+//		-> cursor inside a record (=FAIL), entry for a missing inode
+//	-> Lock/Unlock
+//		-> shared with shared, exclusive with anything (=FAIL if nonblock)
+//		-> same client different fds, different clients
+//		-> blocking until the holder unlocks, closing drops the lock
+//		-> lease kept alive by renewal, lease expires after holder dies
+//		-> holder's clock far behind, file reusing a locked file's inode
+//	-> Txn
+//		-> commit, abort
+//		-> write to an existing fd, to a created fd
+//		-> several creates in one dir, create then unlink in one txn
+//		-> create existing (=FAIL), use after commit (=FAIL)
+//		-> rename, truncate and chmod, committed and aborted
+//	-> Fsck
+//		-> clean volume, with a sparse file
+//		-> leaked, unmarked and double-allocated blocks
+//		-> orphan, bad refcnt, bad directory entry, bad inode map
+//		-> check only, repair
+//		-> bad and shared pointer blocks
+//		-> check only on a volume Mount would migrate
+//		-> orphan whose link doesn't take
+//		-> kept block count off
+//		-> tree head tagged with another tree
+//		-> no room to copy shared blocks into
+//	-> Xattrs
+//		-> set new, replace, remove, missing (=FAIL)
+//		-> through a symlink, kept across unlink of another link
+//		-> too big (=FAIL), bad name (=FAIL)
+//	-> Permissions
+//		-> as owner, as group, as other, as root
+//		-> read, write, list, search (=FAIL without each bit)
+//		-> create, unlink, rename in a read-only dir (=FAIL)
+//		-> new files owned by the creator, umask applied, with given bits
+//		-> Chmod by owner, by other (=FAIL)
+//		-> Chown by root, to own group, away (=FAIL)
+//	-> Quotas
+//		-> user blocks, user inodes (=FAIL over the limit), unlink gives back
+//		-> tree adopts what's there, new inodes inherit
+//		-> renamed or linked in or out (=FAIL), renamed within, head renamed
+//		-> chown moves usage, set by non-root (=FAIL)
+//		-> fsck fixes drifted usage, cleared and set again
+//		-> tree set inside another, then the outer one
+//	-> Handles
+//		-> stat and open by handle, survives a rename, packs into a uint64
+//		-> file removed and its inode reused: handle, open fd (=FAIL)
+//		-> never allocated (=FAIL)
+//		-> open fd has the handle path names, directory listing itself (=FAIL)
+
+func initUut() *Filesystem {
+	bio.Binit("", true)
+	jrnl.InitSb()
+	balloc.InitBalloc(inode.EndInode)
+	quota.InitQuota(balloc.EndData())
+	inode.InodeInit()
+	return Mount(RootCred)
+}
+
+func mustOpen(tt *testing.T, f *Filesystem, path string) int {
+	fd, err := f.Open(path, O_RDWR|O_CREAT)
+	if err != nil {
+		tt.Fatalf("failed to open %s: %s", path, err)
+	}
+	return fd
+}
+
+// Covers:
+//	-> open/root
+//	-> open/subdir
+//	-> mkdir/root
+//	-> mkdir/nested
+func TestNestedOpen(tt *testing.T) {
+	f := initUut()
+	if err := f.Mkdir("/a"); err != nil {
+		tt.Fatalf("failed to mkdir /a: %s", err)
+	}
+	if err := f.Mkdir("/a/b"); err != nil {
+		tt.Fatalf("failed to mkdir /a/b: %s", err)
+	}
+
+	fd := mustOpen(tt, f, "/a/b/c")
+	if _, err := f.Write(fd, "nested"); err != nil {
+		tt.Errorf("failed to write: %s", err)
+	}
+	f.Close(fd)
+
+	fd = mustOpen(tt, f, "a/./b/../b/c")
+	data, err := f.Read(fd, 100)
+	if err != nil {
+		tt.Errorf("failed to read: %s", err)
+	} else if data != "nested" {
+		tt.Errorf("read %v vs. expected nested", data)
+	}
+	f.Close(fd)
+
+	fd = mustOpen(tt, f, "/c")
+	data, _ = f.Read(fd, 100)
+	if data != "" {
+		tt.Errorf("root c should be a different, empty file, read %v", data)
+	}
+	f.Close(fd)
+}
+
+// Covers:
+//	-> open/parentmissing
+//	-> open/parentfile
+//	-> mkdir/exists
+func TestBadPaths(tt *testing.T) {
+	f := initUut()
+	if _, err := f.Open("/nope/file", O_RDWR|O_CREAT); err == nil {
+		tt.Errorf("opened a file under a missing directory")
+	}
+
+	fd := mustOpen(tt, f, "/file")
+	f.Close(fd)
+	if _, err := f.Open("/file/other", O_RDWR|O_CREAT); err == nil {
+		tt.Errorf("opened a file under a regular file")
+	}
+	if err := f.Mkdir("/file"); err == nil {
+		tt.Errorf("made a directory over an existing file")
+	}
+}
+
+// Covers:
+//	-> rmdir/empty
+//	-> rmdir/nonempty
+//	-> rmdir/file
+func TestRmdir(tt *testing.T) {
+	f := initUut()
+	if err := f.Mkdir("/d"); err != nil {
+		tt.Fatalf("failed to mkdir /d: %s", err)
+	}
+	fd := mustOpen(tt, f, "/d/f")
+	f.Close(fd)
+
+	if err := f.Rmdir("/d"); err == nil {
+		tt.Errorf("removed a non-empty directory")
+	}
+	if err := f.Rmdir("/d/f"); err == nil {
+		tt.Errorf("removed a file with rmdir")
+	}
+
+	if err := f.Mkdir("/d/e"); err != nil {
+		tt.Fatalf("failed to mkdir /d/e: %s", err)
+	}
+	if err := f.Rmdir("/d/e"); err != nil {
+		tt.Errorf("failed to remove empty directory: %s", err)
+	}
+	if _, err := f.Open("/d/e/x", O_RDWR|O_CREAT); err == nil {
+		tt.Errorf("opened a file under a removed directory")
+	}
+
+	fd = mustOpen(tt, f, "/d/f")
+	f.Close(fd)
+}
+
+// Covers:
+//	-> unlink/withdata
+//	-> unlink/missing
+//	-> unlink/dir
+//	-> unlink/stillopen
+func TestUnlink(tt *testing.T) {
+	f := initUut()
+	fd := mustOpen(tt, f, "/f")
+	if _, err := f.Write(fd, "some data"); err != nil {
+		tt.Errorf("failed to write: %s", err)
+	}
+
+	if err := f.Unlink("/f"); err != nil {
+		tt.Errorf("failed to unlink: %s", err)
+	}
+	if _, err := f.Write(fd, "more"); err == nil {
+		tt.Errorf("wrote to an unlinked file")
+	}
+	f.Close(fd)
+
+	if err := f.Unlink("/f"); err == nil {
+		tt.Errorf("unlinked a missing file")
+	}
+
+	fd = mustOpen(tt, f, "/f")
+	data, _ := f.Read(fd, 100)
+	if data != "" {
+		tt.Errorf("recreated file has old data %v", data)
+	}
+	f.Close(fd)
+
+	if err := f.Mkdir("/d"); err != nil {
+		tt.Fatalf("failed to mkdir /d: %s", err)
+	}
+	if err := f.Unlink("/d"); err == nil {
+		tt.Errorf("unlinked a directory")
+	}
+}
+
+func readAll(tt *testing.T, f *Filesystem, path string) string {
+	fd := mustOpen(tt, f, path)
+	defer f.Close(fd)
+	data, err := f.Read(fd, 4096)
+	if err != nil {
+		tt.Errorf("failed to read %s: %s", path, err)
+	}
+	return data
+}
+
+func writeAll(tt *testing.T, f *Filesystem, path string, data string) {
+	fd := mustOpen(tt, f, path)
+	defer f.Close(fd)
+	if _, err := f.Write(fd, data); err != nil {
+		tt.Errorf("failed to write %s: %s", path, err)
+	}
+}
+
+// Covers:
+//	-> rename/samedir
+//	-> rename/targetexists
+//	-> rename/targetmissing
+func TestRenameReplace(tt *testing.T) {
+	f := initUut()
+	writeAll(tt, f, "/config", "old")
+	writeAll(tt, f, "/config.tmp", "new")
+
+	if err := f.Rename("/config.tmp", "/config"); err != nil {
+		tt.Fatalf("failed to rename: %s", err)
+	}
+	if data := readAll(tt, f, "/config"); data != "new" {
+		tt.Errorf("read %v vs. expected new", data)
+	}
+	if err := f.Unlink("/config.tmp"); err == nil {
+		tt.Errorf("old name still exists after rename")
+	}
+
+	if err := f.Rename("/config", "/other"); err != nil {
+		tt.Fatalf("failed to rename: %s", err)
+	}
+	if data := readAll(tt, f, "/other"); data != "new" {
+		tt.Errorf("read %v vs. expected new", data)
+	}
+}
+
+// Covers:
+//	-> rename/acrossdirs
+//	-> rename/subtree
+//	-> rename/diroverfile
+func TestRenameAcrossDirs(tt *testing.T) {
+	f := initUut()
+	for _, d := range []string{"/a", "/b", "/a/sub"} {
+		if err := f.Mkdir(d); err != nil {
+			tt.Fatalf("failed to mkdir %s: %s", d, err)
+		}
+	}
+	writeAll(tt, f, "/a/sub/f", "moved")
+	writeAll(tt, f, "/b/g", "file")
+
+	if err := f.Rename("/a", "/a/sub/a"); err == nil {
+		tt.Errorf("moved a directory inside itself")
+	}
+	if err := f.Rename("/a/sub", "/b/g"); err == nil {
+		tt.Errorf("moved a directory over a file")
+	}
+
+	if err := f.Rename("/a/sub", "/b/sub"); err != nil {
+		tt.Fatalf("failed to rename: %s", err)
+	}
+	if data := readAll(tt, f, "/b/sub/f"); data != "moved" {
+		tt.Errorf("read %v vs. expected moved", data)
+	}
+	if err := f.Rmdir("/a"); err != nil {
+		tt.Errorf("source dir should be empty after the move: %s", err)
+	}
+}
+
+// Covers:
+//	-> seek/start
+//	-> seek/current
+//	-> seek/end
+//	-> seek/negative
+//	-> seek/pastend
+func TestSeek(tt *testing.T) {
+	f := initUut()
+	fd := mustOpen(tt, f, "/f")
+	defer f.Close(fd)
+	if _, err := f.Write(fd, "0123456789"); err != nil {
+		tt.Fatalf("failed to write: %s", err)
+	}
+
+	if off, err := f.Seek(fd, 2, io.SeekStart); err != nil || off != 2 {
+		tt.Errorf("seek to 2 gave %d, %v", off, err)
+	}
+	if data, _ := f.Read(fd, 3); data != "234" {
+		tt.Errorf("read %v vs. expected 234", data)
+	}
+	if off, err := f.Seek(fd, -1, io.SeekCurrent); err != nil || off != 4 {
+		tt.Errorf("seek back 1 gave %d, %v", off, err)
+	}
+	if off, err := f.Seek(fd, -2, io.SeekEnd); err != nil || off != 8 {
+		tt.Errorf("seek to end-2 gave %d, %v", off, err)
+	}
+	if data, _ := f.Read(fd, 100); data != "89" {
+		tt.Errorf("read %v vs. expected 89", data)
+	}
+
+	if _, err := f.Seek(fd, -11, io.SeekEnd); err == nil {
+		tt.Errorf("seeked before the start of the file")
+	}
+	if off, err := f.Seek(fd, 5, io.SeekEnd); err != nil || off != 15 {
+		tt.Errorf("seek past end gave %d, %v", off, err)
+	}
+}
+
+// Covers:
+//	-> readat/inside
+//	-> readat/atend
+//	-> writeat/inside
+//	-> writeat/atend
+//	-> writeat/pastend
+func TestPositional(tt *testing.T) {
+	f := initUut()
+	fd := mustOpen(tt, f, "/f")
+	defer f.Close(fd)
+	if _, err := f.Write(fd, "hello"); err != nil {
+		tt.Fatalf("failed to write: %s", err)
+	}
+
+	if _, err := f.WriteAt(fd, 1, "EL"); err != nil {
+		tt.Errorf("failed to write inside: %s", err)
+	}
+	if _, err := f.WriteAt(fd, 5, " world"); err != nil {
+		tt.Errorf("failed to write at end: %s", err)
+	}
+	if data, _ := f.ReadAt(fd, 0, 100); data != "hELlo world" {
+		tt.Errorf("read %v vs. expected hELlo world", data)
+	}
+	if data, _ := f.ReadAt(fd, 11, 100); data != "" {
+		tt.Errorf("read %v at the end of the file", data)
+	}
+
+	if _, err := f.WriteAt(fd, 8000, "far"); err != nil {
+		tt.Errorf("failed to write past the end: %s", err)
+	}
+	if data, _ := f.ReadAt(fd, 7998, 100); data != "\x00\x00far" {
+		tt.Errorf("read %q vs. expected a hole then far", data)
+	}
+	if st, _ := f.Fstat(fd); st.Size != 8003 || st.Blocks != 2 {
+		tt.Errorf("got size %d in %d blocks, wanted 8003 in 2", st.Size, st.Blocks)
+	}
+	f.Truncate("/f", 11)
+
+	// Neither call moved the fd's offset
+	if _, err := f.Write(fd, "J"); err != nil {
+		tt.Errorf("failed to write: %s", err)
+	}
+	if data, _ := f.ReadAt(fd, 0, 100); data != "hELloJworld" {
+		tt.Errorf("read %v vs. expected hELloJworld", data)
+	}
+}
+
+// Covers:
+//	-> stat/newfile
+//	-> stat/afterwrite
+//	-> stat/dir
+//	-> stat/missing
+func TestStat(tt *testing.T) {
+	f := initUut()
+	if _, err := f.Stat("/f"); err == nil {
+		tt.Errorf("stat a missing file")
+	}
+
+	fd := mustOpen(tt, f, "/f")
+	defer f.Close(fd)
+	st, err := f.Stat("/f")
+	if err != nil {
+		tt.Fatalf("failed to stat: %s", err)
+	}
+	if st.Mode != inode.File || st.Size != 0 || st.Nlink != 1 {
+		tt.Errorf("bad stat for new file: %v", *st)
+	}
+	if st.Mtime.IsZero() || st.Ctime.IsZero() || st.Atime.IsZero() {
+		tt.Errorf("new file has unset times: %v", *st)
+	}
+
+	if _, err := f.Write(fd, "hello"); err != nil {
+		tt.Fatalf("failed to write: %s", err)
+	}
+	fst, err := f.Fstat(fd)
+	if err != nil {
+		tt.Fatalf("failed to fstat: %s", err)
+	}
+	if fst.Size != 5 || fst.Inum != st.Inum {
+		tt.Errorf("bad stat after write: %v", *fst)
+	}
+	if !fst.Mtime.After(st.Mtime) {
+		tt.Errorf("write didn't move mtime: %v vs. %v", fst.Mtime, st.Mtime)
+	}
+
+	if err := f.Mkdir("/d"); err != nil {
+		tt.Fatalf("failed to mkdir: %s", err)
+	}
+	if st, err = f.Stat("/d"); err != nil || st.Mode != inode.Dir {
+		tt.Errorf("bad stat for directory: %v, %v", st, err)
+	}
+}
+
+// Covers:
+//	-> names/spaces
+//	-> names/nul
+//	-> names/toolong
+func TestOddNames(tt *testing.T) {
+	f := initUut()
+	writeAll(tt, f, "/a b,c", "odd")
+	writeAll(tt, f, "/a", "plain")
+	if data := readAll(tt, f, "/a b,c"); data != "odd" {
+		tt.Errorf("read %v vs. expected odd", data)
+	}
+	if data := readAll(tt, f, "/a"); data != "plain" {
+		tt.Errorf("read %v vs. expected plain", data)
+	}
+
+	if _, err := f.Open("/a\x00b", O_RDWR|O_CREAT); err == nil {
+		tt.Errorf("opened a name with a NUL in it")
+	}
+	if _, err := f.Open("/"+strings.Repeat("n", 256), O_RDWR|O_CREAT); err == nil {
+		tt.Errorf("opened a name that's too long")
+	}
+}
+
+// Covers:
+//	-> mount/textdirs
+func TestMigrate(tt *testing.T) {
+	f := initUut()
+
+	// Lay out /sub/f by hand the old way
+	t := jrnl.BeginTransaction()
+	sub := inode.Alloci(t, inode.Dir)
+	sub.Relse()
+	file := inode.Alloci(t, inode.File)
+	file.Relse()
+	t.EndTransaction(false)
+
+	t = jrnl.BeginTransaction()
+	inode.Writei(t, f.rooti, 0, fmt.Sprintf("sub,%d ", sub.Serialnum))
+	inode.Writei(t, sub.Serialnum, 0, fmt.Sprintf("f,%d ", file.Serialnum))
+	inode.Writei(t, file.Serialnum, 0, "legacy")
+	t.EndTransaction(false)
+
+	f = Mount(RootCred)
+	for _, inum := range []uint16{f.rooti, sub.Serialnum} {
+		if raw := inode.Readi(inum, 0, 4096); !strings.HasPrefix(raw, dirMagic) {
+			tt.Errorf("directory %d wasn't migrated: %q", inum, raw)
+		}
+	}
+	if data := readAll(tt, f, "/sub/f"); data != "legacy" {
+		tt.Errorf("read %v vs. expected legacy", data)
+	}
+}
+
+// Covers:
+//	-> mount/textlongname
+func TestMigrateLongName(tt *testing.T) {
+	f := initUut()
+
+	t := jrnl.BeginTransaction()
+	sub := inode.Alloci(t, inode.Dir)
+	sub.Relse()
+	file := inode.Alloci(t, inode.File)
+	file.Relse()
+	t.EndTransaction(false)
+
+	long := strings.Repeat("n", 300)
+	t = jrnl.BeginTransaction()
+	inode.Writei(t, f.rooti, 0, fmt.Sprintf("sub,%d ", sub.Serialnum))
+	inode.Writei(t, sub.Serialnum, 0, fmt.Sprintf("f,%d %s,%d ", file.Serialnum, long, file.Serialnum))
+	inode.Writei(t, file.Serialnum, 0, "legacy")
+	t.EndTransaction(false)
+
+	// Neither sub nor the root above it can be
+	// migrated without losing the long name
+	f = Mount(RootCred)
+	for _, inum := range []uint16{f.rooti, sub.Serialnum} {
+		if raw := inode.Readi(inum, 0, 4096); strings.HasPrefix(raw, dirMagic) {
+			tt.Errorf("directory %d was migrated: %q", inum, raw)
+		}
+	}
+	if data := readAll(tt, f, "/sub/f"); data != "legacy" {
+		tt.Errorf("read %v vs. expected legacy", data)
+	}
+	if _, err := f.Open("/sub/g", O_RDWR|O_CREAT); err == nil {
+		tt.Errorf("rewrote a directory with a name too long for it")
+	}
+	if raw := inode.Readi(sub.Serialnum, 0, 4096); !strings.Contains(raw, long) {
+		tt.Errorf("lost the long name: %q", raw)
+	}
+}
+
+// Covers:
+//	-> mount/textdangling
+func TestMigrateDangling(tt *testing.T) {
+	f := initUut()
+
+	t := jrnl.BeginTransaction()
+	file := inode.Alloci(t, inode.File)
+	file.Relse()
+	t.EndTransaction(false)
+
+	// One never made, one past the last inode
+	t = jrnl.BeginTransaction()
+	inode.Writei(t, f.rooti, 0, fmt.Sprintf("f,%d ghost,%d far,60000 ", file.Serialnum, file.Serialnum+100))
+	t.EndTransaction(false)
+
+	f = Mount(RootCred)
+	if raw := inode.Readi(f.rooti, 0, 4096); !strings.HasPrefix(raw, dirMagic) {
+		tt.Errorf("root wasn't migrated: %q", raw)
+	}
+	if ents, err := f.ReadDir("/"); err != nil || len(ents) != 1 || ents[0].Name != "f" {
+		tt.Errorf("listed %v, %v after migrating", ents, err)
+	}
+}
+
+// Covers:
+//	-> link/file
+//	-> link/dir
+//	-> link/exists
+//	-> link/unlinkone
+//	-> link/unlinkboth
+func TestLink(tt *testing.T) {
+	f := initUut()
+	writeAll(tt, f, "/a", "shared")
+	if err := f.Mkdir("/d"); err != nil {
+		tt.Fatalf("failed to mkdir: %s", err)
+	}
+
+	if err := f.Link("/a", "/d/b"); err != nil {
+		tt.Fatalf("failed to link: %s", err)
+	}
+	if err := f.Link("/d", "/e"); err == nil {
+		tt.Errorf("linked a directory")
+	}
+	if err := f.Link("/a", "/d/b"); err == nil {
+		tt.Errorf("linked over an existing name")
+	}
+
+	st, err := f.Stat("/d/b")
+	if err != nil {
+		tt.Fatalf("failed to stat: %s", err)
+	} else if st.Nlink != 2 {
+		tt.Errorf("%d links, wanted 2", st.Nlink)
+	}
+
+	writeAll(tt, f, "/d/b", "SHARED")
+	if err := f.Unlink("/a"); err != nil {
+		tt.Fatalf("failed to unlink: %s", err)
+	}
+	if data := readAll(tt, f, "/d/b"); data != "SHARED" {
+		tt.Errorf("read %v vs. expected SHARED", data)
+	}
+	if err := f.Unlink("/d/b"); err != nil {
+		tt.Fatalf("failed to unlink: %s", err)
+	}
+	if err := f.Rmdir("/d"); err != nil {
+		tt.Errorf("dir should be empty: %s", err)
+	}
+}
+
+// Covers:
+//	-> link/toomany
+func TestLinkMax(tt *testing.T) {
+	f := initUut()
+	writeAll(tt, f, "/a", "data")
+	inum, err := f.namei("/a")
+	if err != nil {
+		tt.Fatalf("failed to find /a: %s", err)
+	}
+
+	// Making 65000 real links takes too long
+	fsckSetRefcnt(inum, maxLinks-1)
+	if err := f.Link("/a", "/b"); err != nil {
+		tt.Fatalf("failed to link: %s", err)
+	}
+	if err := f.Link("/a", "/c"); err != ErrMlink {
+		tt.Errorf("got %v linking past the limit vs. expected ErrMlink", err)
+	}
+	st, err := f.Stat("/a")
+	if err != nil {
+		tt.Fatalf("failed to stat: %s", err)
+	} else if st.Nlink != maxLinks {
+		tt.Errorf("got %d links vs. expected %d", st.Nlink, maxLinks)
+	}
+}
+
+// Covers:
+//	-> symlink/absolute
+//	-> symlink/relative
+//	-> symlink/dir
+//	-> symlink/dangling
+//	-> symlink/loop
+func TestSymlink(tt *testing.T) {
+	f := initUut()
+	if err := f.Mkdir("/d"); err != nil {
+		tt.Fatalf("failed to mkdir: %s", err)
+	}
+	writeAll(tt, f, "/d/f", "target")
+
+	links := map[string]string{
+		"/abs":    "/d/f",
+		"/d/rel":  "f",
+		"/dl":     "d",
+		"/d/up":   "../dl/f",
+		"/dangle": "/d/new",
+		"/loop1":  "loop2",
+		"/loop2":  "/loop1",
+	}
+	for path, target := range links {
+		if err := f.Symlink(target, path); err != nil {
+			tt.Fatalf("failed to symlink %s: %s", path, err)
+		}
+	}
+	if err := f.Symlink("x", "/abs"); err == nil {
+		tt.Errorf("made a symlink over an existing name")
+	}
+
+	for _, path := range []string{"/abs", "/d/rel", "/dl/f", "/d/up", "/dl/rel"} {
+		if data := readAll(tt, f, path); data != "target" {
+			tt.Errorf("read %v through %s vs. expected target", data, path)
+		}
+	}
+	if target, err := f.Readlink("/dl/up"); err != nil || target != "../dl/f" {
+		tt.Errorf("readlink gave %v, %v", target, err)
+	}
+	if _, err := f.Readlink("/d/f"); err == nil {
+		tt.Errorf("readlink on a regular file")
+	}
+
+	// Opening a dangling link makes its target
+	writeAll(tt, f, "/dangle", "new")
+	if data := readAll(tt, f, "/d/new"); data != "new" {
+		tt.Errorf("read %v vs. expected new", data)
+	}
+
+	if _, err := f.Open("/loop1", O_RDWR|O_CREAT); err != ErrLoop {
+		tt.Errorf("got %v opening a loop, wanted %v", err, ErrLoop)
+	}
+	if _, err := f.Stat("/loop2/x"); err != ErrLoop {
+		tt.Errorf("got %v walking through a loop, wanted %v", err, ErrLoop)
+	}
+
+	// Removing the link leaves the target alone
+	if err := f.Unlink("/abs"); err != nil {
+		tt.Fatalf("failed to unlink: %s", err)
+	}
+	if data := readAll(tt, f, "/d/f"); data != "target" {
+		tt.Errorf("read %v vs. expected target", data)
+	}
+}
+
+// Covers:
+//	-> symlink/renamethrough
+func TestRenameThroughSymlink(tt *testing.T) {
+	f := initUut()
+	for _, d := range []string{"/a", "/a/sub"} {
+		if err := f.Mkdir(d); err != nil {
+			tt.Fatalf("failed to mkdir %s: %s", d, err)
+		}
+	}
+	if err := f.Symlink("/a/sub", "/s"); err != nil {
+		tt.Fatalf("failed to symlink: %s", err)
+	}
+
+	if err := f.Rename("/a", "/s/a"); err == nil {
+		tt.Errorf("moved a directory inside itself through a symlink")
+	}
+	if err := f.Rename("/s", "/t"); err != nil {
+		tt.Fatalf("failed to rename the link: %s", err)
+	}
+	if _, err := f.Stat("/a/sub"); err != nil {
+		tt.Errorf("link rename moved the target: %s", err)
+	}
+}
+
+// Covers:
+//	-> symlink/renameancestry
+func TestRenameAncestry(tt *testing.T) {
+	f := initUut()
+	for _, d := range []string{"/a", "/a/sub"} {
+		if err := f.Mkdir(d); err != nil {
+			tt.Fatalf("failed to mkdir %s: %s", d, err)
+		}
+	}
+	writeAll(tt, f, "/a/sub/f", "data")
+	if err := f.Symlink("..", "/a/sub/up"); err != nil {
+		tt.Fatalf("failed to symlink: %s", err)
+	}
+	if err := f.Symlink("/a", "/a/sub/top"); err != nil {
+		tt.Fatalf("failed to symlink: %s", err)
+	}
+
+	for _, p := range []string{"/a/sub/up/x", "/a/sub/top/sub/x", "/a/sub/../sub/x"} {
+		if err := f.Rename("/a", p); err == nil {
+			tt.Errorf("moved a directory inside itself as %s", p)
+		}
+	}
+	if err := f.Rename("/a/sub/up/sub", "/a"); err != ErrNotEmpty {
+		tt.Errorf("got %v replacing a parent vs. expected ErrNotEmpty", err)
+	}
+	if err := f.Rename("/a/sub/top/sub/f", "/a/sub/up"); err != nil {
+		tt.Errorf("failed to replace a link to a parent: %s", err)
+	}
+	if _, err := f.Stat("/a/sub/top"); err != nil {
+		tt.Errorf("lost the tree: %s", err)
+	}
+}
+
+// Covers:
+//	-> flags/nocreat
+//	-> flags/excl
+//	-> flags/excldangling
+//	-> flags/rdonly
+//	-> flags/wronly
+//	-> flags/trunc
+//	-> flags/truncrdonly
+//	-> flags/dirwrite
+//	-> flags/append
+func TestOpenFlags(tt *testing.T) {
+	f := initUut()
+	if _, err := f.Open("/f", O_RDWR); err != ErrNotExist {
+		tt.Errorf("got %v opening a missing file, wanted %v", err, ErrNotExist)
+	}
+	fd, err := f.Open("/f", O_WRONLY|O_CREAT|O_EXCL)
+	if err != nil {
+		tt.Fatalf("failed to create: %s", err)
+	}
+	if _, err := f.Open("/f", O_RDWR|O_CREAT|O_EXCL); err != ErrExist {
+		tt.Errorf("got %v on exclusive create of an existing file, wanted %v", err, ErrExist)
+	}
+	if err := f.Symlink("/nowhere", "/dangle"); err != nil {
+		tt.Fatalf("failed to symlink: %s", err)
+	}
+	if _, err := f.Open("/dangle", O_RDWR|O_CREAT|O_EXCL); err != ErrExist {
+		tt.Errorf("got %v on exclusive create through a symlink, wanted %v", err, ErrExist)
+	}
+
+	if _, err := f.Write(fd, "0123456789"); err != nil {
+		tt.Fatalf("failed to write: %s", err)
+	}
+	if _, err := f.Read(fd, 10); err == nil {
+		tt.Errorf("read from a write-only fd")
+	}
+	f.Close(fd)
+
+	fd, err = f.Open("/f", O_RDONLY)
+	if err != nil {
+		tt.Fatalf("failed to open: %s", err)
+	}
+	if _, err := f.Write(fd, "x"); err == nil {
+		tt.Errorf("wrote to a read-only fd")
+	}
+	f.Close(fd)
+
+	if _, err := f.Open("/f", O_RDONLY|O_TRUNC); err == nil {
+		tt.Errorf("truncated a file opened read-only")
+	}
+	if err := f.Mkdir("/d"); err != nil {
+		tt.Fatalf("failed to mkdir: %s", err)
+	}
+	if _, err := f.Open("/d", O_WRONLY); err != ErrIsDir {
+		tt.Errorf("got %v opening a dir for writing, wanted %v", err, ErrIsDir)
+	}
+
+	fd, err = f.Open("/f", O_RDWR|O_TRUNC)
+	if err != nil {
+		tt.Fatalf("failed to open: %s", err)
+	}
+	if st, _ := f.Fstat(fd); st.Size != 0 {
+		tt.Errorf("size %d after O_TRUNC, wanted 0", st.Size)
+	}
+	f.Close(fd)
+
+	// Two appenders never clobber each other,
+	// wherever their own offsets are
+	a, err := f.Open("/f", O_WRONLY|O_APPEND)
+	if err != nil {
+		tt.Fatalf("failed to open: %s", err)
+	}
+	b, err := f.Open("/f", O_WRONLY|O_APPEND)
+	if err != nil {
+		tt.Fatalf("failed to open: %s", err)
+	}
+	for _, w := range []struct {
+		fd   int
+		data string
+	}{{a, "one"}, {b, "two"}, {a, "three"}} {
+		if _, err := f.Write(w.fd, w.data); err != nil {
+			tt.Fatalf("failed to append: %s", err)
+		}
+	}
+	if _, err := f.WriteAt(b, 0, "four"); err != nil {
+		tt.Fatalf("failed to append: %s", err)
+	}
+	f.Close(a)
+	f.Close(b)
+
+	if data := readAll(tt, f, "/f"); data != "onetwothreefour" {
+		tt.Errorf("read %v vs. expected onetwothreefour", data)
+	}
+}
+
+// Covers:
+//	-> truncate/shrink
+//	-> truncate/grow
+//	-> truncate/dir
+//	-> truncate/rdonly
+func TestTruncate(tt *testing.T) {
+	f := initUut()
+	writeAll(tt, f, "/f", "0123456789")
+
+	if err := f.Truncate("/f", 4); err != nil {
+		tt.Fatalf("failed to truncate: %s", err)
+	}
+	if data := readAll(tt, f, "/f"); data != "0123" {
+		tt.Errorf("read %v vs. expected 0123", data)
+	}
+
+	fd := mustOpen(tt, f, "/f")
+	if err := f.Ftruncate(fd, 6); err != nil {
+		tt.Fatalf("failed to ftruncate: %s", err)
+	}
+	if st, _ := f.Fstat(fd); st.Size != 6 {
+		tt.Errorf("size %d vs. expected 6", st.Size)
+	}
+	f.Close(fd)
+	if data := readAll(tt, f, "/f"); data != "0123\x00\x00" {
+		tt.Errorf("read %q vs. expected zero fill", data)
+	}
+
+	if err := f.Mkdir("/d"); err != nil {
+		tt.Fatalf("failed to mkdir: %s", err)
+	}
+	if err := f.Truncate("/d", 0); err != ErrIsDir {
+		tt.Errorf("got %v truncating a dir, wanted %v", err, ErrIsDir)
+	}
+	fd, err := f.Open("/f", O_RDONLY)
+	if err != nil {
+		tt.Fatalf("failed to open: %s", err)
+	}
+	if err := f.Ftruncate(fd, 0); err == nil {
+		tt.Errorf("truncated through a read-only fd")
+	}
+	f.Close(fd)
+}
+
+// Covers:
+//	-> readdir/empty
+//	-> readdir/onepage
+//	-> readdir/manypages
+//	-> readdir/file
+//	-> readdir/zero
+//	-> readdir/badcursor
+//	-> readdir/dangling
+func TestReadDirPage(tt *testing.T) {
+	f := initUut()
+	if err := f.Mkdir("/d"); err != nil {
+		tt.Fatalf("failed to mkdir: %s", err)
+	}
+	if ents, next, err := f.ReadDirPage("/d", 0, 4); err != nil || len(ents) != 0 || next != 0 {
+		tt.Errorf("listed %v, %d, %v in an empty dir", ents, next, err)
+	}
+
+	want := []string{}
+	for idx := 0; idx < 10; idx++ {
+		name := strings.Repeat(fmt.Sprint(idx), idx+1)
+		writeAll(tt, f, "/d/"+name, name)
+		want = append(want, name)
+	}
+	if err := f.Mkdir("/d/sub"); err != nil {
+		tt.Fatalf("failed to mkdir: %s", err)
+	}
+	want = append(want, "sub")
+
+	all, err := f.ReadDir("/d")
+	if err != nil || len(all) != len(want) {
+		tt.Fatalf("listed %v, %v", all, err)
+	}
+	if ents, next, err := f.ReadDirPage("/d", 0, 100); err != nil || len(ents) != len(want) || next != 0 {
+		tt.Errorf("one page gave %d entries, next %d, %v", len(ents), next, err)
+	}
+
+	got := []DirEntry{}
+	cursor, pages := uint(0), 0
+	for {
+		ents, next, err := f.ReadDirPage("/d", cursor, 3)
+		if err != nil {
+			tt.Fatalf("failed to list: %s", err)
+		} else if len(ents) > 3 {
+			tt.Errorf("page of %d entries, wanted at most 3", len(ents))
+		}
+		got = append(got, ents...)
+		pages++
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	if pages != 4 || len(got) != len(want) {
+		tt.Fatalf("got %d entries over %d pages", len(got), pages)
+	}
+	for idx := range got {
+		if got[idx] != all[idx] || got[idx].Name != want[idx] {
+			tt.Errorf("entry %d is %v, wanted %s", idx, got[idx], want[idx])
+		}
+	}
+	if got[len(got)-1].Mode != inode.Dir || got[0].Mode != inode.File {
+		tt.Errorf("wrong modes in %v", got)
+	}
+
+	// Only cursors we handed out land on a record,
+	// and one moved off its record fails its check
+	cursors := []uint{}
+	for cursor := uint(0); ; {
+		_, next, _ := f.ReadDirPage("/d", cursor, 1)
+		if next == 0 {
+			break
+		}
+		cursors = append(cursors, next)
+		cursor = next
+	}
+	if len(cursors) != len(want)-1 {
+		tt.Fatalf("got %d cursors for %d entries", len(cursors), len(want))
+	}
+	for _, cursor := range cursors {
+		if _, _, err := f.ReadDirPage("/d", cursor, 3); err != nil {
+			tt.Errorf("cursor %x gave %v", cursor, err)
+		}
+		for _, bad := range []uint{cursor - 1, cursor + 1, cursor ^ 1<<40, cursor & cursorOffMask} {
+			if _, _, err := f.ReadDirPage("/d", bad, 3); err == nil {
+				tt.Errorf("cursor %x was taken", bad)
+			}
+		}
+	}
+	dinum, _ := f.namei("/d")
+
+	// An entry for an inode that was never made
+	t := jrnl.BeginTransaction()
+	dir := inode.Geti(dinum)
+	if err := addEntry(t, dir, dirent{name: "ghost", inum: 9999}); err != nil {
+		tt.Fatalf("failed to add an entry: %s", err)
+	}
+	t.EndTransaction(false)
+	dir.Relse()
+	if ents, err := f.ReadDir("/d"); err != nil || len(ents) != len(want) {
+		tt.Errorf("listed %v, %v with a dangling entry", ents, err)
+	}
+
+	if _, _, err := f.ReadDirPage("/d/0", 0, 3); err != ErrNotDir {
+		tt.Errorf("got %v listing a file, wanted %v", err, ErrNotDir)
+	}
+	if _, _, err := f.ReadDirPage("/d", 0, 0); err == nil {
+		tt.Errorf("listed a page of size 0")
+	}
+}
+
+// Covers:
+//	-> lock/shared
+//	-> lock/exclusive
+//	-> lock/samefds
+//	-> lock/otherclient
+//	-> lock/blocking
+//	-> lock/close
+func TestLock(tt *testing.T) {
+	f1 := initUut()
+	f2 := Mount(RootCred)
+	a := mustOpen(tt, f1, "/f")
+	b := mustOpen(tt, f1, "/f")
+	c := mustOpen(tt, f2, "/f")
+
+	if err := f1.Lock(a, LockShared, true); err != nil {
+		tt.Fatalf("failed to lock: %s", err)
+	}
+	if err := f2.Lock(c, LockShared, true); err != nil {
+		tt.Fatalf("failed to share a lock: %s", err)
+	}
+	if err := f1.Lock(b, LockExclusive, true); err != ErrWouldBlock {
+		tt.Errorf("got %v taking an exclusive lock over shared ones", err)
+	}
+
+	// Converting needs everyone else gone
+	if err := f1.Lock(a, LockExclusive, true); err != ErrWouldBlock {
+		tt.Errorf("got %v upgrading a shared lock", err)
+	}
+	f2.Close(c)
+	if err := f1.Lock(a, LockExclusive, true); err != nil {
+		tt.Fatalf("failed to upgrade: %s", err)
+	}
+	if err := f1.Lock(b, LockShared, true); err != ErrWouldBlock {
+		tt.Errorf("got %v sharing an exclusive lock from another fd", err)
+	}
+
+	c = mustOpen(tt, f2, "/f")
+	done := make(chan error)
+	go func() {
+		done <- f2.Lock(c, LockExclusive, false)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-done:
+		tt.Fatalf("blocking lock returned %v while the file was locked", err)
+	default:
+	}
+
+	if err := f1.Unlock(a); err != nil {
+		tt.Fatalf("failed to unlock: %s", err)
+	}
+	if err := <-done; err != nil {
+		tt.Fatalf("failed to lock after waiting: %s", err)
+	}
+	f2.Close(c)
+	if err := f1.Lock(b, LockExclusive, true); err != nil {
+		tt.Errorf("close didn't drop the lock: %s", err)
+	}
+	f1.Close(a)
+	f1.Close(b)
+}
+
+// Covers:
+//	-> lock/renewed
+//	-> lock/expired
+//	-> lock/skewedclock
+//	-> lock/reusedinode
+func TestLockLease(tt *testing.T) {
+	old := flockLease
+	flockLease = 300 * time.Millisecond
+	defer func() { flockLease = old }()
+
+	f1 := initUut()
+	f2 := Mount(RootCred)
+	a := mustOpen(tt, f1, "/f")
+	b := mustOpen(tt, f2, "/f")
+
+	if err := f1.Lock(a, LockExclusive, true); err != nil {
+		tt.Fatalf("failed to lock: %s", err)
+	}
+	time.Sleep(3 * flockLease)
+	if err := f2.Lock(b, LockShared, true); err != ErrWouldBlock {
+		tt.Errorf("got %v, lock should have been renewed", err)
+	}
+
+	// f1 dies without unlocking. f2 only counts
+	// the lease from when it sees the last renewal
+	f1.locks.mu.Lock()
+	delete(f1.locks.held, a)
+	f1.locks.mu.Unlock()
+	if err := lockWithin(f2, b, LockShared, 3*flockLease); err != nil {
+		tt.Errorf("dead client's lock never expired: %s", err)
+	}
+	f2.Unlock(b)
+
+	// A holder whose clock is far behind ours is
+	// still live until its renewals stop
+	st, _ := f2.Stat("/f")
+	r := bio.Rget(flockKey(st.Handle))
+	r.Data = flattenFlock([]flockHolder{{mode: LockExclusive, id: "slow.0", renewed: 1}})
+	r.Rpush()
+	r.Rrelse()
+	if err := f2.Lock(b, LockShared, true); err != ErrWouldBlock {
+		tt.Errorf("got %v, lock with an old renewal time was taken as expired", err)
+	}
+	if err := lockWithin(f2, b, LockShared, 3*flockLease); err != nil {
+		tt.Errorf("lock that stopped being renewed never expired: %s", err)
+	}
+	f2.Close(b)
+
+	// A file reusing the inode starts out unlocked
+	c := mustOpen(tt, f2, "/g")
+	if err := f2.Lock(c, LockExclusive, true); err != nil {
+		tt.Fatalf("failed to lock: %s", err)
+	}
+	gst, _ := f2.Stat("/g")
+	f2.Unlink("/g")
+	d := mustOpen(tt, f1, "/h")
+	if st, _ := f1.Stat("/h"); st.Inum != gst.Inum {
+		tt.Fatalf("/h got inode %d, not /g's %d", st.Inum, gst.Inum)
+	}
+	if err := f1.Lock(d, LockExclusive, true); err != nil {
+		tt.Errorf("new file came with the old one's lock: %s", err)
+	}
+	f1.Close(d)
+	f2.Close(c)
+}
+
+// Blocking Lock, giving up after d
+func lockWithin(f *Filesystem, fd int, mode LockMode, d time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Lock(fd, mode, false)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(d):
+		return fmt.Errorf("still waiting after %v", d)
+	}
+}
+
+// Covers:
+//	-> txn/commit
+//	-> txn/existingfd
+//	-> txn/createdfd
+//	-> txn/manycreates
+//	-> txn/createunlink
+//	-> txn/exists
+//	-> txn/done
+func TestTxnCommit(tt *testing.T) {
+	f := initUut()
+	if err := f.Mkdir("/ledger"); err != nil {
+		tt.Fatalf("failed to mkdir: %s", err)
+	}
+	writeAll(tt, f, "/ledger/index", "0:")
+	idx := mustOpen(tt, f, "/ledger/index")
+	if _, err := f.Seek(idx, 0, io.SeekEnd); err != nil {
+		tt.Fatalf("failed to seek: %s", err)
+	}
+
+	x := f.Begin()
+	data, err := x.Create("/ledger/data1")
+	if err != nil {
+		tt.Fatalf("failed to create: %s", err)
+	}
+	if _, err := x.Create("/ledger/data2"); err != nil {
+		tt.Fatalf("failed to create a second file: %s", err)
+	}
+	if _, err := x.Create("/ledger/data1"); err != ErrExist {
+		tt.Errorf("got %v creating over a file made in this txn, wanted %v", err, ErrExist)
+	}
+	if _, err := x.Create("/ledger/index"); err != ErrExist {
+		tt.Errorf("got %v creating over an existing file, wanted %v", err, ErrExist)
+	}
+	for _, w := range []struct {
+		fd   int
+		data string
+	}{{data, "alpha"}, {idx, "data1"}, {data, "beta"}} {
+		if _, err := x.Write(w.fd, w.data); err != nil {
+			tt.Fatalf("failed to write: %s", err)
+		}
+	}
+	if err := x.Unlink("/ledger/data2"); err != nil {
+		tt.Errorf("failed to unlink a file made in this txn: %s", err)
+	}
+	if err := x.Commit(); err != nil {
+		tt.Fatalf("failed to commit: %s", err)
+	}
+	if _, err := x.Write(data, "late"); err != ErrTxnDone {
+		tt.Errorf("got %v writing after commit, wanted %v", err, ErrTxnDone)
+	}
+
+	// Offsets moved on commit
+	if _, err := f.Write(idx, ";"); err != nil {
+		tt.Fatalf("failed to write: %s", err)
+	}
+	f.Close(idx)
+	f.Close(data)
+
+	if got := readAll(tt, f, "/ledger/index"); got != "0:data1;" {
+		tt.Errorf("read %v vs. expected 0:data1;", got)
+	}
+	if got := readAll(tt, f, "/ledger/data1"); got != "alphabeta" {
+		tt.Errorf("read %v vs. expected alphabeta", got)
+	}
+	ents, err := f.ReadDir("/ledger")
+	if err != nil || len(ents) != 2 {
+		tt.Errorf("listed %v, %v; wanted index and data1", ents, err)
+	}
+}
+
+// Covers:
+//	-> txn/abort
+func TestTxnAbort(tt *testing.T) {
+	f := initUut()
+	writeAll(tt, f, "/keep", "old")
+	writeAll(tt, f, "/gone", "still here")
+	fd := mustOpen(tt, f, "/keep")
+
+	x := f.Begin()
+	if _, err := x.Write(fd, "new data"); err != nil {
+		tt.Fatalf("failed to write: %s", err)
+	}
+	made, err := x.Create("/made")
+	if err != nil {
+		tt.Fatalf("failed to create: %s", err)
+	}
+	if err := x.Unlink("/gone"); err != nil {
+		tt.Fatalf("failed to unlink: %s", err)
+	}
+	if err := x.Abort(); err != nil {
+		tt.Fatalf("failed to abort: %s", err)
+	}
+	if err := x.Commit(); err != ErrTxnDone {
+		tt.Errorf("got %v committing after abort, wanted %v", err, ErrTxnDone)
+	}
+
+	if data, _ := f.Read(fd, 100); data != "old" {
+		tt.Errorf("read %v vs. expected old", data)
+	}
+	f.Close(fd)
+	if _, err := f.Stat("/made"); err != ErrNotExist {
+		tt.Errorf("got %v for a file created in an aborted txn", err)
+	}
+	if _, err := f.Write(made, "x"); err != ErrBadFd {
+		tt.Errorf("got %v writing to an aborted txn's fd, wanted %v", err, ErrBadFd)
+	}
+	if data := readAll(tt, f, "/gone"); data != "still here" {
+		tt.Errorf("read %v vs. expected still here", data)
+	}
+
+	// Nothing leaked: both inodes are still usable
+	writeAll(tt, f, "/after", "fine")
+	if data := readAll(tt, f, "/after"); data != "fine" {
+		tt.Errorf("read %v vs. expected fine", data)
+	}
+}
+
+// Covers:
+//	-> txn/metadata
+func TestTxnMetadata(tt *testing.T) {
+	f := initUut()
+	f.Mkdir("/d")
+	writeAll(tt, f, "/d/a", "some data")
+	writeAll(tt, f, "/d/b", "replaced")
+
+	// Aborted, nothing changes
+	x := f.Begin()
+	if err := x.Rename("/d/a", "/d/b"); err != nil {
+		tt.Fatalf("failed to rename: %s", err)
+	}
+	if err := x.Truncate("/d/b", 4); err != nil {
+		tt.Fatalf("failed to truncate: %s", err)
+	}
+	if err := x.Chmod("/d/b", 0600); err != nil {
+		tt.Fatalf("failed to chmod: %s", err)
+	}
+	x.Abort()
+	if data := readAll(tt, f, "/d/a"); data != "some data" {
+		tt.Errorf("read %q from a after abort", data)
+	}
+	if st, _ := f.Stat("/d/b"); st == nil || st.Size != 8 || st.Perm != 0644 {
+		tt.Errorf("b is %v after abort", st)
+	}
+
+	// Committed, all of it does
+	x = f.Begin()
+	x.Rename("/d/a", "/d/b")
+	x.Truncate("/d/b", 4)
+	x.Chmod("/d/b", 0600)
+	if err := x.Commit(); err != nil {
+		tt.Fatalf("failed to commit: %s", err)
+	}
+	if _, err := f.Stat("/d/a"); err != ErrNotExist {
+		tt.Errorf("got %v for a after the rename", err)
+	}
+	if data := readAll(tt, f, "/d/b"); data != "some" {
+		tt.Errorf("read %q from b after commit", data)
+	}
+	if st, _ := f.Stat("/d/b"); st == nil || st.Perm != 0600 {
+		tt.Errorf("b is %v after commit", st)
+	}
+	if rep := f.Fsck(false); len(rep.Problems) != 0 {
+		tt.Errorf("found %v", rep.Problems)
+	}
+}
+
+// Changes inum on disk behind the filesystem's back
+func corrupt(tt *testing.T, inum uint16, change func(i *inode.Inode)) {
+	t := jrnl.BeginTransaction()
+	i := inode.Geti(inum)
+	change(i)
+	if err := i.EnqWrite(t); err != nil {
+		tt.Fatalf("failed to corrupt inode %d: %s", inum, err)
+	}
+	t.EndTransaction(false)
+	i.Relse()
+}
+
+func fsckKinds(ps []FsckProblem) map[FsckKind]int {
+	res := make(map[FsckKind]int)
+	for _, p := range ps {
+		res[p.Kind]++
+	}
+	return res
+}
+
+// Covers:
+//	-> fsck/clean
+func TestFsckClean(tt *testing.T) {
+	f := initUut()
+	writeAll(tt, f, "/a", strings.Repeat("a", 5000))
+	f.Mkdir("/d")
+	writeAll(tt, f, "/d/x", "x")
+	f.Link("/d/x", "/y")
+	f.Symlink("/d/x", "/s")
+	fd := mustOpen(tt, f, "/sparse")
+	f.WriteAt(fd, 100000, "end")
+	f.Close(fd)
+
+	rep := f.Fsck(false)
+	if len(rep.Problems) != 0 {
+		tt.Errorf("clean volume has problems: %v", rep.Problems)
+	}
+	// Two for /a and one for the end of /sparse.
+	// Everything else is small enough to be inline
+	if rep.Inodes != 6 || rep.Blocks != 3 {
+		tt.Errorf("counted %d inodes and %d blocks, wanted 6 and 3", rep.Inodes, rep.Blocks)
+	}
+}
+
+// Covers:
+//	-> fsck/leaked, fsck/unmarked, fsck/double
+//	-> fsck/orphan, fsck/refcnt, fsck/dirent, fsck/imap
+//	-> fsck/check, fsck/repair
+func TestFsckRepair(tt *testing.T) {
+	// Big enough to take a block each
+	apple := "apple" + strings.Repeat(".", 3000)
+	f := initUut()
+	writeAll(tt, f, "/a", apple)
+	f.Mkdir("/d")
+	writeAll(tt, f, "/d/x", "xylophone"+strings.Repeat(".", 3000))
+
+	a, _ := f.Stat("/a")
+	x, _ := f.Stat("/d/x")
+	d, _ := f.Stat("/d")
+
+	// /d/x loses its block and shares /a's,
+	// whose bitmap bit gets cleared
+	var shared uint
+	corrupt(tt, a.Inum, func(i *inode.Inode) {
+		shared = i.Extents[0].Start
+		i.Refcnt = 3
+	})
+	corrupt(tt, x.Inum, func(i *inode.Inode) {
+		i.Extents = []inode.Extent{{Block: 0, Start: shared, Len: 1}}
+		i.Filesize = uint(len(apple))
+	})
+
+	// An entry for a free inode, and a truncated record
+	t := jrnl.BeginTransaction()
+	dir := inode.Geti(d.Inum)
+	ents := readDir(dir)
+	raw := flattenDir(append(ents, dirent{name: "ghost", inum: 9000})) + "\x00"
+	dir.Truncate(t)
+	dir.Write(t, 0, raw)
+	t.EndTransaction(false)
+	dir.Relse()
+
+	// Last, so nothing above allocates the shared block
+	t = jrnl.BeginTransaction()
+	orphan := inode.Alloci(t, inode.File)
+	orphan.Write(t, 0, "lost")
+	balloc.Mark(t, []uint{shared}, false)
+	balloc.Mark(t, []uint{shared + 100}, true)
+	inode.MarkMap(t, []uint16{d.Inum}, false)
+	inode.MarkMap(t, []uint16{9001}, true)
+	t.EndTransaction(false)
+	orphan.Relse()
+
+	rep := f.Fsck(false)
+	kinds := fsckKinds(rep.Problems)
+	want := map[FsckKind]int{
+		FsckLeakedBlock:   2, // shared + 100, and /d/x's old block
+		FsckUnmarkedBlock: 1,
+		FsckDoubleBlock:   1,
+		FsckOrphan:        1,
+		FsckBadRefcnt:     1,
+		FsckBadDirent:     2,
+		FsckBadInodeMap:   2,
+	}
+	for kind, cnt := range want {
+		if kinds[kind] != cnt {
+			tt.Errorf("found %d of %s, wanted %d: %v", kinds[kind], kind, cnt, rep.Problems)
+		}
+	}
+	if rep.Repaired {
+		tt.Errorf("checking alone repaired the volume")
+	}
+
+	rep = f.Fsck(true)
+	if !rep.Repaired || len(rep.Left) != 0 {
+		tt.Fatalf("repair left %v", rep.Left)
+	}
+	if rep = f.Fsck(false); len(rep.Problems) != 0 {
+		tt.Errorf("repaired volume has problems: %v", rep.Problems)
+	}
+
+	if got := readAll(tt, f, "/a"); got != apple {
+		tt.Errorf("read %.10q vs. expected apple", got)
+	}
+	if got := readAll(tt, f, "/d/x"); got != apple {
+		tt.Errorf("read %.10q vs. expected /d/x's copy of apple", got)
+	}
+	if st, _ := f.Stat("/a"); st.Nlink != 1 {
+		tt.Errorf("/a has %d links after repair, wanted 1", st.Nlink)
+	}
+	name := fmt.Sprintf("/lost+found/#%d", orphan.Serialnum)
+	if got := readAll(tt, f, name); got != "lost" {
+		tt.Errorf("read %v from %s vs. expected lost", got, name)
+	}
+	ents2, _ := f.ReadDir("/d")
+	if len(ents2) != 1 || ents2[0].Name != "x" {
+		tt.Errorf("/d has %v after repair, wanted just x", ents2)
+	}
+
+	// Copies are independent now
+	fd := mustOpen(tt, f, "/d/x")
+	f.Write(fd, "A")
+	f.Close(fd)
+	if got := readAll(tt, f, "/a"); got != apple {
+		tt.Errorf("read %.10q vs. expected apple", got)
+	}
+}
+
+// Covers:
+//	-> fsck/blockcount
+func TestFsckBlockCount(tt *testing.T) {
+	f := initUut()
+	writeAll(tt, f, "/a", strings.Repeat("a", 3*4096))
+	a, _ := f.Stat("/a")
+	corrupt(tt, a.Inum, func(i *inode.Inode) {
+		i.Blocks = 7
+	})
+
+	rep := f.Fsck(true)
+	if kinds := fsckKinds(rep.Problems); kinds[FsckBadBlockCount] != 1 {
+		tt.Errorf("found %v, wanted one bad block count", rep.Problems)
+	} else if len(rep.Left) != 0 {
+		tt.Errorf("repair left %v", rep.Left)
+	}
+	if a, _ = f.Stat("/a"); a.Blocks != 3 {
+		tt.Errorf("stat has %d blocks after repair, wanted 3", a.Blocks)
+	}
+}
+
+// Covers:
+//	-> fsck/readonly
+//	-> fsck/adoptbound
+func TestFsckReadOnly(tt *testing.T) {
+	f := initUut()
+
+	// A text directory, which Mount would migrate
+	t := jrnl.BeginTransaction()
+	file := inode.Alloci(t, inode.File)
+	file.Relse()
+	t.EndTransaction(false)
+	t = jrnl.BeginTransaction()
+	legacy := fmt.Sprintf("f,%d ", file.Serialnum)
+	inode.Writei(t, f.rooti, 0, legacy)
+	t.EndTransaction(false)
+
+	MountReadOnly(RootCred).Fsck(false)
+	if raw := inode.Readi(f.rooti, 0, 4096); raw != legacy {
+		tt.Errorf("checking changed the root to %q", raw)
+	}
+
+	// A scan that keeps saying the file is an
+	// orphan, as if linking it never took
+	f = Mount(RootCred)
+	s := &fsckScan{
+		problems: []FsckProblem{{Kind: FsckOrphan, Inum: file.Serialnum}},
+		dirs:     make(map[uint16][]dirent),
+	}
+	adopted := make(map[uint16]bool)
+	links := 0
+	for f.fsckAdopt(s, adopted) {
+		links++
+		if links > 1 {
+			tt.Fatalf("linked the same orphan again")
+		}
+	}
+	if ents, err := f.ReadDir("/lost+found"); err != nil || len(ents) != 1 {
+		tt.Errorf("lost+found has %v, %v", ents, err)
+	}
+}
+
+// Covers:
+//	-> xattrs/new, xattrs/replace, xattrs/remove, xattrs/missing
+//	-> xattrs/symlink, xattrs/link
+//	-> xattrs/toobig, xattrs/badname
+func TestXattr(tt *testing.T) {
+	f := initUut()
+	writeAll(tt, f, "/a", "data")
+	f.Link("/a", "/b")
+	f.Symlink("/a", "/s")
+
+	if names, err := f.Listxattr("/a"); err != nil || len(names) != 0 {
+		tt.Errorf("new file has attributes %v, %v", names, err)
+	}
+	if err := f.Setxattr("/a", "type", "text/plain"); err != nil {
+		tt.Fatalf("failed to set: %s", err)
+	}
+	if err := f.Setxattr("/s", "team", "storage"); err != nil {
+		tt.Fatalf("failed to set through a symlink: %s", err)
+	}
+	if err := f.Setxattr("/a", "type", "text/csv"); err != nil {
+		tt.Errorf("failed to replace: %s", err)
+	}
+
+	names, err := f.Listxattr("/b")
+	if err != nil || strings.Join(names, ",") != "team,type" {
+		tt.Errorf("listed %v, %v; wanted team and type", names, err)
+	}
+	if v, err := f.Getxattr("/b", "type"); err != nil || v != "text/csv" {
+		tt.Errorf("got %v, %v; wanted text/csv", v, err)
+	}
+	if _, err := f.Getxattr("/a", "owner"); err != ErrNoAttr {
+		tt.Errorf("got %v for a missing attribute, wanted %v", err, ErrNoAttr)
+	}
+
+	f.Unlink("/a")
+	if err := f.Removexattr("/b", "team"); err != nil {
+		tt.Errorf("failed to remove: %s", err)
+	}
+	if err := f.Removexattr("/b", "team"); err != ErrNoAttr {
+		tt.Errorf("got %v removing twice, wanted %v", err, ErrNoAttr)
+	}
+	if names, _ := f.Listxattr("/b"); len(names) != 1 || names[0] != "type" {
+		tt.Errorf("listed %v, wanted type", names)
+	}
+
+	if err := f.Setxattr("/b", "big", strings.Repeat("x", 2000)); err != ErrAttrSpace {
+		tt.Errorf("got %v setting a huge attribute, wanted %v", err, ErrAttrSpace)
+	}
+	if err := f.Setxattr("/b", "", "x"); err == nil {
+		tt.Errorf("set an attribute with no name")
+	}
+	if v, _ := f.Getxattr("/b", "type"); v != "text/csv" {
+		tt.Errorf("failed set changed the file: got %v", v)
+	}
+}
+
+// Covers:
+//	-> perms/owner, perms/group, perms/other, perms/root
+//	-> perms/read, perms/write, perms/list, perms/search
+//	-> perms/create, perms/unlink, perms/rename
+//	-> perms/newfile
+//	-> perms/chmod/owner, perms/chmod/other
+//	-> perms/chown/root, perms/chown/group, perms/chown/away
+func TestPermissions(tt *testing.T) {
+	root := initUut()
+	alice := Mount(Cred{Uid: 1000, Gid: 100, Umask: 077})
+	bob := Mount(Cred{Uid: 1001, Gid: 100, Groups: []uint32{200}})
+
+	// Root's files come out 0644, dirs 0755
+	writeAll(tt, root, "/motd", "hello")
+	root.Mkdir("/shared")
+	if st, _ := root.Stat("/motd"); st.Uid != 0 || st.Perm != 0644 {
+		tt.Errorf("got uid %d perm %o for /motd, wanted 0 and 0644", st.Uid, st.Perm)
+	}
+	if _, err := bob.Open("/motd", O_RDONLY); err != nil {
+		tt.Errorf("failed to open a 0644 file for reading: %s", err)
+	}
+	if _, err := bob.Open("/motd", O_RDWR); err != ErrPerm {
+		tt.Errorf("got %v opening a 0644 file for writing, wanted %v", err, ErrPerm)
+	}
+	if err := bob.Truncate("/motd", 0); err != ErrPerm {
+		tt.Errorf("got %v truncating a 0644 file, wanted %v", err, ErrPerm)
+	}
+	if err := bob.Unlink("/shared/../motd"); err != nil {
+		// The root directory is open to everyone
+		tt.Errorf("failed to unlink from the root: %s", err)
+	}
+	if _, err := bob.Open("/shared/x", O_RDWR|O_CREAT); err != ErrPerm {
+		tt.Errorf("got %v creating in a 0755 dir, wanted %v", err, ErrPerm)
+	}
+
+	// Alice's umask leaves only her
+	if err := alice.Mkdir("/alice"); err != nil {
+		tt.Fatalf("failed to mkdir: %s", err)
+	}
+	writeAll(tt, alice, "/alice/notes", "secret")
+	if st, _ := alice.Stat("/alice/notes"); st.Uid != 1000 || st.Gid != 100 || st.Perm != 0600 {
+		tt.Errorf("got %d:%d %o for alice's file, wanted 1000:100 0600", st.Uid, st.Gid, st.Perm)
+	}
+	if fd, err := alice.OpenPerm("/alice/run", O_RDWR|O_CREAT, 0755); err != nil {
+		tt.Errorf("failed to create with bits: %s", err)
+	} else {
+		alice.Close(fd)
+	}
+	alice.MkdirPerm("/alice/pub", 0755)
+	for _, p := range []string{"/alice/run", "/alice/pub"} {
+		if st, _ := alice.Stat(p); st == nil || st.Perm != 0700 {
+			tt.Errorf("got %v for %s made with 0755", st, p)
+		}
+	}
+	if _, err := bob.Stat("/alice/notes"); err != ErrPerm {
+		tt.Errorf("got %v searching a 0700 dir, wanted %v", err, ErrPerm)
+	}
+	if _, err := bob.ReadDir("/alice"); err != ErrPerm {
+		tt.Errorf("got %v listing a 0700 dir, wanted %v", err, ErrPerm)
+	}
+	if got := readAll(tt, root, "/alice/notes"); got != "secret" {
+		tt.Errorf("root read %v vs. expected secret", got)
+	}
+
+	// Search without list
+	if err := alice.Chmod("/alice", 0711); err != nil {
+		tt.Fatalf("failed to chmod: %s", err)
+	}
+	if _, err := bob.Stat("/alice/notes"); err != nil {
+		tt.Errorf("failed to stat through a 0711 dir: %s", err)
+	}
+	if _, err := bob.ReadDir("/alice"); err != ErrPerm {
+		tt.Errorf("got %v listing a 0711 dir, wanted %v", err, ErrPerm)
+	}
+	if _, err := bob.Open("/alice/notes", O_RDONLY); err != ErrPerm {
+		tt.Errorf("got %v reading a 0600 file, wanted %v", err, ErrPerm)
+	}
+
+	// Group bits
+	if err := bob.Chmod("/alice/notes", 0644); err != ErrPerm {
+		tt.Errorf("got %v chmodding someone else's file, wanted %v", err, ErrPerm)
+	}
+	alice.Chmod("/alice/notes", 0640)
+	fd, err := bob.Open("/alice/notes", O_RDONLY)
+	if err != nil {
+		tt.Fatalf("failed to open a 0640 file as group: %s", err)
+	}
+	if got, _ := bob.Read(fd, 100); got != "secret" {
+		tt.Errorf("group read %v vs. expected secret", got)
+	}
+	bob.Close(fd)
+	if err := bob.Rename("/alice/notes", "/stolen"); err != ErrPerm {
+		tt.Errorf("got %v renaming out of a 0711 dir, wanted %v", err, ErrPerm)
+	}
+
+	// Only root gives files away
+	if err := alice.Chown("/alice/notes", 1001, 100); err != ErrPerm {
+		tt.Errorf("got %v giving a file away, wanted %v", err, ErrPerm)
+	}
+	if err := alice.Chown("/alice/notes", 1000, 200); err != ErrPerm {
+		tt.Errorf("got %v moving to a group alice isn't in, wanted %v", err, ErrPerm)
+	}
+	if err := root.Chown("/alice/notes", 1001, 200); err != nil {
+		tt.Fatalf("root failed to chown: %s", err)
+	}
+	if err := bob.Chown("/alice/notes", 1001, 100); err != nil {
+		tt.Errorf("failed to move to another of bob's groups: %s", err)
+	}
+	if st, _ := root.Stat("/alice/notes"); st.Uid != 1001 || st.Gid != 100 || st.Perm != 0640 {
+		tt.Errorf("got %d:%d %o after chown, wanted 1001:100 0640", st.Uid, st.Gid, st.Perm)
+	}
+
+	// An owner without the bits is shut out too
+	alice.Chmod("/alice", 0500)
+	if _, err := alice.Open("/alice/new", O_RDWR|O_CREAT); err != ErrPerm {
+		tt.Errorf("got %v creating in a 0500 dir, wanted %v", err, ErrPerm)
+	}
+	if err := alice.Unlink("/alice/notes"); err != ErrPerm {
+		tt.Errorf("got %v unlinking from a 0500 dir, wanted %v", err, ErrPerm)
+	}
+}
+
+func quotaOf(f *Filesystem, tree bool, id uint32) Quota {
+	for _, q := range f.Quotas() {
+		if q.Tree == tree && q.Id == id {
+			return q
+		}
+	}
+	return Quota{}
+}
+
+// Covers:
+//	-> quota/user/blocks, quota/user/inodes, quota/user/unlink
+//	-> quota/tree/adopt, quota/tree/inherit, quota/tree/renamed
+//	-> quota/chown, quota/notroot
+//	-> quota/fsck
+func TestQuota(tt *testing.T) {
+	root := initUut()
+	alice := Mount(Cred{Uid: 1000, Gid: 100, Umask: 022})
+
+	writeAll(tt, alice, "/old", strings.Repeat("o", 5000))
+	if err := alice.SetUserQuota(1000, 4, 3); err != ErrPerm {
+		tt.Errorf("got %v setting a quota as a user, wanted %v", err, ErrPerm)
+	}
+	if err := root.SetUserQuota(1000, 4, 3); err != nil {
+		tt.Fatalf("failed to set a user quota: %s", err)
+	}
+	if q := quotaOf(root, false, 1000); q.Blocks != 2 || q.Inodes != 1 {
+		tt.Errorf("counted %d blocks and %d inodes already used, wanted 2 and 1", q.Blocks, q.Inodes)
+	}
+
+	// Two more blocks fit, a third doesn't,
+	// and the failed write changes nothing
+	writeAll(tt, alice, "/new", strings.Repeat("n", 5000))
+	fd := mustOpen(tt, alice, "/new")
+	if _, err := alice.WriteAt(fd, 9000, "more"); err != ErrQuota {
+		tt.Errorf("got %v writing over the block limit, wanted %v", err, ErrQuota)
+	}
+	alice.Close(fd)
+	if st, _ := alice.Stat("/new"); st.Size != 5000 || st.Blocks != 2 {
+		tt.Errorf("failed write left size %d and %d blocks, wanted 5000 and 2", st.Size, st.Blocks)
+	}
+	writeAll(tt, alice, "/empty", "")
+	if _, err := alice.Open("/one-too-many", O_RDWR|O_CREAT); err != ErrQuota {
+		tt.Errorf("got %v creating over the inode limit, wanted %v", err, ErrQuota)
+	}
+	if _, err := alice.Stat("/one-too-many"); err != ErrNotExist {
+		tt.Errorf("got %v for the file that went over, wanted %v", err, ErrNotExist)
+	}
+
+	// Root isn't limited, and unlinking gives back
+	writeAll(tt, root, "/big", strings.Repeat("b", 9000))
+	alice.Unlink("/old")
+	if q := quotaOf(root, false, 1000); q.Blocks != 2 || q.Inodes != 2 {
+		tt.Errorf("got %d blocks and %d inodes after unlink, wanted 2 and 2", q.Blocks, q.Inodes)
+	}
+
+	// Handing a file to alice charges her, over the limit or not
+	root.Chown("/big", 1000, 100)
+	if q := quotaOf(root, false, 1000); q.Blocks != 5 || q.Inodes != 3 {
+		tt.Errorf("got %d blocks and %d inodes after chown, wanted 5 and 3", q.Blocks, q.Inodes)
+	}
+	root.Chown("/big", 0, 0)
+	root.SetUserQuota(1000, 0, 0)
+	if len(root.Quotas()) != 0 {
+		tt.Errorf("got %v after clearing the only quota", root.Quotas())
+	}
+
+	// A tree takes in what's already there, and
+	// whatever's made under it later
+	root.Mkdir("/proj")
+	root.Mkdir("/proj/src")
+	writeAll(tt, root, "/proj/src/a", "a")
+	if err := root.SetTreeQuota("/", 1, 1); err == nil {
+		tt.Errorf("set a tree quota on the root")
+	}
+	if err := root.SetTreeQuota("/proj", 10, 5); err != nil {
+		tt.Fatalf("failed to set a tree quota: %s", err)
+	}
+	proj, _ := root.Stat("/proj")
+	if q := quotaOf(root, true, uint32(proj.Inum)); q.Inodes != 3 {
+		tt.Errorf("tree adopted %d inodes, wanted 3", q.Inodes)
+	}
+	writeAll(tt, root, "/proj/src/b", "b")
+	root.Mkdir("/proj/c")
+
+	// Nothing moves in or out of it, but moves
+	// inside it are fine, and it can move itself
+	writeAll(tt, root, "/e", "e")
+	if err := root.Rename("/proj/src/b", "/b"); err != ErrXDev {
+		tt.Errorf("got %v renaming out of the tree, wanted %v", err, ErrXDev)
+	}
+	if err := root.Rename("/e", "/proj/e"); err != ErrXDev {
+		tt.Errorf("got %v renaming into the tree, wanted %v", err, ErrXDev)
+	}
+	if err := root.Link("/e", "/proj/e"); err != ErrXDev {
+		tt.Errorf("got %v linking into the tree, wanted %v", err, ErrXDev)
+	}
+	if err := root.Rename("/proj/src/b", "/proj/c/b"); err != nil {
+		tt.Errorf("failed to rename inside the tree: %s", err)
+	}
+	if err := root.Rename("/proj", "/proj2"); err != nil {
+		tt.Errorf("failed to rename the tree: %s", err)
+	}
+	root.Rename("/proj2", "/proj")
+	if _, err := root.Open("/proj/d", O_RDWR|O_CREAT); err != ErrQuota {
+		tt.Errorf("got %v creating over the tree's inode limit, wanted %v", err, ErrQuota)
+	}
+	if q := quotaOf(root, true, uint32(proj.Inum)); q.Inodes != 5 {
+		tt.Errorf("tree has %d inodes, wanted 5", q.Inodes)
+	}
+	if _, err := root.Open("/d", O_RDWR|O_CREAT); err != nil {
+		tt.Errorf("failed to create outside the tree: %s", err)
+	}
+
+	// Usage that drifted is fsck's to fix
+	t := jrnl.BeginTransaction()
+	quota.SetUsage(t, quota.TreeKey(proj.Inum), quota.Usage{Blocks: 1})
+	t.EndTransaction(false)
+	if kinds := fsckKinds(root.Fsck(false).Problems); kinds[FsckBadQuota] != 1 {
+		tt.Errorf("found %d bad quotas, wanted 1", kinds[FsckBadQuota])
+	}
+	if rep := root.Fsck(true); len(rep.Left) != 0 {
+		tt.Errorf("repair left %v", rep.Left)
+	}
+	if q := quotaOf(root, true, uint32(proj.Inum)); q.Inodes != 5 || q.BlockLimit != 10 {
+		tt.Errorf("repaired tree quota is %v, wanted 5 inodes and a limit of 10", q.Usage)
+	}
+
+	// Set again after clearing, the tree is counted
+	// afresh, and only once
+	root.SetTreeQuota("/proj", 0, 0)
+	if err := root.SetTreeQuota("/proj", 10, 6); err != nil {
+		tt.Fatalf("failed to set the tree quota again: %s", err)
+	}
+	if q := quotaOf(root, true, uint32(proj.Inum)); q.Inodes != 5 {
+		tt.Errorf("tree has %d inodes when set again, wanted 5", q.Inodes)
+	}
+	if rep := root.Fsck(false); len(rep.Problems) != 0 {
+		tt.Errorf("found %v", rep.Problems)
+	}
+}
+
+// Covers:
+//	-> quota/nested
+//	-> fsck/treehead
+func TestNestedTreeQuota(tt *testing.T) {
+	f := initUut()
+	f.Mkdir("/outer")
+	f.Mkdir("/outer/inner")
+	f.Mkdir("/outer/inner/deep")
+	writeAll(tt, f, "/outer/inner/deep/f", "f")
+	writeAll(tt, f, "/outer/g", "g")
+
+	// The inner tree first, so the outer one
+	// has to go around it
+	if err := f.SetTreeQuota("/outer/inner", 0, 10); err != nil {
+		tt.Fatalf("failed to set the inner quota: %s", err)
+	}
+	if err := f.SetTreeQuota("/outer", 0, 10); err != nil {
+		tt.Fatalf("failed to set the outer quota: %s", err)
+	}
+	outer, _ := f.Stat("/outer")
+	inner, _ := f.Stat("/outer/inner")
+	if q := quotaOf(f, true, uint32(inner.Inum)); q.Inodes != 3 {
+		tt.Errorf("inner tree has %d inodes, wanted 3", q.Inodes)
+	}
+	if q := quotaOf(f, true, uint32(outer.Inum)); q.Inodes != 2 {
+		tt.Errorf("outer tree has %d inodes, wanted 2", q.Inodes)
+	}
+	if rep := f.Fsck(false); len(rep.Problems) != 0 {
+		tt.Errorf("found %v", rep.Problems)
+	}
+
+	// As if the outer tree had taken over the inner one
+	corrupt(tt, inner.Inum, func(i *inode.Inode) {
+		i.Tree = outer.Inum
+	})
+	rep := f.Fsck(true)
+	if kinds := fsckKinds(rep.Problems); kinds[FsckBadTreeHead] != 1 {
+		tt.Errorf("found %v, wanted a bad tree head", rep.Problems)
+	} else if len(rep.Left) != 0 {
+		tt.Errorf("repair left %v", rep.Left)
+	}
+	if q := quotaOf(f, true, uint32(inner.Inum)); q.Inodes != 3 {
+		tt.Errorf("inner tree has %d inodes after repair, wanted 3", q.Inodes)
+	}
+}
+
+// Covers:
+//	-> readat/indirect, readat/gigabytes
+//	-> readat/solid, fsck/pointers
+func TestBigFile(tt *testing.T) {
+	f := initUut()
+	fd := mustOpen(tt, f, "/big")
+	far := uint(3) << 30
+	if _, err := f.WriteAt(fd, far, "far"); err != nil {
+		tt.Fatalf("failed to write 3GiB in: %s", err)
+	}
+	if _, err := f.WriteAt(fd, 600*4096, "near"); err != nil {
+		tt.Fatalf("failed to write past the direct blocks: %s", err)
+	}
+	if got, _ := f.ReadAt(fd, far-2, 10); got != "\x00\x00far" {
+		tt.Errorf("read %q at 3GiB", got)
+	}
+	f.Close(fd)
+
+	// Two data blocks, the indirect block and two
+	// double-indirect ones. The root directory is
+	// inline, so fsck finds no others
+	st, _ := f.Stat("/big")
+	if st.Size != far+3 || st.Blocks != 5 {
+		tt.Errorf("size %d with %d blocks, wanted %d with 5", st.Size, st.Blocks, far+3)
+	}
+	if rep := f.Fsck(false); len(rep.Problems) != 0 || rep.Blocks != 5 {
+		tt.Errorf("found %v in %d blocks", rep.Problems, rep.Blocks)
+	}
+
+	// No holes this time, 64 blocks a write
+	fd = mustOpen(tt, f, "/solid")
+	chunks := []string{}
+	for k := 0; k < 10; k++ {
+		chunk := strings.Repeat(fmt.Sprintf("%07d\n", k), 64*4096/8)
+		if _, err := f.Write(fd, chunk); err != nil {
+			tt.Fatalf("failed to write chunk %d: %s", k, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	f.Close(fd)
+	fd = mustOpen(tt, f, "/solid")
+	if got, _ := f.Read(fd, 10*64*4096); got != strings.Join(chunks, "") {
+		tt.Errorf("read back %d bytes that don't match what was written", len(got))
+	}
+	f.Close(fd)
+	if s, _ := f.Stat("/solid"); s.Blocks <= 640 {
+		tt.Errorf("%d blocks for 640 blocks of data", s.Blocks)
+	}
+	f.Unlink("/solid")
+
+	// A second file sharing the first's indirect block
+	// shares what's under it too, and loses its own
+	fd = mustOpen(tt, f, "/copy")
+	f.WriteAt(fd, 600*4096, "mine")
+	f.Close(fd)
+	c, _ := f.Stat("/copy")
+	var ind uint
+	corrupt(tt, st.Inum, func(i *inode.Inode) {
+		ind = i.Indirect
+	})
+	corrupt(tt, c.Inum, func(i *inode.Inode) {
+		i.Indirect = ind
+	})
+
+	kinds := fsckKinds(f.Fsck(false).Problems)
+	if kinds[FsckDoubleBlock] != 2 || kinds[FsckLeakedBlock] != 2 {
+		tt.Errorf("found %v, wanted 2 double-allocated and 2 leaked blocks", kinds)
+	}
+	if rep := f.Fsck(true); len(rep.Left) != 0 {
+		tt.Fatalf("repair left %v", rep.Left)
+	}
+	fd = mustOpen(tt, f, "/copy")
+	if got, _ := f.ReadAt(fd, 600*4096, 4); got != "near" {
+		tt.Errorf("read %q from the copy", got)
+	}
+	f.WriteAt(fd, 600*4096, "copy")
+	f.Close(fd)
+	fd = mustOpen(tt, f, "/big")
+	if got, _ := f.ReadAt(fd, 600*4096, 4); got != "near" {
+		tt.Errorf("read %q from the original after writing the copy", got)
+	}
+	f.Close(fd)
+}
+
+// Covers:
+//	-> fsck/noroom
+func TestFsckNoRoom(tt *testing.T) {
+	f := initUut()
+	fd := mustOpen(tt, f, "/big")
+	f.WriteAt(fd, 600*4096, "near")
+	f.Close(fd)
+	writeAll(tt, f, "/copy", "")
+	st, _ := f.Stat("/big")
+	c, _ := f.Stat("/copy")
+	var ind uint
+	corrupt(tt, st.Inum, func(i *inode.Inode) {
+		ind = i.Indirect
+	})
+	corrupt(tt, c.Inum, func(i *inode.Inode) {
+		i.Indirect = ind
+		i.Filesize = st.Size
+	})
+
+	// Leave no room to copy the shared blocks into
+	fd = mustOpen(tt, f, "/fill")
+	for free := freeBlocks(); free > 1; free = freeBlocks() {
+		n := 1
+		if free > 3 {
+			n = free - 3
+		}
+		if n > 64 {
+			n = 64
+		}
+		if _, err := f.Write(fd, strings.Repeat("x", n*4096)); err != nil {
+			tt.Fatalf("failed to fill the volume: %s", err)
+		}
+	}
+	f.Close(fd)
+
+	rep := f.Fsck(true)
+	if kinds := fsckKinds(rep.Left); kinds[FsckDoubleBlock] != 2 {
+		tt.Errorf("repair with no room left %v, wanted the 2 double-allocated blocks", kinds)
+	}
+	fd = mustOpen(tt, f, "/big")
+	if got, _ := f.ReadAt(fd, 600*4096, 4); got != "near" {
+		tt.Errorf("read %q after a repair with no room", got)
+	}
+	f.Close(fd)
+}
+
+func freeBlocks() int {
+	_, used := balloc.Snapshot()
+	free := 0
+	for _, u := range used {
+		if !u {
+			free++
+		}
+	}
+	return free
+}
+
+// Covers:
+//	-> handles/open, handles/rename, handles/uint64
+//	-> handles/reused, handles/never
+//	-> handles/openfd, handles/selfentry
+func TestHandles(tt *testing.T) {
+	f := initUut()
+	writeAll(tt, f, "/a", "apple")
+	st, _ := f.Stat("/a")
+	h := HandleFromUint64(st.Handle.Uint64())
+	if h != st.Handle || h.Inum() != st.Inum {
+		tt.Errorf("handle %v came back from a uint64 as %v", st.Handle, h)
+	}
+
+	f.Rename("/a", "/b")
+	fd, err := f.OpenHandle(h, O_RDWR)
+	if err != nil {
+		tt.Fatalf("failed to open by handle: %s", err)
+	}
+	if data, _ := f.Read(fd, 100); data != "apple" {
+		tt.Errorf("read %v by handle vs. expected apple", data)
+	}
+	if hst, err := f.StatHandle(h); err != nil || hst.Size != 5 {
+		tt.Errorf("stat by handle gave %v, %v", hst, err)
+	}
+
+	// The new file lands in /b's inode
+	f.Unlink("/b")
+	writeAll(tt, f, "/c", "cherry")
+	cst, _ := f.Stat("/c")
+	if cst.Inum != st.Inum || cst.Handle == h {
+		tt.Fatalf("/c got inode %d and handle %v, /b had %d and %v", cst.Inum, cst.Handle, st.Inum, h)
+	}
+
+	if _, err := f.StatHandle(h); err != ErrStale {
+		tt.Errorf("stat of a stale handle gave %v", err)
+	}
+	if _, err := f.OpenHandle(h, O_RDONLY); err != ErrStale {
+		tt.Errorf("open of a stale handle gave %v", err)
+	}
+	if _, err := f.Read(fd, 100); err != ErrStale {
+		tt.Errorf("read of a stale fd gave %v", err)
+	}
+	if _, err := f.Write(fd, "oops"); err != ErrStale {
+		tt.Errorf("write to a stale fd gave %v", err)
+	}
+	if _, err := f.Fstat(fd); err != ErrStale {
+		tt.Errorf("stat of a stale fd gave %v", err)
+	}
+	f.Close(fd)
+	if got := readAll(tt, f, "/c"); got != "cherry" {
+		tt.Errorf("read %v vs. expected cherry", got)
+	}
+
+	if _, err := f.StatHandle(HandleFromUint64(9000)); err != ErrStale {
+		tt.Errorf("stat of a never-allocated inode gave %v", err)
+	}
+
+	fd, _ = f.Open("/c", O_RDONLY)
+	if fst, err := f.Fstat(fd); err != nil || fst.Handle != cst.Handle {
+		tt.Errorf("fd on /c has %v, %v vs. expected %v", fst, err, cst.Handle)
+	}
+	f.Close(fd)
+
+	// A damaged directory listing itself
+	// fails lookups instead of hanging them
+	f.Mkdir("/d")
+	dinum, _ := f.namei("/d")
+	t := jrnl.BeginTransaction()
+	dir := inode.Geti(dinum)
+	if err := addEntry(t, dir, dirent{name: "self", inum: dinum}); err != nil {
+		tt.Fatalf("failed to add an entry: %s", err)
+	}
+	t.EndTransaction(false)
+	dir.Relse()
+	if _, err := f.Stat("/d/self"); err != ErrLoop {
+		tt.Errorf("stat through a self entry gave %v", err)
+	}
+	for _, flags := range []int{O_RDONLY, O_CREAT | O_RDWR, O_CREAT | O_EXCL | O_RDWR} {
+		if _, err := f.Open("/d/self", flags); err == nil {
+			tt.Errorf("opened a self entry with flags %o", flags)
+		}
+	}
+}
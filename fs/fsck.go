@@ -0,0 +1,701 @@
+package fs
+
+import (
+	"fmt"
+	"pp2/balloc"
+	"pp2/inode"
+	"pp2/jrnl"
+	"pp2/quota"
+	"sort"
+)
+
+// Checks the whole volume. The check takes each inode's
+// lock only long enough to read it, so it can run while
+// other clients are working, though it might then report
+// changes they have in flight; anything real shows up
+// again on a second run. Repairs assume nobody else is
+// writing, so only repair a volume nobody has mounted
+
+type FsckKind byte
+
+const (
+	FsckLeakedBlock   FsckKind = iota // Marked in use, but no inode has it
+	FsckUnmarkedBlock                 // An inode has it, but it's marked free
+	FsckDoubleBlock                   // More than one inode has it
+	FsckBadBlock                      // Not a data block at all
+	FsckOrphan                        // In use, but not reachable from the root
+	FsckBadRefcnt                     // Refcnt doesn't match the links to it
+	FsckBadDirent                     // Can't be decoded, or points nowhere
+	FsckBadQuota                      // Usage doesn't match what's there
+	FsckBadInodeMap                   // The inode map has it wrong
+	FsckBadBlockCount                 // The inode's kept block count is off
+	FsckBadTreeHead                   // A tree's directory isn't tagged with it
+)
+
+func (k FsckKind) String() string {
+	switch k {
+	case FsckLeakedBlock:
+		return "leaked block"
+	case FsckUnmarkedBlock:
+		return "unmarked block"
+	case FsckDoubleBlock:
+		return "double-allocated block"
+	case FsckBadBlock:
+		return "bad block address"
+	case FsckOrphan:
+		return "orphan inode"
+	case FsckBadRefcnt:
+		return "bad refcnt"
+	case FsckBadDirent:
+		return "bad directory entry"
+	case FsckBadQuota:
+		return "bad quota usage"
+	case FsckBadInodeMap:
+		return "bad inode map"
+	case FsckBadBlockCount:
+		return "bad block count"
+	case FsckBadTreeHead:
+		return "bad tree head"
+	}
+	return "unknown"
+}
+
+type FsckProblem struct {
+	Kind   FsckKind
+	Inum   uint16 // Unused for leaked and unmarked blocks, the second owner for double ones
+	Block  uint   // Only for block problems
+	Quota  string // Only for quota problems
+	Detail string
+}
+
+func (p FsckProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Kind, p.Detail)
+}
+
+type FsckReport struct {
+	Inodes   int // In use
+	Blocks   int // Owned by some inode
+	Problems []FsckProblem
+	Repaired bool
+	Left     []FsckProblem // Still there after repairing
+}
+
+// Everything one pass over the volume found
+type fsckScan struct {
+	inodes    map[uint16]*inode.Inode // Refcnt > 0
+	dirs      map[uint16][]dirent     // Good entries, by directory
+	reachable map[uint16]bool
+	links     map[uint16]uint16 // Entries in reachable directories
+	owners    map[uint][]uint16 // Block -> inodes with it
+	first     uint              // First data block
+	used      []bool            // The bitmap, from first
+	imap      []bool            // The inode map, nil if there's none yet
+	usage     map[string]quota.Usage
+	problems  []FsckProblem
+}
+
+func (s *fsckScan) report(kind FsckKind, inum uint16, bn uint, format string, args ...interface{}) {
+	s.problems = append(s.problems, FsckProblem{
+		Kind:   kind,
+		Inum:   inum,
+		Block:  bn,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+func (s *fsckScan) isData(bn uint) bool {
+	return bn >= s.first && bn-s.first < uint(len(s.used))
+}
+
+func fsckScanAll(rooti uint16) *fsckScan {
+	s := &fsckScan{
+		inodes:    make(map[uint16]*inode.Inode),
+		dirs:      make(map[uint16][]dirent),
+		reachable: make(map[uint16]bool),
+		links:     make(map[uint16]uint16),
+		owners:    make(map[uint][]uint16),
+	}
+
+	for inum := 0; inum < inode.NumInodes; inum++ {
+		if i := inode.Peeki(uint16(inum)); i != nil && i.Refcnt > 0 {
+			s.inodes[uint16(inum)] = i
+		}
+	}
+	s.first, s.used = balloc.Snapshot()
+	s.imap = inode.SnapshotMap()
+
+	s.checkInodeMap()
+	s.checkBlocks()
+	for _, inum := range s.sortedInums() {
+		if i := s.inodes[inum]; i.Mode == inode.Dir {
+			s.checkDir(rooti, i)
+		}
+	}
+	s.walkFrom(rooti)
+
+	for _, inum := range s.sortedInums() {
+		i := s.inodes[inum]
+		if !s.reachable[inum] {
+			s.report(FsckOrphan, inum, 0, "inode %d (%s) isn't reachable from the root", inum, i.Mode)
+			continue
+		}
+		if want := s.wantRefcnt(rooti, inum); i.Refcnt != want {
+			s.report(FsckBadRefcnt, inum, 0, "inode %d has refcnt %d, but %d links", inum, i.Refcnt, want)
+		}
+	}
+	s.checkTreeHeads()
+	s.checkQuotas()
+	return s
+}
+
+// A tree's directory is tagged with the tree itself,
+// which is where adoptTree stops when a tree is set
+// around it. If another tree took it over, that one
+// took the inner tree's inodes too. A head that was
+// removed and its inode reused for a directory looks
+// the same, so clear quotas on trees that are gone
+func (s *fsckScan) checkTreeHeads() {
+	recorded := quota.Snapshot()
+	for _, inum := range s.sortedInums() {
+		i := s.inodes[inum]
+		if _, tracked := recorded[quota.TreeKey(inum)]; tracked && i.Mode == inode.Dir && i.Tree != inum {
+			s.report(FsckBadTreeHead, inum, 0, "directory %d heads a tree, but is tagged with tree %d", inum, i.Tree)
+		}
+	}
+}
+
+func (s *fsckScan) checkInodeMap() {
+	for inum, used := range s.imap {
+		_, inUse := s.inodes[uint16(inum)]
+		if inUse && !used {
+			s.report(FsckBadInodeMap, uint16(inum), 0, "inode %d is in use, but marked free", inum)
+		} else if used && !inUse {
+			s.report(FsckBadInodeMap, uint16(inum), 0, "inode %d is free, but marked in use", inum)
+		}
+	}
+}
+
+// Recounts what every tracked quota key uses
+func (s *fsckScan) checkQuotas() {
+	recorded := quota.Snapshot()
+	s.usage = make(map[string]quota.Usage)
+	for key := range recorded {
+		s.usage[key] = quota.Usage{}
+	}
+
+	for _, i := range s.inodes {
+		keys := []string{quota.UserKey(i.Uid)}
+		if i.Tree != 0 {
+			keys = append(keys, quota.TreeKey(i.Tree))
+		}
+		for _, key := range keys {
+			if u, ok := s.usage[key]; ok {
+				u.Blocks += i.CountBlocks(nil)
+				u.Inodes++
+				s.usage[key] = u
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(recorded))
+	for key := range recorded {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		got, want := recorded[key], s.usage[key]
+		if got.Blocks != want.Blocks || got.Inodes != want.Inodes {
+			s.problems = append(s.problems, FsckProblem{
+				Kind:  FsckBadQuota,
+				Quota: key,
+				Detail: fmt.Sprintf("quota %s has %d blocks and %d inodes recorded, but uses %d and %d",
+					key, got.Blocks, got.Inodes, want.Blocks, want.Inodes),
+			})
+		}
+	}
+}
+
+func (s *fsckScan) sortedInums() []uint16 {
+	res := make([]uint16, 0, len(s.inodes))
+	for inum := range s.inodes {
+		res = append(res, inum)
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a] < res[b] })
+	return res
+}
+
+// The root has no entry pointing at it,
+// but counts as linked once
+func (s *fsckScan) wantRefcnt(rooti uint16, inum uint16) uint16 {
+	if inum == rooti {
+		return 1
+	}
+	return s.links[inum]
+}
+
+func (s *fsckScan) checkBlocks() {
+	for _, inum := range s.sortedInums() {
+		i := s.inodes[inum]
+		n, bad := uint(0), false
+		i.EachBlock(nil, func(bn uint) bool {
+			n++
+			if !s.isData(bn) {
+				// Don't go reading what's in it
+				s.report(FsckBadBlock, inum, bn, "inode %d points at block %d", inum, bn)
+				bad = true
+				return false
+			}
+			s.owners[bn] = append(s.owners[bn], inum)
+			return true
+		})
+
+		// Dropping bad blocks redoes the count anyway
+		if !bad && i.HasBlocks && i.Blocks != n {
+			s.report(FsckBadBlockCount, inum, 0, "inode %d counts %d blocks, but has %d", inum, i.Blocks, n)
+		}
+	}
+
+	bns := make([]uint, 0, len(s.owners))
+	for bn := range s.owners {
+		bns = append(bns, bn)
+	}
+	sort.Slice(bns, func(a, b int) bool { return bns[a] < bns[b] })
+	for _, bn := range bns {
+		if !s.used[bn-s.first] {
+			s.report(FsckUnmarkedBlock, 0, bn, "block %d belongs to inode %d but is marked free", bn, s.owners[bn][0])
+		}
+		if owners := s.owners[bn]; len(owners) > 1 {
+			s.report(FsckDoubleBlock, owners[1], bn, "block %d belongs to inodes %v", bn, owners)
+		}
+	}
+
+	for idx, used := range s.used {
+		bn := s.first + uint(idx)
+		if _, ok := s.owners[bn]; used && !ok {
+			s.report(FsckLeakedBlock, 0, bn, "block %d is marked in use but belongs to nothing", bn)
+		}
+	}
+}
+
+// Keeps the entries of dir that decode and
+// point at an inode in use, once per name
+func (s *fsckScan) checkDir(rooti uint16, dir *inode.Inode) {
+	good := []dirent{}
+	bad := false
+	dir.EachBlock(nil, func(bn uint) bool {
+		bad = bad || !s.isData(bn)
+		return !bad
+	})
+	if bad {
+		// Don't go reading inodes or the journal
+		s.dirs[dir.Serialnum] = good
+		return
+	}
+
+	ents, err := parseDir(dir.Read(0, dir.Filesize))
+	if err != nil {
+		s.report(FsckBadDirent, dir.Serialnum, 0, "directory %d: %s", dir.Serialnum, err)
+	}
+
+	seen := make(map[string]bool)
+	for _, ent := range ents {
+		if seen[ent.name] {
+			s.report(FsckBadDirent, dir.Serialnum, 0, "directory %d has %q twice", dir.Serialnum, ent.name)
+			continue
+		} else if _, ok := s.inodes[ent.inum]; !ok || ent.inum == rooti {
+			s.report(FsckBadDirent, dir.Serialnum, 0, "directory %d: %q points at free inode %d", dir.Serialnum, ent.name, ent.inum)
+			continue
+		}
+		seen[ent.name] = true
+		good = append(good, ent)
+	}
+	s.dirs[dir.Serialnum] = good
+}
+
+// Marks everything reachable from rooti and counts links.
+// A directory only gets walked the first time it's seen,
+// any other entry for it is a bad one
+func (s *fsckScan) walkFrom(rooti uint16) {
+	if _, ok := s.inodes[rooti]; !ok {
+		return
+	}
+	s.reachable[rooti] = true
+
+	queue := []uint16{rooti}
+	for len(queue) > 0 {
+		inum := queue[0]
+		queue = queue[1:]
+
+		good := []dirent{}
+		for _, ent := range s.dirs[inum] {
+			child := s.inodes[ent.inum]
+			if child.Mode == inode.Dir && s.reachable[ent.inum] {
+				s.report(FsckBadDirent, inum, 0, "directory %d: %q is another link to directory %d", inum, ent.name, ent.inum)
+				continue
+			}
+
+			good = append(good, ent)
+			s.links[ent.inum]++
+			if !s.reachable[ent.inum] {
+				s.reachable[ent.inum] = true
+				if child.Mode == inode.Dir {
+					queue = append(queue, ent.inum)
+				}
+			}
+		}
+		s.dirs[inum] = good
+	}
+}
+
+// Checks every inode and block on the volume, and with
+// repair set, fixes what it finds. Repairs go in this
+// order, so that nothing allocates blocks before the
+// bitmap is right:
+//  1. Bad block addresses become holes
+//  2. The bitmap is rebuilt from what inodes point at,
+//     and the inode map from which inodes are in use
+//  3. Blocks with more than one owner are copied, so
+//     each owner after the first gets its own
+//  4. Directories are rewritten without bad entries
+//  5. Orphans are linked into /lost+found as #<inum>
+//  6. Refcnts are set to the number of links, and
+//     block counts to the blocks there are
+//  7. Tree heads are tagged with their own trees, then
+//     quota usage is set to what's really used
+//
+// Each fix goes through its own jrnl transaction, so a
+// crash partway through leaves a volume fsck can pick
+// up from. A fix that fails says why and moves on;
+// the report's Left has whatever a final check
+// still found
+func (f *Filesystem) Fsck(repair bool) *FsckReport {
+	s := fsckScanAll(f.rooti)
+	res := &FsckReport{
+		Inodes:   len(s.inodes),
+		Blocks:   len(s.owners),
+		Problems: s.problems,
+	}
+	if !repair || len(s.problems) == 0 {
+		return res
+	}
+
+	for _, p := range s.problems {
+		if p.Kind == FsckBadBlock {
+			fsckDropBadBlocks(s, p.Inum)
+		}
+	}
+
+	s = fsckScanAll(f.rooti)
+	fsckFixBitmap(s)
+	fsckFixInodeMap(s)
+
+	shared := make(map[uint16]map[uint]bool)
+	for _, p := range s.problems {
+		if p.Kind != FsckDoubleBlock {
+			continue
+		}
+		for _, inum := range s.owners[p.Block][1:] {
+			if shared[inum] == nil {
+				shared[inum] = make(map[uint]bool)
+			}
+			shared[inum][p.Block] = true
+		}
+	}
+	for inum, bns := range shared {
+		fsckCloneBlocks(s, inum, bns)
+	}
+
+	s = fsckScanAll(f.rooti)
+	fixed := make(map[uint16]bool)
+	for _, p := range s.problems {
+		if p.Kind == FsckBadDirent && !fixed[p.Inum] {
+			fsckRewriteDir(s, p.Inum)
+			fixed[p.Inum] = true
+		}
+	}
+
+	s = fsckScanAll(f.rooti)
+	adopted := make(map[uint16]bool)
+	for f.fsckAdopt(s, adopted) {
+		s = fsckScanAll(f.rooti)
+	}
+	for _, p := range s.problems {
+		if p.Kind == FsckBadRefcnt {
+			fsckSetRefcnt(p.Inum, s.wantRefcnt(f.rooti, p.Inum))
+		} else if p.Kind == FsckBadBlockCount {
+			fsckRecount(p.Inum)
+		}
+	}
+
+	s = fsckScanAll(f.rooti)
+	for _, p := range s.problems {
+		if p.Kind == FsckBadTreeHead {
+			fsckSetTree(p.Inum)
+		}
+	}
+
+	s = fsckScanAll(f.rooti)
+	for _, p := range s.problems {
+		if p.Kind == FsckBadQuota {
+			fsckSetUsage(p.Quota, s.usage[p.Quota])
+		}
+	}
+
+	res.Repaired = true
+	res.Left = fsckScanAll(f.rooti).problems
+	return res
+}
+
+// Each fix below takes its own locks, and throws
+// its work away if a transaction won't take it
+
+func fsckDropBadBlocks(s *fsckScan, inum uint16) {
+	t := jrnl.BeginTransaction()
+	i := inode.Geti(inum)
+	defer i.Relse()
+
+	err := i.Remap(t, func(bn uint) uint {
+		if !s.isData(bn) {
+			return 0
+		}
+		return bn
+	})
+	if err != nil {
+		t.AbortTransaction()
+		fmt.Printf("Couldn't drop bad blocks from inode %d: %s\n", inum, err)
+		return
+	}
+	t.EndTransaction(false)
+}
+
+func fsckFixBitmap(s *fsckScan) {
+	marked, freed := []uint{}, []uint{}
+	for idx, used := range s.used {
+		bn := s.first + uint(idx)
+		_, owned := s.owners[bn]
+		if owned && !used {
+			marked = append(marked, bn)
+		} else if used && !owned {
+			freed = append(freed, bn)
+		}
+	}
+	if len(marked) == 0 && len(freed) == 0 {
+		return
+	}
+
+	t := jrnl.BeginTransaction()
+	balloc.Mark(t, marked, true)
+	balloc.Mark(t, freed, false)
+	t.EndTransaction(false)
+}
+
+func fsckFixInodeMap(s *fsckScan) {
+	marked, freed := []uint16{}, []uint16{}
+	for _, p := range s.problems {
+		if p.Kind != FsckBadInodeMap {
+			continue
+		} else if _, inUse := s.inodes[p.Inum]; inUse {
+			marked = append(marked, p.Inum)
+		} else {
+			freed = append(freed, p.Inum)
+		}
+	}
+	if len(marked) == 0 && len(freed) == 0 {
+		return
+	}
+
+	t := jrnl.BeginTransaction()
+	inode.MarkMap(t, marked, true)
+	inode.MarkMap(t, freed, false)
+	t.EndTransaction(false)
+}
+
+// Gives inum its own copy of each block in bns. A
+// pointer block is copied before what's in it, so
+// its copy ends up pointing at the copies. The first
+// copy that fails stops the rest, and the whole
+// transaction is thrown away
+func fsckCloneBlocks(s *fsckScan, inum uint16, bns map[uint]bool) {
+	// balloc gives up the process when it runs out,
+	// so make sure there's room for every copy first
+	_, used := balloc.Snapshot()
+	free := 0
+	for _, u := range used {
+		if !u {
+			free++
+		}
+	}
+	if free < len(bns) {
+		fmt.Printf("Couldn't copy %d shared blocks for inode %d: only %d free\n", len(bns), inum, free)
+		return
+	}
+
+	t := jrnl.BeginTransaction()
+	i := inode.Geti(inum)
+	defer i.Relse()
+
+	var werr error
+	err := i.Remap(t, func(bn uint) uint {
+		if werr != nil || !bns[bn] {
+			return bn
+		}
+		delete(bns, bn)
+		nb := balloc.AllocBlocks(t, 1)[0]
+		old := t.ReadBlock(bn)
+		data := old.Data
+		old.Brelse()
+
+		blk := t.ReadBlock(nb)
+		blk.Data = data
+		werr = t.WriteBlock(blk)
+		blk.Brelse()
+		if werr != nil {
+			return bn
+		}
+		return nb
+	})
+	if err == nil {
+		err = werr
+	}
+	if err != nil {
+		t.AbortTransaction()
+		fmt.Printf("Couldn't copy shared blocks for inode %d: %s\n", inum, err)
+		return
+	}
+	t.EndTransaction(false)
+}
+
+func fsckRewriteDir(s *fsckScan, inum uint16) {
+	ents, ok := s.dirs[inum]
+	if !ok {
+		return
+	}
+
+	t := jrnl.BeginTransaction()
+	dir := inode.Geti(inum)
+	defer dir.Relse()
+	if err := writeDir(t, dir, ents); err != nil {
+		t.AbortTransaction()
+		fmt.Printf("Couldn't rewrite directory %d: %s\n", inum, err)
+		return
+	}
+	t.EndTransaction(false)
+}
+
+// Links orphans into /lost+found, leaving out any
+// that an orphaned directory already has, since they
+// come along with it. If every orphan is in such a
+// directory, they must form a cycle, so one gets
+// linked anyway. Nothing in adopted is linked twice,
+// so calling this until it returns false ends even if
+// a link doesn't take. Returns whether it linked anything
+func (f *Filesystem) fsckAdopt(s *fsckScan, adopted map[uint16]bool) bool {
+	orphans := []uint16{}
+	for _, p := range s.problems {
+		if p.Kind == FsckOrphan && !adopted[p.Inum] {
+			orphans = append(orphans, p.Inum)
+		}
+	}
+	if len(orphans) == 0 {
+		return false
+	}
+
+	inOrphan := make(map[uint16]bool)
+	for _, inum := range orphans {
+		for _, ent := range s.dirs[inum] {
+			inOrphan[ent.inum] = true
+		}
+	}
+	adopt := []uint16{}
+	for _, inum := range orphans {
+		if !inOrphan[inum] {
+			adopt = append(adopt, inum)
+		}
+	}
+	if len(adopt) == 0 {
+		adopt = orphans[:1]
+	}
+
+	lost, err := f.lostFound()
+	if err != nil {
+		fmt.Printf("Couldn't make /lost+found: %s\n", err)
+		return false
+	}
+
+	dir, err := getDir(lost)
+	if err != nil {
+		return false
+	}
+	defer dir.Relse()
+	for _, inum := range adopt {
+		t := jrnl.BeginTransaction()
+		err := addEntry(t, dir, dirent{name: fmt.Sprintf("#%d", inum), inum: inum})
+		if err != nil {
+			t.AbortTransaction()
+			fmt.Printf("Couldn't link inode %d: %s\n", inum, err)
+			return false
+		}
+		t.EndTransaction(false)
+		adopted[inum] = true
+	}
+	return true
+}
+
+// Makes it if it isn't there
+func (f *Filesystem) lostFound() (uint16, error) {
+	h, _, err := create(&f.cred, f.rooti, "lost+found", inode.Dir, 0777, "")
+	return h.inum, err
+}
+
+func fsckSetRefcnt(inum uint16, refcnt uint16) {
+	t := jrnl.BeginTransaction()
+	i := inode.Geti(inum)
+	defer i.Relse()
+
+	i.Refcnt = refcnt
+	if err := i.Touch(t, inode.CTime); err != nil {
+		t.AbortTransaction()
+		fmt.Printf("Couldn't set the link count of inode %d: %s\n", inum, err)
+		return
+	}
+	t.EndTransaction(false)
+}
+
+// Usage is left for the next step to recount
+func fsckSetTree(inum uint16) {
+	t := jrnl.BeginTransaction()
+	i := inode.Geti(inum)
+	defer i.Relse()
+
+	i.Tree = inum
+	if err := i.EnqWrite(t); err != nil {
+		t.AbortTransaction()
+		fmt.Printf("Couldn't tag inode %d with its tree: %s\n", inum, err)
+		return
+	}
+	t.EndTransaction(false)
+}
+
+// Remap with nothing to change still redoes the count
+func fsckRecount(inum uint16) {
+	t := jrnl.BeginTransaction()
+	i := inode.Geti(inum)
+	defer i.Relse()
+
+	if err := i.Remap(t, func(bn uint) uint { return bn }); err != nil {
+		t.AbortTransaction()
+		fmt.Printf("Couldn't recount the blocks of inode %d: %s\n", inum, err)
+		return
+	}
+	t.EndTransaction(false)
+}
+
+func fsckSetUsage(key string, used quota.Usage) {
+	t := jrnl.BeginTransaction()
+	if err := quota.SetUsage(t, key, used); err != nil {
+		t.AbortTransaction()
+		fmt.Printf("Couldn't set the usage of quota %s: %s\n", key, err)
+		return
+	}
+	t.EndTransaction(false)
+}
@@ -0,0 +1,113 @@
+package fs
+
+import (
+	"errors"
+	"pp2/inode"
+)
+
+// Names a file for as long as it exists, whatever
+// it's renamed to: its inode number and that inode's
+// generation, which Alloci bumps each time the number
+// is reused. Once the file is freed, a handle to it is
+// stale, and fails with ErrStale instead of reaching
+// whatever gets the inode next. Network front-ends
+// can hand them out as one number, see Uint64
+type Handle struct {
+	inum uint16
+	gen  uint32
+}
+
+var ErrStale = errors.New("stale file handle")
+
+func (h Handle) Inum() uint16 {
+	return h.inum
+}
+
+// Packs h into one number, e.g. a 9P qid's path
+func (h Handle) Uint64() uint64 {
+	return uint64(h.gen)<<16 | uint64(h.inum)
+}
+
+// Unpacks what Uint64 made. Any number makes some
+// handle; one that names nothing is just stale
+func HandleFromUint64(v uint64) Handle {
+	return Handle{inum: uint16(v), gen: uint32(v >> 16)}
+}
+
+// The inode h names, held
+func (h Handle) geti() (*inode.Inode, error) {
+	if uint(h.inum) >= inode.NumInodes || !inode.Probei(h.inum) {
+		return nil, ErrStale
+	}
+	i := inode.Geti(h.inum)
+	if i.Refcnt == 0 || i.Gen != h.gen {
+		i.Relse()
+		return nil, ErrStale
+	}
+	return i, nil
+}
+
+func (file *File) handle() Handle {
+	return Handle{inum: file.inum, gen: file.gen}
+}
+
+// The handle for inum, which an entry in the held
+// directory dir names. It's locked under dir, so it
+// can't be freed and reused in between
+func entryHandle(dir *inode.Inode, inum uint16) (Handle, error) {
+	if inum == dir.Serialnum {
+		// Only a damaged directory lists itself
+		return Handle{}, ErrLoop
+	}
+	i := inode.Geti(inum)
+	defer i.Relse()
+	return Handle{inum: inum, gen: i.Gen}, nil
+}
+
+// Like Stat, for the file h names
+func (f *Filesystem) StatHandle(h Handle) (*Stat, error) {
+	i, err := h.geti()
+	if err != nil {
+		return nil, err
+	}
+	defer i.Relse()
+	return statOf(i), nil
+}
+
+// Like Open, for the file h names. There's no
+// path to create at, so O_CREAT and O_EXCL do
+// nothing. h has to be a regular file or, opened
+// read-only, a directory
+func (f *Filesystem) OpenHandle(h Handle, flags int) (int, error) {
+	acc := flags & accMode
+	if acc != O_RDONLY && acc != O_WRONLY && acc != O_RDWR {
+		return -1, errors.New("invalid access mode")
+	}
+
+	i, err := h.geti()
+	if err != nil {
+		return -1, err
+	}
+	if i.Mode == inode.Symlink {
+		err = errors.New("can't open a symlink by handle")
+	} else {
+		err = f.cred.check(i, openPerms(flags))
+	}
+	i.Relse()
+	if err != nil {
+		return -1, err
+	}
+	if acc != O_RDONLY || flags&O_TRUNC != 0 {
+		if err := openForWrite(h, flags); err != nil {
+			return -1, err
+		}
+	}
+
+	newFd := f.mkFd()
+	f.fdTable[newFd] = &File{
+		inum:  h.inum,
+		gen:   h.gen,
+		flags: flags &^ (O_CREAT | O_EXCL),
+	}
+	return newFd, nil
+}
@@ -0,0 +1,99 @@
+package fs
+
+import (
+	"errors"
+	"pp2/inode"
+	"pp2/jrnl"
+)
+
+// Refcnt is a uint16; stop well short of wrapping
+const maxLinks = 65000
+
+// Adds newpath as another name for the file at
+// oldpath. If oldpath is a symlink, the link itself
+// gets the new name. Directories can't be linked,
+// since that could make cycles in the tree
+func (f *Filesystem) Link(oldpath string, newpath string) error {
+	inum, err := f.lnamei(oldpath)
+	if err != nil {
+		return err
+	}
+	pinum, name, err := f.nameiparent(newpath)
+	if err != nil {
+		return err
+	}
+
+	dir, err := getDir(pinum)
+	if err != nil {
+		return err
+	}
+	defer dir.Relse()
+	if err := f.cred.check(dir, permW|permX); err != nil {
+		return err
+	} else if _, found := lookup(dir, name); found {
+		return ErrExist
+	}
+
+	i := inode.Geti(inum)
+	defer i.Relse()
+	if i.Mode == inode.Dir {
+		return ErrIsDir
+	} else if i.Refcnt == 0 {
+		return ErrNotExist
+	} else if i.Refcnt >= maxLinks {
+		return ErrMlink
+	} else if crossesTree(i, dir) {
+		return ErrXDev
+	}
+
+	t := jrnl.BeginTransaction()
+	i.Refcnt++
+	if err := i.Touch(t, inode.CTime); err != nil {
+		i.Refcnt--
+		t.AbortTransaction()
+		return err
+	}
+	if err := addEntry(t, dir, dirent{name: name, inum: inum}); err != nil {
+		i.Refcnt--
+		t.AbortTransaction()
+		return err
+	}
+
+	t.EndTransaction(false)
+	return nil
+}
+
+// Makes a symlink at path pointing to target. The
+// target is stored as given, and needn't exist
+func (f *Filesystem) Symlink(target string, path string) error {
+	if target == "" {
+		return errors.New("empty symlink target")
+	}
+	pinum, name, err := f.nameiparent(path)
+	if err != nil {
+		return err
+	}
+
+	_, made, err := create(&f.cred, pinum, name, inode.Symlink, 0777, target)
+	if err != nil {
+		return err
+	} else if !made {
+		return ErrExist
+	}
+	return nil
+}
+
+// Returns the target of the symlink at path
+func (f *Filesystem) Readlink(path string) (string, error) {
+	inum, err := f.lnamei(path)
+	if err != nil {
+		return "", err
+	}
+
+	i := inode.Geti(inum)
+	defer i.Relse()
+	if i.Mode != inode.Symlink {
+		return "", errors.New("not a symlink")
+	}
+	return i.Read(0, i.Filesize), nil
+}
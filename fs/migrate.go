@@ -0,0 +1,112 @@
+package fs
+
+import (
+	"fmt"
+	"pp2/inode"
+	"pp2/jrnl"
+	"strconv"
+	"strings"
+)
+
+// Before dirMagic, directories were stored as text
+// of the form "filename,inum filename,inum ", which
+// broke on names with spaces or commas in them
+func parseLegacyDir(raw string) []dirent {
+	ents := []dirent{}
+	for _, entry := range strings.Split(raw, " ") {
+		data := strings.Split(entry, ",")
+		if len(data) != 2 {
+			continue
+		}
+		inum64, err := strconv.ParseUint(data[1], 10, 16)
+		if err != nil {
+			continue
+		}
+		ents = append(ents, dirent{
+			name: data[0],
+			inum: uint16(inum64),
+		})
+	}
+	return ents
+}
+
+// Rewrites every text directory under inum in the
+// binary format, children first. The root goes last,
+// so a root in the new format means there's nothing
+// left to migrate, even if we crashed halfway through.
+// A directory that can't be migrated (say, a name
+// too long for the new format) stays as text, and so
+// do the ones above it, so the next mount tries again.
+// Entries naming an inode that was never made are
+// dropped, since there's nothing behind them
+func migrateDir(inum uint16) error {
+	dir, err := getDir(inum)
+	if err != nil {
+		return nil
+	}
+	raw := dir.Read(0, dir.Filesize)
+	dir.Relse()
+
+	var ents []dirent
+	if isLegacyDir(raw) {
+		ents = parseLegacyDir(raw)
+	} else {
+		ents, _ = parseDir(raw)
+	}
+	for _, ent := range ents {
+		if !madeInode(ent.inum) {
+			continue
+		}
+		child := inode.Geti(ent.inum)
+		isDir := child.Mode == inode.Dir
+		child.Relse()
+		if isDir {
+			if err := migrateDir(ent.inum); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Look again under the lock, somebody else
+	// might be migrating alongside us
+	dir, err = getDir(inum)
+	if err != nil {
+		return nil
+	}
+	defer dir.Relse()
+	raw = dir.Read(0, dir.Filesize)
+	if !isLegacyDir(raw) {
+		return nil
+	}
+
+	ents = []dirent{}
+	for _, ent := range parseLegacyDir(raw) {
+		if madeInode(ent.inum) {
+			ents = append(ents, ent)
+		} else {
+			fmt.Printf("Dropping %q from directory %d, inode %d was never made\n", ent.name, inum, ent.inum)
+		}
+	}
+
+	t := jrnl.BeginTransaction()
+	if err := writeDir(t, dir, ents); err != nil {
+		t.AbortTransaction()
+		return fmt.Errorf("directory %d: %s", inum, err)
+	}
+	t.EndTransaction(false)
+	fmt.Printf("Migrated directory %d\n", inum)
+	return nil
+}
+
+// Called on mount
+func (f *Filesystem) migrate() {
+	root := inode.Geti(f.rooti)
+	legacy := isLegacyDir(root.Read(0, root.Filesize))
+	root.Relse()
+	if legacy {
+		fmt.Printf("Migrating text directories...\n")
+		if err := migrateDir(f.rooti); err != nil {
+			fmt.Printf("Couldn't migrate %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package fs
+
+import (
+	"errors"
+	"pp2/inode"
+	"strings"
+)
+
+// Splits a slash-separated path into its components.
+// All paths are taken relative to the root, and "."
+// and ".." are resolved lexically, since directories
+// don't store entries for either
+func splitPath(path string) []string {
+	comps := []string{}
+	for _, c := range strings.Split(path, "/") {
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(comps) > 0 {
+				comps = comps[:len(comps)-1]
+			}
+		default:
+			comps = append(comps, c)
+		}
+	}
+	return comps
+}
+
+// How many symlinks one lookup may go through
+// before we decide it's a loop
+const maxSymlinks = 16
+
+// Walks comps starting at the root, locking one
+// directory at a time. Symlinks along the way are
+// expanded, as is one in the last component if follow
+// is set. Returns a handle on the inode that the last
+// component names, and the components of the path
+// that actually got walked. Those are also returned
+// alongside ErrNotExist if only the last one is missing,
+// so callers can create it
+func (f *Filesystem) walk(comps []string, follow bool) (Handle, []string, error) {
+	chain, gen, comps, err := f.walkChain(nil, comps, follow)
+	if err != nil {
+		return Handle{}, comps, err
+	}
+	return Handle{inum: chain[len(chain)-1], gen: gen}, comps, nil
+}
+
+// walk on behalf of the transaction x, which
+// may already hold (and have changed) some of
+// the inodes on the way. x may be nil
+func (f *Filesystem) walkIn(x *Txn, comps []string, follow bool) (uint16, []string, error) {
+	chain, _, comps, err := f.walkChain(x, comps, follow)
+	if err != nil {
+		return 0, comps, err
+	}
+	return chain[len(chain)-1], comps, nil
+}
+
+// walkIn, but returns the inode number of every
+// directory on the way, from the root down to what
+// the last component names, and that last inode's
+// generation. Each child is locked before its
+// directory is let go, so the generation is the one
+// the entry named, not whatever reused the inode since
+func (f *Filesystem) walkChain(x *Txn, comps []string, follow bool) ([]uint16, uint32, []string, error) {
+	links := 0
+
+restart:
+	cur := f.rooti
+	chain := []uint16{cur}
+	gen := uint32(0)
+	if len(comps) == 0 {
+		root := x.iget(cur)
+		gen = root.Gen
+		x.iput(root)
+	}
+	for idx, c := range comps {
+		dir := x.iget(cur)
+		if dir.Mode != inode.Dir {
+			x.iput(dir)
+			return nil, 0, nil, ErrNotDir
+		} else if !f.cred.may(dir, permX) {
+			x.iput(dir)
+			return nil, 0, nil, ErrPerm
+		}
+
+		next, found := findEntry(x.readDir(dir), c)
+		if !found {
+			x.iput(dir)
+			if idx == len(comps)-1 {
+				return nil, 0, comps, ErrNotExist
+			}
+			return nil, 0, nil, ErrNotExist
+		} else if next == cur {
+			// Only a damaged directory lists itself
+			x.iput(dir)
+			return nil, 0, nil, ErrLoop
+		}
+
+		child := x.iget(next)
+		x.iput(dir)
+		if child.Mode == inode.Symlink && (idx < len(comps)-1 || follow) {
+			target := x.read(child)
+			x.iput(child)
+
+			links++
+			if links > maxSymlinks {
+				return nil, 0, nil, ErrLoop
+			}
+
+			// Relative targets hang off the link's directory
+			base := ""
+			if !strings.HasPrefix(target, "/") {
+				base = strings.Join(comps[:idx], "/")
+			}
+			rest := strings.Join(comps[idx+1:], "/")
+			comps = splitPath(base + "/" + target + "/" + rest)
+			goto restart
+		}
+		gen = child.Gen
+		x.iput(child)
+		cur = next
+		chain = append(chain, cur)
+	}
+	return chain, gen, comps, nil
+}
+
+// Resolves path to an inode number,
+// following symlinks all the way
+func (f *Filesystem) namei(path string) (uint16, error) {
+	h, _, err := f.walk(splitPath(path), true)
+	return h.inum, err
+}
+
+// Like namei, but if the last component
+// is a symlink, returns the link itself
+func (f *Filesystem) lnamei(path string) (uint16, error) {
+	h, _, err := f.walk(splitPath(path), false)
+	return h.inum, err
+}
+
+// Resolves everything but the last component of
+// path, returning the parent directory's inode number
+// and the final name. Fails on the root itself
+func (f *Filesystem) nameiparent(path string) (uint16, string, error) {
+	pinum, name, _, err := f.resolveParent(path)
+	return pinum, name, err
+}
+
+// nameiparent, but also returns the components
+// of the parent with any symlinks expanded
+func (f *Filesystem) resolveParent(path string) (uint16, string, []string, error) {
+	return f.resolveParentIn(nil, path)
+}
+
+func (f *Filesystem) resolveParentIn(x *Txn, path string) (uint16, string, []string, error) {
+	chain, name, pcomps, err := f.parentChainIn(x, path)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	return chain[len(chain)-1], name, pcomps, nil
+}
+
+// resolveParent, but returns the inode numbers of
+// the parent and all of its ancestors, root first
+func (f *Filesystem) parentChain(path string) ([]uint16, string, error) {
+	chain, name, _, err := f.parentChainIn(nil, path)
+	return chain, name, err
+}
+
+func (f *Filesystem) parentChainIn(x *Txn, path string) ([]uint16, string, []string, error) {
+	comps := splitPath(path)
+	if len(comps) == 0 {
+		return nil, "", nil, errors.New("invalid path")
+	}
+
+	name := comps[len(comps)-1]
+	if err := checkName(name); err != nil {
+		return nil, "", nil, err
+	}
+
+	chain, _, pcomps, err := f.walkChain(x, comps[:len(comps)-1], true)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return chain, name, pcomps, nil
+}
+
+// Locks the directory pinum for a modification.
+// Fails, releasing it, if it isn't a directory
+// (or has been freed from under us)
+func getDir(pinum uint16) (*inode.Inode, error) {
+	dir := inode.Geti(pinum)
+	if dir.Mode != inode.Dir || dir.Refcnt == 0 {
+		dir.Relse()
+		return nil, ErrNotDir
+	}
+	return dir, nil
+}
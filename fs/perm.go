@@ -0,0 +1,145 @@
+package fs
+
+import (
+	"pp2/inode"
+	"pp2/jrnl"
+	"pp2/quota"
+)
+
+// Who a mount acts as. Every inode has an owning uid
+// and gid and rwx bits for its owner, its group and
+// everyone else, checked as in Unix: reading and
+// writing a file takes r and w, listing a directory
+// takes r, looking up a name in it takes x, and adding
+// or removing names takes w and x. Uid 0 may do
+// anything. Clients are trusted to say who they are
+type Cred struct {
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32 // Besides Gid
+	Umask  uint16   // Bits cleared on new files and directories
+}
+
+// For tests and tools that need to see everything
+var RootCred = Cred{Umask: 022}
+
+const (
+	permR = 4
+	permW = 2
+	permX = 1
+)
+
+func (c *Cred) inGroup(gid uint32) bool {
+	if c.Gid == gid {
+		return true
+	}
+	for _, g := range c.Groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether c may do all of want to the held inode i.
+// Only one class of bits applies, so an owner can
+// be shut out of what everyone else may do
+func (c *Cred) may(i *inode.Inode, want uint16) bool {
+	if c.Uid == 0 {
+		return true
+	}
+
+	perm := i.Perms()
+	if c.Uid == i.Uid {
+		perm >>= 6
+	} else if c.inGroup(i.Gid) {
+		perm >>= 3
+	}
+	return perm&want == want
+}
+
+func (c *Cred) check(i *inode.Inode, want uint16) error {
+	if !c.may(i, want) {
+		return ErrPerm
+	}
+	return nil
+}
+
+// Makes the new inode i c's, with bits perm less the
+// umask. The caller enqueues it. Symlinks are always
+// open, since their target is what gets checked
+func (c *Cred) own(i *inode.Inode, perm uint16) {
+	perm &= 0777
+	if i.Mode == inode.Symlink {
+		perm = 0777
+	} else {
+		perm &^= c.Umask
+	}
+	i.Uid = c.Uid
+	i.Gid = c.Gid
+	i.Perm = perm
+	i.HasPerm = true
+}
+
+// Checks that we may do want to inum
+func (f *Filesystem) access(inum uint16, want uint16) error {
+	i := inode.Geti(inum)
+	defer i.Relse()
+	return f.cred.check(i, want)
+}
+
+// Sets the permission bits on path, following
+// symlinks. Only its owner or root may
+func (f *Filesystem) Chmod(path string, perm uint16) error {
+	return f.setOwner(path, func(i *inode.Inode) (uint32, uint32, uint16, error) {
+		if f.cred.Uid != 0 && f.cred.Uid != i.Uid {
+			return 0, 0, 0, ErrPerm
+		}
+		return i.Uid, i.Gid, perm, nil
+	})
+}
+
+// Gives path to uid and gid, following symlinks. Only
+// root may give a file away; its owner may only move
+// it to another group they're in
+func (f *Filesystem) Chown(path string, uid uint32, gid uint32) error {
+	return f.setOwner(path, func(i *inode.Inode) (uint32, uint32, uint16, error) {
+		if f.cred.Uid != 0 && (f.cred.Uid != i.Uid || uid != i.Uid || !f.cred.inGroup(gid)) {
+			return 0, 0, 0, ErrPerm
+		}
+		return uid, gid, i.Perms(), nil
+	})
+}
+
+// Runs pick on path's inode for its new owner and
+// bits, and writes them in their own transaction
+func (f *Filesystem) setOwner(path string, pick func(*inode.Inode) (uint32, uint32, uint16, error)) error {
+	inum, err := f.namei(path)
+	if err != nil {
+		return err
+	}
+	i := inode.Geti(inum)
+	defer i.Relse()
+	if i.Refcnt == 0 {
+		return ErrNotExist
+	}
+
+	uid, gid, perm, err := pick(i)
+	if err != nil {
+		return err
+	}
+	t := jrnl.BeginTransaction()
+	if uid != i.Uid {
+		// Whatever the new owner's quota says
+		err = quota.Move(t, quota.UserKey(i.Uid), quota.UserKey(uid), int(i.NBlocks()), 1)
+	}
+	if err == nil {
+		err = i.SetOwner(t, uid, gid, perm)
+	}
+	if err != nil {
+		t.AbortTransaction()
+		return err
+	}
+	t.EndTransaction(false)
+	return nil
+}
@@ -0,0 +1,199 @@
+package fs
+
+import (
+	"errors"
+	"pp2/inode"
+	"pp2/jrnl"
+	"pp2/quota"
+	"strconv"
+)
+
+// Quotas limit how many blocks and inodes a uid, or a
+// directory tree, may use. A tree is a directory given
+// a quota and everything made under it since, or in it
+// when the quota was set: each inode remembers which
+// tree it was made in, and is charged to it. Trees
+// don't nest; setting a quota inside one takes that
+// subtree out of the outer one. Limits are checked
+// whenever an inode is made or a write needs new
+// blocks, and going over fails the whole operation
+// with ErrQuota
+var ErrQuota = quota.ErrQuota
+
+// An inode can't be renamed or linked from one tree into
+// another while either has a quota, or it would stay
+// charged to the tree it left. As with a move between
+// devices, the caller can copy it over instead
+var ErrXDev = errors.New("can't move across quota trees")
+
+type Quota struct {
+	Tree bool   // A tree quota, not a user's
+	Id   uint32 // The uid, or the tree's inode number
+	quota.Usage
+}
+
+// Every quota that's set
+func (f *Filesystem) Quotas() []Quota {
+	res := []Quota{}
+	for _, e := range quota.List() {
+		id, err := strconv.ParseUint(e.Key[1:], 10, 32)
+		if err != nil {
+			continue
+		}
+		res = append(res, Quota{
+			Tree:  e.Key[0] == 't',
+			Id:    uint32(id),
+			Usage: e.Usage,
+		})
+	}
+	return res
+}
+
+// Sets uid's limits, where 0 means no limit; with
+// neither, uid stops being tracked. The first time
+// a uid gets a quota, every inode is read to count
+// what it already uses. Only root may set quotas
+func (f *Filesystem) SetUserQuota(uid uint32, blocks uint, inodes uint) error {
+	if f.cred.Uid != 0 {
+		return ErrPerm
+	}
+
+	key := quota.UserKey(uid)
+	used := quota.Usage{}
+	if !quota.Tracked(key) {
+		for inum := 0; inum < inode.NumInodes; inum++ {
+			i := inode.Peeki(uint16(inum))
+			if i != nil && i.Refcnt > 0 && i.Uid == uid {
+				used.Blocks += i.NBlocks()
+				used.Inodes++
+			}
+		}
+	}
+
+	t := jrnl.BeginTransaction()
+	if err := quota.SetLimits(t, key, blocks, inodes, used); err != nil {
+		t.AbortTransaction()
+		return err
+	}
+	t.EndTransaction(false)
+	return nil
+}
+
+// Like SetUserQuota, for the tree under the directory
+// at path. The first time, everything already in the
+// tree is retagged into it, one inode per transaction,
+// and counted to start it off. The root can't have a
+// tree quota, it's everything
+func (f *Filesystem) SetTreeQuota(path string, blocks uint, inodes uint) error {
+	if f.cred.Uid != 0 {
+		return ErrPerm
+	}
+	inum, err := f.namei(path)
+	if err != nil {
+		return err
+	} else if inum == f.rooti {
+		return errors.New("the root can't have a tree quota")
+	}
+	dir, err := getDir(inum)
+	if err != nil {
+		return err
+	}
+	dir.Relse()
+
+	key := quota.TreeKey(inum)
+	used := quota.Usage{}
+	if !quota.Tracked(key) && (blocks != 0 || inodes != 0) {
+		if used, err = adoptTree(inum); err != nil {
+			return err
+		}
+	}
+
+	t := jrnl.BeginTransaction()
+	if err := quota.SetLimits(t, key, blocks, inodes, used); err != nil {
+		t.AbortTransaction()
+		return err
+	}
+	t.EndTransaction(false)
+	return nil
+}
+
+// Whether the held inode i would cross trees by getting
+// a name in the held directory dir. A tree's head takes
+// its tree along wherever it goes
+func crossesTree(i *inode.Inode, dir *inode.Inode) bool {
+	if i.Tree == dir.Tree || i.Tree == i.Serialnum {
+		return false
+	}
+	return quota.Tracked(quota.TreeKey(i.Tree)) || quota.Tracked(quota.TreeKey(dir.Tree))
+}
+
+// Tags everything under the directory root with its
+// tree, stopping at other trees, and returns what it
+// all uses. Each inode counts once however many links
+// it has. The tree isn't tracked yet, so nothing is
+// charged to it here
+func adoptTree(root uint16) (quota.Usage, error) {
+	used := quota.Usage{}
+	seen := map[uint16]bool{root: true}
+	queue := []uint16{root}
+	for len(queue) > 0 {
+		inum := queue[0]
+		queue = queue[1:]
+
+		i := inode.Geti(inum)
+		if stopsTree(i, root) {
+			i.Relse()
+			continue
+		}
+		var ents []dirent
+		if i.Mode == inode.Dir {
+			ents = readDir(i)
+		}
+		err := moveToTree(i, root)
+		used.Blocks += i.NBlocks()
+		used.Inodes++
+		i.Relse()
+		if err != nil {
+			return used, err
+		}
+
+		for _, ent := range ents {
+			if !seen[ent.inum] {
+				seen[ent.inum] = true
+				queue = append(queue, ent.inum)
+			}
+		}
+	}
+	return used, nil
+}
+
+// Whether adoptTree stops at the held inode i:
+// it's gone, or heads a tree other than root's
+func stopsTree(i *inode.Inode, root uint16) bool {
+	return i.Refcnt == 0 || (i.Tree == i.Serialnum && i.Serialnum != root)
+}
+
+// Retags the held inode i as part of root's tree,
+// giving back what it used to the tree it leaves
+func moveToTree(i *inode.Inode, root uint16) error {
+	if i.Tree == root {
+		return nil
+	}
+	from := ""
+	if i.Tree != 0 {
+		from = quota.TreeKey(i.Tree)
+	}
+
+	t := jrnl.BeginTransaction()
+	i.Tree = root
+	err := i.EnqWrite(t)
+	if err == nil {
+		err = quota.Move(t, from, "", int(i.NBlocks()), 1)
+	}
+	if err != nil {
+		t.AbortTransaction()
+		return err
+	}
+	t.EndTransaction(false)
+	return nil
+}
@@ -0,0 +1,162 @@
+package fs
+
+import (
+	"errors"
+	"hash/fnv"
+	"pp2/inode"
+)
+
+type DirEntry struct {
+	Name string
+	Inum uint16
+	Mode inode.IType
+}
+
+// Lists the directory at path
+func (f *Filesystem) ReadDir(path string) ([]DirEntry, error) {
+	inum, err := f.namei(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := inode.Geti(inum)
+	if dir.Mode != inode.Dir {
+		dir.Relse()
+		return nil, ErrNotDir
+	} else if err := f.cred.check(dir, permR); err != nil {
+		dir.Relse()
+		return nil, err
+	}
+	ents := readDir(dir)
+	dir.Relse()
+	return toDirEntries(ents), nil
+}
+
+// Lists up to count entries of the directory at path,
+// starting from cursor, which is 0 for the first page.
+// Returns the cursor for the next page, or 0 once the
+// listing is done. Entries added or removed between
+// pages might be missed, and removing one can make
+// a cursor stale
+func (f *Filesystem) ReadDirPage(path string, cursor uint, count int) ([]DirEntry, uint, error) {
+	if count <= 0 {
+		return nil, 0, errors.New("invalid page size")
+	}
+	inum, err := f.namei(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dir := inode.Geti(inum)
+	if dir.Mode != inode.Dir {
+		dir.Relse()
+		return nil, 0, ErrNotDir
+	} else if err := f.cred.check(dir, permR); err != nil {
+		dir.Relse()
+		return nil, 0, err
+	}
+	ents, next, err := readDirPage(dir, cursor, count)
+	dir.Relse()
+	if err != nil {
+		return nil, 0, err
+	}
+	return toDirEntries(ents), next, nil
+}
+
+// In a migrated directory, the cursor is the byte offset
+// of the next record with a hash of that record above it.
+// It comes from the caller, so the record there is checked
+// against the hash; that way a page only reads the records
+// it returns. In a text directory, it's the index of the
+// next entry. The caller must hold dir
+func readDirPage(dir *inode.Inode, cursor uint, count int) ([]dirent, uint, error) {
+	if dir.Filesize == 0 {
+		return []dirent{}, 0, nil
+	} else if isLegacyDir(dir.Read(0, uint(len(dirMagic)))) {
+		// Not migrated yet, so there are no records
+		// to seek between. Page through the lot
+		ents := readDir(dir)
+		if cursor >= uint(len(ents)) {
+			return []dirent{}, 0, nil
+		}
+		ents = ents[cursor:]
+		if len(ents) <= count {
+			return ents, 0, nil
+		}
+		return ents[:count], cursor + uint(count), nil
+	}
+
+	off := cursor & cursorOffMask
+	if cursor == 0 {
+		off = uint(len(dirMagic))
+	} else if off >= dir.Filesize {
+		return []dirent{}, 0, nil
+	}
+
+	// Enough for the page and the record after it
+	b := []byte(dir.Read(off, uint(count+1)*(direntHdrLen+maxNameLen)))
+	if cursor != 0 {
+		check, ok := recordCheck(b)
+		if off < uint(len(dirMagic)) || !ok || check != cursor>>cursorOffBits {
+			return nil, 0, errors.New("stale directory cursor")
+		}
+	}
+
+	ents, n, err := parseEntries(b, count)
+	if err != nil {
+		return nil, 0, err
+	} else if n == 0 {
+		return nil, 0, errors.New("truncated directory entry")
+	}
+
+	next := off + uint(n)
+	if next >= dir.Filesize {
+		return ents, 0, nil
+	}
+	check, ok := recordCheck(b[n:])
+	if !ok {
+		return nil, 0, errors.New("truncated directory entry")
+	}
+	return ents, next | check<<cursorOffBits, nil
+}
+
+// Room for directories of up to 4 GiB
+const cursorOffBits = 32
+const cursorOffMask = 1<<cursorOffBits - 1
+
+// A hash of the record at the front of b, if a
+// whole, well-formed one is there
+func recordCheck(b []byte) (uint, bool) {
+	_, n, err := parseEntries(b, 1)
+	if err != nil || n == 0 {
+		return 0, false
+	}
+	h := fnv.New32a()
+	h.Write(b[:n])
+	return uint(h.Sum32()), true
+}
+
+// Whether inum was ever allocated. An entry naming
+// one that wasn't can't be read without a crash
+func madeInode(inum uint16) bool {
+	return uint(inum) < inode.NumInodes && inode.Probei(inum)
+}
+
+// Entries naming an inode that was never made are
+// left out; fsck is the place to find them
+func toDirEntries(ents []dirent) []DirEntry {
+	res := make([]DirEntry, 0, len(ents))
+	for _, ent := range ents {
+		if !madeInode(ent.inum) {
+			continue
+		}
+		child := inode.Geti(ent.inum)
+		res = append(res, DirEntry{
+			Name: ent.name,
+			Inum: ent.inum,
+			Mode: child.Mode,
+		})
+		child.Relse()
+	}
+	return res
+}
@@ -0,0 +1,154 @@
+package fs
+
+import (
+	"errors"
+	"pp2/inode"
+	"pp2/jrnl"
+)
+
+// Locks the two directories a and b, lowest inode
+// number first so that two renames going opposite ways
+// can't deadlock. If a == b, it is only locked once and
+// returned twice, so only release the first
+func getDirPair(a uint16, b uint16) (*inode.Inode, *inode.Inode, error) {
+	if a == b {
+		dir, err := getDir(a)
+		return dir, dir, err
+	}
+
+	first, second := a, b
+	if b < a {
+		first, second = b, a
+	}
+	fdir, err := getDir(first)
+	if err != nil {
+		return nil, nil, err
+	}
+	sdir, err := getDir(second)
+	if err != nil {
+		fdir.Relse()
+		return nil, nil, err
+	}
+
+	if first == a {
+		return fdir, sdir, nil
+	}
+	return sdir, fdir, nil
+}
+
+// Whether inum is one of the directories in chain
+func inChain(chain []uint16, inum uint16) bool {
+	for _, c := range chain {
+		if c == inum {
+			return true
+		}
+	}
+	return false
+}
+
+// Moves the entry at oldpath to newpath, replacing
+// whatever newpath named before. Both directories are
+// updated (and the replaced file freed) in one
+// transaction, so nobody ever sees both names or neither
+func (f *Filesystem) Rename(oldpath string, newpath string) error {
+	ochain, oname, err := f.parentChain(oldpath)
+	if err != nil {
+		return err
+	}
+	nchain, nname, err := f.parentChain(newpath)
+	if err != nil {
+		return err
+	}
+	opinum := ochain[len(ochain)-1]
+	npinum := nchain[len(nchain)-1]
+
+	odir, ndir, err := getDirPair(opinum, npinum)
+	if err != nil {
+		return err
+	}
+	defer odir.Relse()
+	if ndir != odir {
+		defer ndir.Relse()
+	}
+	if err := f.cred.check(odir, permW|permX); err != nil {
+		return err
+	} else if err := f.cred.check(ndir, permW|permX); err != nil {
+		return err
+	}
+
+	oents := readDir(odir)
+	nents := oents
+	if ndir != odir {
+		nents = readDir(ndir)
+	}
+
+	inum, found := findEntry(oents, oname)
+	if !found {
+		return ErrNotExist
+	}
+
+	// The chains are the directories above each parent,
+	// by inode number, so no spelling of the paths can
+	// hide that one is inside the other. Only directories
+	// are in a chain, and we can't lock one we hold
+	if inChain(nchain, inum) {
+		return errors.New("can't move a directory inside itself")
+	} else if tinum, found := findEntry(nents, nname); found && tinum != inum && inChain(ochain, tinum) {
+		// newpath is a directory holding oldpath
+		return ErrNotEmpty
+	}
+	src := inode.Geti(inum)
+	srcMode := src.Mode
+	cross := ndir != odir && crossesTree(src, ndir)
+	src.Relse()
+	if cross {
+		return ErrXDev
+	}
+
+	// If something is already at newpath, make sure
+	// we're allowed to clobber it, and hold it until
+	// it's freed
+	var target *inode.Inode
+	if tinum, found := findEntry(nents, nname); found {
+		if tinum == inum {
+			return nil
+		}
+		target = inode.Geti(tinum)
+		if srcMode == inode.Dir && target.Mode != inode.Dir {
+			target.Relse()
+			return ErrNotDir
+		} else if srcMode != inode.Dir && target.Mode == inode.Dir {
+			target.Relse()
+			return ErrIsDir
+		} else if target.Mode == inode.Dir && len(readDir(target)) > 0 {
+			target.Relse()
+			return ErrNotEmpty
+		}
+	}
+
+	t := jrnl.BeginTransaction()
+	if ndir == odir {
+		oents, _ = dropEntry(oents, oname)
+		err = writeDir(t, odir, setEntry(oents, nname, inum))
+	} else {
+		oents, _ = dropEntry(oents, oname)
+		err = writeDir(t, odir, oents)
+		if err == nil {
+			err = writeDir(t, ndir, setEntry(nents, nname, inum))
+		}
+	}
+	if err == nil && target != nil {
+		err = target.Free(t)
+	}
+
+	if err != nil {
+		t.AbortTransaction()
+		if target != nil {
+			target.Relse()
+		}
+		return err
+	}
+
+	t.EndTransaction(false)
+	return nil
+}
@@ -0,0 +1,72 @@
+package fs
+
+import (
+	"pp2/inode"
+	"time"
+)
+
+// What Stat and Fstat hand back. Reads don't
+// update Atime, since that would turn every read
+// into a transaction; it's set on create
+type Stat struct {
+	Inum   uint16
+	Handle Handle
+	Mode   inode.IType
+	Size   uint
+	Blocks uint // Actually allocated, so holes don't count
+	Nlink  uint16
+	Uid    uint32
+	Gid    uint32
+	Perm   uint16 // rwxrwxrwx
+	Atime  time.Time
+	Mtime  time.Time
+	Ctime  time.Time
+}
+
+func statInode(inum uint16) *Stat {
+	i := inode.Geti(inum)
+	defer i.Relse()
+	return statOf(i)
+}
+
+func statOf(i *inode.Inode) *Stat {
+	return &Stat{
+		Inum:   i.Serialnum,
+		Handle: Handle{inum: i.Serialnum, gen: i.Gen},
+		Mode:   i.Mode,
+		Size:   i.Filesize,
+		Blocks: i.NBlocks(),
+		Nlink:  i.Refcnt,
+		Uid:    i.Uid,
+		Gid:    i.Gid,
+		Perm:   i.Perms(),
+		Atime:  time.Unix(0, i.Atime),
+		Mtime:  time.Unix(0, i.Mtime),
+		Ctime:  time.Unix(0, i.Ctime),
+	}
+}
+
+func (f *Filesystem) Stat(path string) (*Stat, error) {
+	inum, err := f.namei(path)
+	if err != nil {
+		return nil, err
+	}
+	return statInode(inum), nil
+}
+
+// Stat, except a symlink at the end
+// of path is described itself
+func (f *Filesystem) Lstat(path string) (*Stat, error) {
+	inum, err := f.lnamei(path)
+	if err != nil {
+		return nil, err
+	}
+	return statInode(inum), nil
+}
+
+func (f *Filesystem) Fstat(fd int) (*Stat, error) {
+	if _, ok := f.fdTable[fd]; !ok {
+		return nil, ErrBadFd
+	}
+	return f.StatHandle(f.fdTable[fd].handle())
+}
@@ -0,0 +1,64 @@
+package fs
+
+import (
+	"errors"
+	"pp2/inode"
+	"pp2/jrnl"
+)
+
+// Sets the length of the file at path to size,
+// following symlinks. Growing fills with zeroes
+func (f *Filesystem) Truncate(path string, size uint) error {
+	inum, err := f.namei(path)
+	if err != nil {
+		return err
+	} else if err := f.access(inum, permW); err != nil {
+		return err
+	}
+	i := inode.Geti(inum)
+	defer i.Relse()
+	if i.Refcnt == 0 {
+		return ErrNotExist
+	}
+	return resize(i, size)
+}
+
+// Truncate for an open fd, which has
+// to have been opened for writing
+func (f *Filesystem) Ftruncate(fd int, size uint) error {
+	if _, ok := f.fdTable[fd]; !ok {
+		return ErrBadFd
+	}
+
+	file := f.fdTable[fd]
+	if !file.writable() {
+		return errors.New("fd not open for writing")
+	}
+	i, err := file.handle().geti()
+	if err != nil {
+		return err
+	}
+	defer i.Relse()
+	return resize(i, size)
+}
+
+// Resizes an inode the caller holds,
+// in its own transaction
+func resize(i *inode.Inode, size uint) error {
+	if i.Mode == inode.Dir {
+		return ErrIsDir
+	}
+
+	t := jrnl.BeginTransaction()
+	err := i.Resize(t, size)
+	if err == nil {
+		err = i.Touch(t, inode.MTime|inode.CTime)
+	}
+	if err != nil {
+		t.AbortTransaction()
+		return err
+	}
+
+	t.EndTransaction(false)
+	return nil
+}
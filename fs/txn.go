@@ -0,0 +1,454 @@
+package fs
+
+import (
+	"errors"
+	"pp2/inode"
+	"pp2/jrnl"
+)
+
+var ErrTxnDone = errors.New("transaction already committed or aborted")
+
+// A user-visible transaction: a run of Write, Create,
+// Unlink, Truncate, Chmod and Rename calls that commit
+// or abort together. Every inode the transaction
+// touches stays locked until it ends, so other clients
+// see all of it or none of it. Keep them short. Like any transaction this
+// holds up everybody's commits while it's open, and
+// locks are taken in whatever order the calls need
+// them, so two clients working over the same files in
+// different orders can stall each other until a lease
+// runs out. While one is open, don't use the files it
+// has touched through the Filesystem directly
+type Txn struct {
+	f       *Filesystem
+	t       *jrnl.TxnHandle
+	held    map[uint16]*inode.Inode
+	offsets map[int]uint // fd -> offset after commit
+	created []int        // fds to close on abort
+	done    bool
+}
+
+func (f *Filesystem) Begin() *Txn {
+	return &Txn{
+		f:       f,
+		t:       jrnl.BeginTransaction(),
+		held:    make(map[uint16]*inode.Inode),
+		offsets: make(map[int]uint),
+	}
+}
+
+// The helpers below let path walking share code
+// with plain operations: on a nil *Txn they go
+// straight to disk
+
+// Locks inum, or hands back our copy
+// if the transaction already has it
+func (x *Txn) iget(inum uint16) *inode.Inode {
+	if x == nil {
+		return inode.Geti(inum)
+	} else if i, ok := x.held[inum]; ok {
+		return i
+	}
+	return inode.Geti(inum)
+}
+
+// Lets go of i, unless the transaction holds it
+func (x *Txn) iput(i *inode.Inode) {
+	if x == nil || x.held[i.Serialnum] != i {
+		i.Relse()
+	}
+}
+
+// Locks inum until the transaction ends
+func (x *Txn) hold(inum uint16) *inode.Inode {
+	i := x.iget(inum)
+	x.held[inum] = i
+	return i
+}
+
+func (x *Txn) heldSet() map[uint16]bool {
+	res := make(map[uint16]bool)
+	for inum := range x.held {
+		res[inum] = true
+	}
+	return res
+}
+
+func (x *Txn) read(i *inode.Inode) string {
+	if x == nil {
+		return i.Read(0, i.Filesize)
+	}
+	return i.ReadIn(x.t, 0, i.Filesize)
+}
+
+func (x *Txn) readDir(dir *inode.Inode) []dirent {
+	if x == nil {
+		return readDir(dir)
+	}
+	return readDirIn(x.t, dir)
+}
+
+// getDir, for the rest of the transaction,
+// checking we may change the directory
+func (x *Txn) holdDir(pinum uint16) (*inode.Inode, error) {
+	dir := x.iget(pinum)
+	if dir.Mode != inode.Dir || dir.Refcnt == 0 {
+		x.iput(dir)
+		return nil, ErrNotDir
+	} else if err := x.f.cred.check(dir, permW|permX); err != nil {
+		x.iput(dir)
+		return nil, err
+	}
+	x.held[pinum] = dir
+	return dir, nil
+}
+
+// Aborts the whole transaction, for when an
+// operation fails after it started changing things
+func (x *Txn) fail(err error) error {
+	x.Abort()
+	return err
+}
+
+// Like Filesystem.Write. The fd's offset moves
+// when the transaction commits
+func (x *Txn) Write(fd int, data string) (uint, error) {
+	if x.done {
+		return 0, ErrTxnDone
+	} else if _, ok := x.f.fdTable[fd]; !ok {
+		return 0, ErrBadFd
+	}
+
+	file := x.f.fdTable[fd]
+	if !file.writable() {
+		return 0, errors.New("fd not open for writing")
+	}
+
+	_, seen := x.held[file.inum]
+	i := x.hold(file.inum)
+	if i.Mode == inode.Dir || i.Refcnt == 0 || i.Gen != file.gen {
+		if !seen {
+			delete(x.held, file.inum)
+			i.Relse()
+		}
+		if i.Mode == inode.Dir {
+			return 0, ErrIsDir
+		}
+		return 0, ErrStale
+	}
+
+	offset, ok := x.offsets[fd]
+	if !ok {
+		offset = file.offset
+	}
+	if file.flags&O_APPEND != 0 {
+		offset = i.Filesize
+	}
+
+	cnt, err := i.Write(x.t, offset, data)
+	if err == nil {
+		err = i.Touch(x.t, inode.MTime|inode.CTime)
+	}
+	if err != nil {
+		return 0, x.fail(err)
+	}
+
+	x.offsets[fd] = offset + cnt
+	return cnt, nil
+}
+
+// Makes a new, empty file at path and opens it
+// read-write. Fails if something is already there.
+// If the transaction aborts, the fd is closed
+func (x *Txn) Create(path string) (int, error) {
+	if x.done {
+		return -1, ErrTxnDone
+	}
+
+	pinum, name, _, err := x.f.resolveParentIn(x, path)
+	if err != nil {
+		return -1, err
+	}
+
+	// Don't allocate if we can see it's
+	// there, like create does
+	dir := x.iget(pinum)
+	_, found := findEntry(x.readDir(dir), name)
+	tree := dir.Tree
+	x.iput(dir)
+	if found {
+		return -1, ErrExist
+	}
+
+	newi := inode.AllociExcept(x.t, inode.File, x.heldSet())
+	x.f.cred.own(newi, 0666)
+	newi.Tree = tree
+	x.held[newi.Serialnum] = newi
+	if err := newi.Charge(x.t, 0, 1); err != nil {
+		return -1, x.fail(err)
+	}
+	if err := newi.Touch(x.t, inode.ATime|inode.MTime|inode.CTime); err != nil {
+		return -1, x.fail(err)
+	}
+
+	dir, err = x.holdDir(pinum)
+	if err != nil {
+		return -1, x.fail(err)
+	}
+	if _, found := findEntry(x.readDir(dir), name); found {
+		// Beaten to it. Give the inode back in
+		// this same transaction
+		if err := newi.Unref(x.t); err != nil {
+			return -1, x.fail(err)
+		}
+		return -1, ErrExist
+	}
+	if err := addEntry(x.t, dir, dirent{name: name, inum: newi.Serialnum}); err != nil {
+		return -1, x.fail(err)
+	}
+
+	fd := x.f.mkFd()
+	x.f.fdTable[fd] = &File{
+		inum:  newi.Serialnum,
+		gen:   newi.Gen,
+		flags: O_RDWR,
+	}
+	x.created = append(x.created, fd)
+	return fd, nil
+}
+
+// Like Filesystem.Unlink
+func (x *Txn) Unlink(path string) error {
+	if x.done {
+		return ErrTxnDone
+	}
+
+	pinum, name, _, err := x.f.resolveParentIn(x, path)
+	if err != nil {
+		return err
+	}
+	dir, err := x.holdDir(pinum)
+	if err != nil {
+		return err
+	}
+
+	inum, found := findEntry(x.readDir(dir), name)
+	if !found {
+		return ErrNotExist
+	}
+	_, seen := x.held[inum]
+	child := x.hold(inum)
+	if child.Mode == inode.Dir {
+		if !seen {
+			delete(x.held, inum)
+			child.Relse()
+		}
+		return ErrIsDir
+	}
+
+	if err := removeEntry(x.t, dir, name); err != nil {
+		return x.fail(err)
+	}
+	if err := child.Touch(x.t, inode.CTime); err != nil {
+		return x.fail(err)
+	}
+	if err := child.Unref(x.t); err != nil {
+		return x.fail(err)
+	}
+	return nil
+}
+
+// Locks whatever path names until the
+// transaction ends, following symlinks
+func (x *Txn) holdPath(path string) (*inode.Inode, error) {
+	inum, _, err := x.f.walkIn(x, splitPath(path), true)
+	if err != nil {
+		return nil, err
+	}
+	_, seen := x.held[inum]
+	i := x.hold(inum)
+	if i.Refcnt == 0 {
+		if !seen {
+			delete(x.held, inum)
+			i.Relse()
+		}
+		return nil, ErrNotExist
+	}
+	return i, nil
+}
+
+// Like Filesystem.Truncate
+func (x *Txn) Truncate(path string, size uint) error {
+	if x.done {
+		return ErrTxnDone
+	}
+
+	i, err := x.holdPath(path)
+	if err != nil {
+		return err
+	} else if i.Mode == inode.Dir {
+		return ErrIsDir
+	} else if err := x.f.cred.check(i, permW); err != nil {
+		return err
+	}
+
+	if err := i.Resize(x.t, size); err != nil {
+		return x.fail(err)
+	}
+	if err := i.Touch(x.t, inode.MTime|inode.CTime); err != nil {
+		return x.fail(err)
+	}
+	return nil
+}
+
+// Like Filesystem.Chmod
+func (x *Txn) Chmod(path string, perm uint16) error {
+	if x.done {
+		return ErrTxnDone
+	}
+
+	i, err := x.holdPath(path)
+	if err != nil {
+		return err
+	} else if x.f.cred.Uid != 0 && x.f.cred.Uid != i.Uid {
+		return ErrPerm
+	}
+
+	if err := i.SetOwner(x.t, i.Uid, i.Gid, perm); err != nil {
+		return x.fail(err)
+	}
+	return nil
+}
+
+// Like Filesystem.Rename. The directories are
+// locked lowest inode number first, as there
+func (x *Txn) Rename(oldpath string, newpath string) error {
+	if x.done {
+		return ErrTxnDone
+	}
+
+	ochain, oname, _, err := x.f.parentChainIn(x, oldpath)
+	if err != nil {
+		return err
+	}
+	nchain, nname, _, err := x.f.parentChainIn(x, newpath)
+	if err != nil {
+		return err
+	}
+	opinum := ochain[len(ochain)-1]
+	npinum := nchain[len(nchain)-1]
+
+	first, second := opinum, npinum
+	if second < first {
+		first, second = second, first
+	}
+	if _, err := x.holdDir(first); err != nil {
+		return err
+	} else if _, err := x.holdDir(second); err != nil {
+		return err
+	}
+	odir, ndir := x.held[opinum], x.held[npinum]
+
+	oents := x.readDir(odir)
+	nents := oents
+	if ndir != odir {
+		nents = x.readDir(ndir)
+	}
+	inum, found := findEntry(oents, oname)
+	if !found {
+		return ErrNotExist
+	}
+
+	// See Filesystem.Rename
+	if inChain(nchain, inum) {
+		return errors.New("can't move a directory inside itself")
+	} else if tinum, found := findEntry(nents, nname); found && tinum != inum && inChain(ochain, tinum) {
+		return ErrNotEmpty
+	}
+	src := x.iget(inum)
+	srcMode := src.Mode
+	cross := ndir != odir && crossesTree(src, ndir)
+	x.iput(src)
+	if cross {
+		return ErrXDev
+	}
+
+	var target *inode.Inode
+	if tinum, found := findEntry(nents, nname); found {
+		if tinum == inum {
+			return nil
+		}
+		_, seen := x.held[tinum]
+		target = x.hold(tinum)
+		var bad error
+		if srcMode == inode.Dir && target.Mode != inode.Dir {
+			bad = ErrNotDir
+		} else if srcMode != inode.Dir && target.Mode == inode.Dir {
+			bad = ErrIsDir
+		} else if target.Mode == inode.Dir && len(x.readDir(target)) > 0 {
+			bad = ErrNotEmpty
+		}
+		if bad != nil {
+			if !seen {
+				delete(x.held, tinum)
+				target.Relse()
+			}
+			return bad
+		}
+	}
+
+	oents, _ = dropEntry(oents, oname)
+	if ndir == odir {
+		err = writeDir(x.t, odir, setEntry(oents, nname, inum))
+	} else {
+		err = writeDir(x.t, odir, oents)
+		if err == nil {
+			err = writeDir(x.t, ndir, setEntry(nents, nname, inum))
+		}
+	}
+	if err == nil && target != nil {
+		err = target.Unref(x.t)
+	}
+	if err != nil {
+		return x.fail(err)
+	}
+	return nil
+}
+
+// Makes everything in the transaction visible at once
+func (x *Txn) Commit() error {
+	if x.done {
+		return ErrTxnDone
+	}
+
+	x.t.EndTransaction(false)
+	x.release()
+	for fd, offset := range x.offsets {
+		if file, ok := x.f.fdTable[fd]; ok {
+			file.offset = offset
+		}
+	}
+	return nil
+}
+
+// Throws away everything in the transaction
+func (x *Txn) Abort() error {
+	if x.done {
+		return ErrTxnDone
+	}
+
+	x.t.AbortTransaction()
+	x.release()
+	for _, fd := range x.created {
+		delete(x.f.fdTable, fd)
+	}
+	return nil
+}
+
+func (x *Txn) release() {
+	for _, i := range x.held {
+		i.Relse()
+	}
+	x.held = nil
+	x.done = true
+}
@@ -0,0 +1,79 @@
+package fs
+
+import (
+	"pp2/inode"
+	"pp2/jrnl"
+)
+
+// Extended attributes: small name/value pairs kept
+// in the inode, e.g. a content type. All of these
+// follow symlinks. Reading them takes read
+// permission, changing them takes write
+var (
+	ErrNoAttr    = inode.ErrNoXattr
+	ErrAttrSpace = inode.ErrXattrSpace
+)
+
+func (f *Filesystem) Getxattr(path string, name string) (string, error) {
+	inum, err := f.namei(path)
+	if err != nil {
+		return "", err
+	}
+	i := inode.Geti(inum)
+	defer i.Relse()
+	if err := f.cred.check(i, permR); err != nil {
+		return "", err
+	}
+	return i.GetXattr(name)
+}
+
+// The names of every attribute on path, sorted
+func (f *Filesystem) Listxattr(path string) ([]string, error) {
+	inum, err := f.namei(path)
+	if err != nil {
+		return nil, err
+	}
+	i := inode.Geti(inum)
+	defer i.Relse()
+	if err := f.cred.check(i, permR); err != nil {
+		return nil, err
+	}
+	return i.ListXattrs(), nil
+}
+
+// Sets name on path to value, replacing any old value.
+// Every file's attributes share about 1 KiB between them
+func (f *Filesystem) Setxattr(path string, name string, value string) error {
+	return f.editXattrs(path, func(t *jrnl.TxnHandle, i *inode.Inode) error {
+		return i.SetXattr(t, name, value)
+	})
+}
+
+func (f *Filesystem) Removexattr(path string, name string) error {
+	return f.editXattrs(path, func(t *jrnl.TxnHandle, i *inode.Inode) error {
+		return i.RemoveXattr(t, name)
+	})
+}
+
+// Runs edit on path's inode in its own transaction
+func (f *Filesystem) editXattrs(path string, edit func(*jrnl.TxnHandle, *inode.Inode) error) error {
+	inum, err := f.namei(path)
+	if err != nil {
+		return err
+	}
+	i := inode.Geti(inum)
+	defer i.Relse()
+	if i.Refcnt == 0 {
+		return ErrNotExist
+	} else if err := f.cred.check(i, permW); err != nil {
+		return err
+	}
+
+	t := jrnl.BeginTransaction()
+	if err := edit(t, i); err != nil {
+		t.AbortTransaction()
+		return err
+	}
+	t.EndTransaction(false)
+	return nil
+}
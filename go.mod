@@ -1,5 +1,5 @@
 module pp2
 
-go 1.13
+go 1.16
 
 require github.com/google/go-cmp v0.5.5
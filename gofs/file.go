@@ -0,0 +1,170 @@
+package gofs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// An open pp2 file
+type File struct {
+	g      *FS
+	fd     int
+	name   string
+	closed bool
+}
+
+func (file *File) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	file.g.mu.Lock()
+	defer file.g.mu.Unlock()
+	if file.closed {
+		return 0, pathErr("read", file.name, fs.ErrClosed)
+	}
+	data, err := file.g.fs.Read(file.fd, uint(len(p)))
+	if err != nil {
+		return 0, pathErr("read", file.name, err)
+	} else if data == "" {
+		return 0, io.EOF
+	}
+	return copy(p, data), nil
+}
+
+// As io.ReaderAt requires, a short read
+// always comes with an error
+func (file *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, pathErr("read", file.name, errors.New("negative offset"))
+	}
+
+	file.g.mu.Lock()
+	defer file.g.mu.Unlock()
+	if file.closed {
+		return 0, pathErr("read", file.name, fs.ErrClosed)
+	}
+	data, err := file.g.fs.ReadAt(file.fd, uint(off), uint(len(p)))
+	if err != nil {
+		return 0, pathErr("read", file.name, err)
+	}
+
+	n := copy(p, data)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (file *File) Write(p []byte) (int, error) {
+	file.g.mu.Lock()
+	defer file.g.mu.Unlock()
+	if file.closed {
+		return 0, pathErr("write", file.name, fs.ErrClosed)
+	}
+	cnt, err := file.g.fs.Write(file.fd, string(p))
+	if err != nil {
+		return int(cnt), pathErr("write", file.name, err)
+	}
+	return int(cnt), nil
+}
+
+func (file *File) Seek(offset int64, whence int) (int64, error) {
+	file.g.mu.Lock()
+	defer file.g.mu.Unlock()
+	if file.closed {
+		return 0, pathErr("seek", file.name, fs.ErrClosed)
+	}
+	res, err := file.g.fs.Seek(file.fd, offset, whence)
+	if err != nil {
+		return 0, pathErr("seek", file.name, err)
+	}
+	return int64(res), nil
+}
+
+func (file *File) Stat() (fs.FileInfo, error) {
+	file.g.mu.Lock()
+	defer file.g.mu.Unlock()
+	if file.closed {
+		return nil, pathErr("stat", file.name, fs.ErrClosed)
+	}
+	st, err := file.g.fs.Fstat(file.fd)
+	if err != nil {
+		return nil, pathErr("stat", file.name, err)
+	}
+	return &fileInfo{name: baseName(file.name), st: st}, nil
+}
+
+func (file *File) Close() error {
+	file.g.mu.Lock()
+	defer file.g.mu.Unlock()
+	if file.closed {
+		return pathErr("close", file.name, fs.ErrClosed)
+	}
+	file.closed = true
+	file.g.fs.Close(file.fd)
+	return nil
+}
+
+// An open directory. Listings are read a page at a
+// time, so they aren't sorted
+type dir struct {
+	g      *FS
+	name   string
+	cursor uint
+	done   bool
+	closed bool
+}
+
+func (d *dir) Read(p []byte) (int, error) {
+	return 0, pathErr("read", d.name, errors.New("is a directory"))
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.g.Stat(d.name)
+}
+
+// As fs.ReadDirFile: with n > 0, returns at most n
+// entries and io.EOF at the end; otherwise returns
+// everything that's left
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, pathErr("readdir", d.name, fs.ErrClosed)
+	}
+
+	res := []fs.DirEntry{}
+	for !d.done && (n <= 0 || len(res) < n) {
+		count := n - len(res)
+		if n <= 0 {
+			count = readDirPage
+		}
+
+		d.g.mu.Lock()
+		ents, next, err := d.g.fs.ReadDirPage(toPath(d.name), d.cursor, count)
+		d.g.mu.Unlock()
+		if err != nil {
+			return res, pathErr("readdir", d.name, err)
+		}
+
+		res = append(res, d.g.toDirEntries(d.name, ents)...)
+		d.cursor = next
+		d.done = next == 0
+	}
+
+	if n > 0 && len(res) == 0 {
+		return res, io.EOF
+	}
+	return res, nil
+}
+
+// How many entries ReadDir(-1) reads at once
+const readDirPage = 64
+
+func (d *dir) Close() error {
+	if d.closed {
+		return pathErr("close", d.name, fs.ErrClosed)
+	}
+	d.closed = true
+	return nil
+}
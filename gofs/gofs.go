@@ -0,0 +1,213 @@
+package gofs
+
+import (
+	"io"
+	"io/fs"
+	pfs "pp2/fs"
+	"pp2/inode"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Adapts a pp2 filesystem to the standard library's
+// interfaces: the tree is an fs.FS (and ReadDirFS and
+// StatFS), and open files are io.Reader, io.Writer,
+// io.Seeker, io.ReaderAt and io.Closer. A pp2
+// Filesystem isn't safe for concurrent use, so every
+// call goes through one mutex, which makes this safe
+// to hand to e.g. http.FileServer
+type FS struct {
+	mu sync.Mutex
+	fs *pfs.Filesystem
+}
+
+var (
+	_ fs.ReadDirFS       = (*FS)(nil)
+	_ fs.StatFS          = (*FS)(nil)
+	_ io.ReadWriteSeeker = (*File)(nil)
+	_ io.ReaderAt        = (*File)(nil)
+	_ io.Closer          = (*File)(nil)
+	_ fs.ReadDirFile     = (*dir)(nil)
+)
+
+func New(f *pfs.Filesystem) *FS {
+	return &FS{fs: f}
+}
+
+// io/fs names are unrooted and slash-separated,
+// with "." for the root
+func toPath(name string) string {
+	if name == "." {
+		return "/"
+	}
+	return "/" + name
+}
+
+func baseName(name string) string {
+	return name[strings.LastIndex(name, "/")+1:]
+}
+
+// Wraps err from pp2 so errors.Is matches
+// the io/fs errors it corresponds to
+func pathErr(op string, name string, err error) error {
+	switch err {
+	case pfs.ErrNotExist:
+		err = fs.ErrNotExist
+	case pfs.ErrExist:
+		err = fs.ErrExist
+	case pfs.ErrBadFd:
+		err = fs.ErrClosed
+	case pfs.ErrPerm:
+		err = fs.ErrPermission
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// Opens name read-only. Directories come back as
+// fs.ReadDirFile, everything else as a *File
+func (g *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathErr("open", name, fs.ErrInvalid)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st, err := g.fs.Stat(toPath(name))
+	if err != nil {
+		return nil, pathErr("open", name, err)
+	} else if st.Mode == inode.Dir {
+		return &dir{g: g, name: name}, nil
+	}
+
+	fd, err := g.fs.Open(toPath(name), pfs.O_RDONLY)
+	if err != nil {
+		return nil, pathErr("open", name, err)
+	}
+	return &File{g: g, fd: fd, name: name}, nil
+}
+
+// Opens name with pp2 open flags, for
+// writing. Directories can't be opened this way
+func (g *FS) OpenFile(name string, flags int) (*File, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathErr("open", name, fs.ErrInvalid)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fd, err := g.fs.Open(toPath(name), flags)
+	if err != nil {
+		return nil, pathErr("open", name, err)
+	}
+	return &File{g: g, fd: fd, name: name}, nil
+}
+
+func (g *FS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathErr("stat", name, fs.ErrInvalid)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st, err := g.fs.Stat(toPath(name))
+	if err != nil {
+		return nil, pathErr("stat", name, err)
+	}
+	return &fileInfo{name: baseName(name), st: st}, nil
+}
+
+// Lists name, sorted by filename
+func (g *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, pathErr("readdir", name, fs.ErrInvalid)
+	}
+
+	g.mu.Lock()
+	ents, err := g.fs.ReadDir(toPath(name))
+	g.mu.Unlock()
+	if err != nil {
+		return nil, pathErr("readdir", name, err)
+	}
+
+	res := g.toDirEntries(name, ents)
+	sort.Slice(res, func(a, b int) bool {
+		return res[a].Name() < res[b].Name()
+	})
+	return res, nil
+}
+
+func (g *FS) toDirEntries(dirname string, ents []pfs.DirEntry) []fs.DirEntry {
+	res := make([]fs.DirEntry, 0, len(ents))
+	for _, ent := range ents {
+		res = append(res, &dirEntry{
+			g:    g,
+			path: joinName(dirname, ent.Name),
+			ent:  ent,
+		})
+	}
+	return res
+}
+
+func joinName(dirname string, name string) string {
+	if dirname == "." {
+		return name
+	}
+	return dirname + "/" + name
+}
+
+type fileInfo struct {
+	name string
+	st   *pfs.Stat
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return int64(fi.st.Size) }
+func (fi *fileInfo) ModTime() time.Time { return fi.st.Mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return fi.st }
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	perm := fs.FileMode(fi.st.Perm)
+	switch fi.st.Mode {
+	case inode.Dir:
+		return fs.ModeDir | perm
+	case inode.Symlink:
+		return fs.ModeSymlink | perm
+	}
+	return perm
+}
+
+type dirEntry struct {
+	g    *FS
+	path string
+	ent  pfs.DirEntry
+}
+
+func (de *dirEntry) Name() string { return de.ent.Name }
+
+func (de *dirEntry) IsDir() bool { return de.Type().IsDir() }
+
+func (de *dirEntry) Type() fs.FileMode {
+	switch de.ent.Mode {
+	case inode.Dir:
+		return fs.ModeDir
+	case inode.Symlink:
+		return fs.ModeSymlink
+	}
+	return 0
+}
+
+// Describes the entry itself, not what a symlink
+// points to. Might fail if it's been removed since
+// the listing
+func (de *dirEntry) Info() (fs.FileInfo, error) {
+	de.g.mu.Lock()
+	defer de.g.mu.Unlock()
+	st, err := de.g.fs.Lstat(toPath(de.path))
+	if err != nil {
+		return nil, pathErr("stat", de.path, err)
+	}
+	return &fileInfo{name: de.ent.Name, st: st}, nil
+}
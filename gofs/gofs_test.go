@@ -0,0 +1,153 @@
+package gofs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"pp2/balloc"
+	"pp2/bio"
+	pfs "pp2/fs"
+	"pp2/inode"
+	"pp2/jrnl"
+	"pp2/quota"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// Checks the adapters against the standard library's
+// expectations, on top of the mock disk
+
+// Partitions:
+//	-> FS
+//		-> files, nested dirs, symlinks, empty dir
+//		-> missing name (=FAIL), invalid name (=FAIL)
+//	-> File
+//		-> Read to EOF, ReadAt short (=EOF), Seek, Write
+//		-> use after Close (=FAIL)
+//	-> WalkDir
+//		-> visits everything once
+
+func initUut(tt *testing.T) *FS {
+	bio.Binit("", true)
+	jrnl.InitSb()
+	balloc.InitBalloc(inode.EndInode)
+	quota.InitQuota(balloc.EndData())
+	inode.InodeInit()
+
+	f := pfs.Mount(pfs.RootCred)
+	for _, d := range []string{"/a", "/a/b", "/empty"} {
+		if err := f.Mkdir(d); err != nil {
+			tt.Fatalf("failed to mkdir %s: %s", d, err)
+		}
+	}
+	g := New(f)
+	for name, data := range map[string]string{
+		"top":     "hello",
+		"a/mid":   strings.Repeat("m", 5000),
+		"a/b/low": "",
+	} {
+		file, err := g.OpenFile(name, pfs.O_WRONLY|pfs.O_CREAT|pfs.O_EXCL)
+		if err != nil {
+			tt.Fatalf("failed to create %s: %s", name, err)
+		}
+		if _, err := io.WriteString(file, data); err != nil {
+			tt.Fatalf("failed to write %s: %s", name, err)
+		}
+		file.Close()
+	}
+	if err := f.Symlink("/a/mid", "/link"); err != nil {
+		tt.Fatalf("failed to symlink: %s", err)
+	}
+	return g
+}
+
+// Covers:
+//	-> fs/files
+//	-> fs/nested
+//	-> fs/symlinks
+//	-> fs/emptydir
+func TestFS(tt *testing.T) {
+	g := initUut(tt)
+	if err := fstest.TestFS(g, "top", "a/mid", "a/b/low", "link", "empty"); err != nil {
+		tt.Error(err)
+	}
+}
+
+// Covers:
+//	-> fs/missing
+//	-> fs/invalid
+//	-> file/read
+//	-> file/readat
+//	-> file/seek
+//	-> file/write
+//	-> file/closed
+func TestFile(tt *testing.T) {
+	g := initUut(tt)
+	if _, err := g.Open("nope"); !errors.Is(err, fs.ErrNotExist) {
+		tt.Errorf("got %v opening a missing file, wanted ErrNotExist", err)
+	}
+	if _, err := g.Open("/top"); !errors.Is(err, fs.ErrInvalid) {
+		tt.Errorf("got %v opening an invalid name, wanted ErrInvalid", err)
+	}
+
+	file, err := g.OpenFile("top", pfs.O_RDWR)
+	if err != nil {
+		tt.Fatalf("failed to open: %s", err)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil || string(data) != "hello" {
+		tt.Errorf("read %q, %v", data, err)
+	}
+
+	buf := make([]byte, 4)
+	if n, err := file.ReadAt(buf, 3); n != 2 || err != io.EOF {
+		tt.Errorf("short ReadAt gave %d, %v", n, err)
+	}
+	if off, err := file.Seek(-1, io.SeekEnd); off != 4 || err != nil {
+		tt.Errorf("seek gave %d, %v", off, err)
+	}
+	if _, err := io.WriteString(file, "!!"); err != nil {
+		tt.Errorf("failed to write: %s", err)
+	}
+	if st, err := file.Stat(); err != nil || st.Size() != 6 || st.Name() != "top" {
+		tt.Errorf("stat gave %v, %v", st, err)
+	}
+
+	if err := file.Close(); err != nil {
+		tt.Errorf("failed to close: %s", err)
+	}
+	if _, err := file.Read(buf); !errors.Is(err, fs.ErrClosed) {
+		tt.Errorf("got %v reading a closed file, wanted ErrClosed", err)
+	}
+	if err := file.Close(); !errors.Is(err, fs.ErrClosed) {
+		tt.Errorf("got %v closing twice, wanted ErrClosed", err)
+	}
+
+	data, err = fs.ReadFile(g, "top")
+	if err != nil || string(data) != "hell!!" {
+		tt.Errorf("read back %q, %v", data, err)
+	}
+}
+
+// Covers:
+//	-> walkdir/everything
+func TestWalkDir(tt *testing.T) {
+	g := initUut(tt)
+	seen := []string{}
+	err := fs.WalkDir(g, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		seen = append(seen, path)
+		return nil
+	})
+	if err != nil {
+		tt.Fatalf("walk failed: %s", err)
+	}
+
+	want := ". a a/b a/b/low a/mid empty link top"
+	if strings.Join(seen, " ") != want {
+		tt.Errorf("walked %v, wanted %s", seen, want)
+	}
+}
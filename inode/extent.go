@@ -0,0 +1,107 @@
+package inode
+
+// The direct blocks are mapped by a list of extents,
+// runs of blocks that sit one after another on disk,
+// so a file written in one go takes a single entry
+// however long it is. Gaps between extents are holes.
+// A file too fragmented for maxExtents falls back to
+// Addrs, one address per block, which always fits;
+// so do inodes from before extents. Whichever is in
+// use, the other is empty
+const maxExtents = 64
+
+// How many blocks Readi fetches at once
+const maxRun = 32
+
+type Extent struct {
+	Block uint // The file's block it starts at
+	Start uint // Where that block is on disk
+	Len   uint
+}
+
+func (i *Inode) blockMapped() bool {
+	return len(i.Addrs) > 0
+}
+
+// The address of direct block bn, or a hole
+func (i *Inode) direct(bn uint) uint {
+	if i.blockMapped() {
+		if bn < uint(len(i.Addrs)) {
+			return i.Addrs[bn]
+		}
+		return hole
+	}
+	for _, e := range i.Extents {
+		if bn >= e.Block && bn < e.Block+e.Len {
+			return e.Start + bn - e.Block
+		}
+	}
+	return hole
+}
+
+// Every direct block's address, up to the last one
+// that isn't a hole
+func (i *Inode) directMap() []uint {
+	if i.blockMapped() {
+		return append([]uint{}, i.Addrs...)
+	}
+	res := []uint{}
+	for _, e := range i.Extents {
+		for uint(len(res)) < e.Block {
+			res = append(res, hole)
+		}
+		for k := uint(0); k < e.Len; k++ {
+			res = append(res, e.Start+k)
+		}
+	}
+	return res
+}
+
+// Maps the direct blocks as addrs says, in
+// extents if they fit
+func (i *Inode) setDirectMap(addrs []uint) {
+	for len(addrs) > 0 && addrs[len(addrs)-1] == hole {
+		addrs = addrs[:len(addrs)-1]
+	}
+
+	exts := []Extent{}
+	for bn, addr := range addrs {
+		if addr == hole {
+			continue
+		} else if n := len(exts); n > 0 && exts[n-1].Block+exts[n-1].Len == uint(bn) &&
+			exts[n-1].Start+exts[n-1].Len == addr {
+			exts[n-1].Len++
+			continue
+		}
+		exts = append(exts, Extent{Block: uint(bn), Start: addr, Len: 1})
+	}
+
+	if len(exts) > maxExtents {
+		i.Addrs = addrs
+		i.Extents = nil
+	} else {
+		i.Addrs = nil
+		i.Extents = exts
+	}
+}
+
+func (i *Inode) setDirect(bn uint, addr uint) {
+	addrs := i.directMap()
+	for uint(len(addrs)) <= bn {
+		addrs = append(addrs, hole)
+	}
+	addrs[bn] = addr
+	i.setDirectMap(addrs)
+}
+
+// Drops direct blocks from keep on,
+// and returns what was dropped
+func (i *Inode) dropDirect(keep uint) []uint {
+	addrs := i.directMap()
+	if keep >= uint(len(addrs)) {
+		return []uint{}
+	}
+	res := allocated(addrs[keep:])
+	i.setDirectMap(addrs[:keep])
+	return res
+}
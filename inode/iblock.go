@@ -8,6 +8,7 @@ import (
 	"pp2/balloc"
 	"pp2/bio"
 	"pp2/jrnl"
+	"strings"
 )
 
 // Pain
@@ -15,48 +16,195 @@ func saneCeil(a uint, b uint) uint {
 	return uint(math.Ceil(float64(a) / float64(b)))
 }
 
+// Files can have holes: an address of 0 stands for a
+// block nobody has written, which reads as zeroes and
+// takes up no space. Block 0 is the journal's, so it's
+// never a data block. Blocks can also be shorter than
+// 4096 bytes, and whatever's missing off the end of
+// one reads as zeroes too, up to Filesize
+const hole = 0
+
 // Increases filesize to ns
 // Fails if ns <= i.Filesize, errors if
 // filesize will exceed dataBlks
-// Burns the allocblocks call
+// New blocks start out as holes, so this
+// doesn't call into balloc
 // Enqueues inode changes for writing
 func (i *Inode) increaseSize(t *jrnl.TxnHandle, ns uint) error {
 	fmt.Printf("Increasing size of inode w/ serial num %d\n", i.Serialnum)
 	if i.Filesize >= ns {
 		log.Fatal("unneeded alloc")
-	} else if saneCeil(ns, 4096) > nDirectBlocks {
+	} else if saneCeil(ns, 4096) > maxBlocks {
 		return errors.New("file would be too large")
 	}
 
-	currentBlocks := saneCeil(i.Filesize, 4096)
-	newBlocks := saneCeil(ns, 4096)
-	addedBlocks := newBlocks - currentBlocks
+	i.Filesize = ns
+	return i.EnqWrite(t)
+}
 
-	if addedBlocks > 0 {
-		fmt.Printf("c: %d vs. n: %d vs. a: %d\n", currentBlocks, newBlocks, addedBlocks)
-		fmt.Printf("Old iaddrs length: %d\n", len(i.Addrs))
-		blnl := balloc.AllocBlocks(t, addedBlocks)
-		i.Addrs = append(i.Addrs, blnl...)
+// Gives every hole among blocks first through last
+// a block from balloc, along with any pointer blocks
+// they need, charging the inode's quotas for all of
+// them. Returns which blocks are new, since whatever
+// they held before is garbage
+// Enqueues inode and pointer block changes for writing
+func (i *Inode) fillHoles(pc *ptrCache, first uint, last uint) (map[uint]bool, error) {
+	fresh := make(map[uint]bool)
+	holes := []uint{}
+	for j := first; j <= last; j++ {
+		if i.bmap(pc, j) == hole {
+			fresh[j] = true
+			holes = append(holes, j)
+		}
+	}
+	if len(holes) == 0 {
+		return fresh, nil
+	}
+	n := len(holes) + i.ptrsNeeded(pc, holes)
+	if err := i.Charge(pc.t, n, 0); err != nil {
+		return nil, err
+	}
+	i.keepCount(pc.t)
+
+	// Data blocks go in a run, after the block
+	// before the first hole if there's one
+	goal := uint(0)
+	if holes[0] > 0 {
+		if prev := i.bmap(pc, holes[0]-1); prev != hole {
+			goal = prev + 1
+		}
+	}
+	data := balloc.AllocRun(pc.t, uint(len(holes)), goal)
+	ptrs := []uint{}
+	if n > len(holes) {
+		ptrs = balloc.AllocBlocks(pc.t, uint(n-len(holes)))
+	}
+	for k, j := range holes {
+		i.setBmap(pc, j, data[k], &ptrs)
+	}
+	i.Blocks += uint(n)
+	if err := pc.flush(); err != nil {
+		return nil, err
+	}
+	return fresh, i.EnqWrite(pc.t)
+}
+
+// The blocks in addrs that aren't holes
+func allocated(addrs []uint) []uint {
+	res := []uint{}
+	for _, bn := range addrs {
+		if bn != hole {
+			res = append(res, bn)
+		}
+	}
+	return res
+}
+
+// How many blocks the file takes up,
+// pointer blocks included
+func (i *Inode) NBlocks() uint {
+	if !i.HasBlocks {
+		return i.CountBlocks(nil)
+	}
+	return i.Blocks
+}
+
+// NBlocks the slow way, by walking the block map
+// through t, if it isn't nil. For fsck, which can't
+// take the kept count on trust
+func (i *Inode) CountBlocks(t *jrnl.TxnHandle) uint {
+	n := uint(0)
+	i.EachBlock(t, func(bn uint) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// Inodes from before Blocks get a count the first
+// time their blocks change. Call before changing them
+func (i *Inode) keepCount(t *jrnl.TxnHandle) {
+	if !i.HasBlocks {
+		i.Blocks = i.CountBlocks(t)
+		i.HasBlocks = true
 	}
-	i.Filesize = ns
-	i.EnqWrite(t)
-	fmt.Printf("New i.Addrs length enqueued: %d\n", len(i.Addrs))
-	return nil
 }
 
 // Decreases filesize to zero
-// Burns the call into balloc since it frees everything
+// Frees everything through balloc
 // Enqueues inode changes for writing
 // Does not fail
-func (i *Inode) truncate(t *jrnl.TxnHandle) {
+func (i *Inode) Truncate(t *jrnl.TxnHandle) {
 	fmt.Printf("Truncating inode w/ serial num %d\n", i.Serialnum)
 	// Free every single block
-	balloc.RelseBlocks(t, i.Addrs)
-	i.Addrs = []uint{}
+	pc := newPtrCache(t)
+	i.keepCount(t)
+	if bns := i.dropFrom(pc, 0); len(bns) > 0 {
+		balloc.RelseBlocks(t, bns)
+		i.Charge(t, -len(bns), 0)
+		i.Blocks -= uint(len(bns))
+	}
+	i.Inline = ""
 	i.Filesize = 0
 	i.EnqWrite(t)
 }
 
+// Sets filesize to ns
+// Shrinking frees the tail blocks, and pointer blocks
+// left empty, through balloc and trims the new last
+// block; growing leaves a hole
+// Enqueues inode changes for writing
+func (i *Inode) Resize(t *jrnl.TxnHandle, ns uint) error {
+	fmt.Printf("Resizing inode w/ serial num %d to %d\n", i.Serialnum, ns)
+	if ns == i.Filesize {
+		return nil
+	} else if ns > i.Filesize && ns > maxInline {
+		if err := i.unInline(t); err != nil {
+			return err
+		}
+		return i.increaseSize(t, ns)
+	} else if ns > i.Filesize {
+		return i.increaseSize(t, ns)
+	} else if i.isInline() {
+		if uint(len(i.Inline)) > ns {
+			i.Inline = i.Inline[:ns]
+		}
+		i.Filesize = ns
+		return i.EnqWrite(t)
+	}
+
+	keep := saneCeil(ns, 4096)
+	pc := newPtrCache(t)
+	i.keepCount(t)
+	if bns := i.dropFrom(pc, keep); len(bns) > 0 {
+		balloc.RelseBlocks(t, bns)
+		i.Blocks -= uint(len(bns))
+		if err := i.Charge(t, -len(bns), 0); err != nil {
+			return err
+		}
+	}
+	if err := pc.flush(); err != nil {
+		return err
+	}
+
+	// The old data past the end has to go, or
+	// growing again would bring it back
+	if bo := ns % 4096; bo > 0 && i.bmap(pc, keep-1) != hole {
+		blk := t.ReadBlock(i.bmap(pc, keep-1))
+		if uint(len(blk.Data)) > bo {
+			blk.Data = blk.Data[:bo]
+			if err := t.WriteBlock(blk); err != nil {
+				blk.Brelse()
+				return err
+			}
+		}
+		blk.Brelse()
+	}
+
+	i.Filesize = ns
+	return i.EnqWrite(t)
+}
+
 // Reads a certain count of data from a certain
 // offset within an inode.
 // Doesn't burn any balloc calls, makes no inode changes
@@ -67,63 +215,93 @@ func Readi(inum uint16, offset uint, count uint) string {
 	// Panics if this fails
 	i := Geti(inum)
 	defer i.Relse()
-	res := ""
+	return i.Read(offset, count)
+}
 
-	fmt.Printf("Reading %d bytes from inode w/ serial num %d\n", count, i.Serialnum)
+// Readi for an inode you already hold, e.g.
+// a directory you want to keep locked between
+// reading and writing it
+func (i *Inode) Read(offset uint, count uint) string {
+	return i.ReadIn(nil, offset, count)
+}
 
-	// Setup the first block
-	bn := offset / 4096
-	bo := offset % 4096
+// Read, but through t if it isn't nil, so that
+// blocks written earlier in t read back as written
+func (i *Inode) ReadIn(t *jrnl.TxnHandle, offset uint, count uint) string {
+	pc := newPtrCache(t)
 
-	// Check that the first block exists
-	if bn >= uint(len(i.Addrs)) {
-		fmt.Printf("Note: bn > len(i.Addrs)\n")
+	fmt.Printf("Reading %d bytes from inode w/ serial num %d\n", count, i.Serialnum)
+	if offset >= i.Filesize {
 		return ""
+	} else if count > i.Filesize-offset {
+		count = i.Filesize - offset
+	}
+	if i.isInline() {
+		return i.readInline(offset, count)
 	}
 
-	for j := bn; count > 0; j++ {
-		blk := bio.Bget(i.Addrs[j])
-		data := blk.Data
-		fmt.Printf("Block data: %s\n", data)
+	res := make([]byte, 0, count)
+	for count > 0 {
+		first := offset / 4096
+		last := (offset + count - 1) / 4096
+		if last-first >= maxRun {
+			last = first + maxRun - 1
+		}
+		run := i.readRun(pc, first, last)
 
-		// First iteration only: block offset check
-		if bo > 0 {
-			// If the block offset is off the end, fail
-			if bo >= uint(len(data)) {
-				blk.Brelse()
-				return res
+		for _, data := range run {
+			bo := offset % 4096
+			toread := 4096 - bo
+			if count < toread {
+				toread = count
 			}
-			data = data[bo:]
-			bo = 0
-		}
 
-		// Deduct from count
-		toread := uint(len(data))
-		if count < toread {
-			toread = count
-		}
-		count -= toread
-		fmt.Printf("count: %d\n", count)
+			// Holes, and anything past the end
+			// of a short block, are zeroes
+			chunk := make([]byte, toread)
+			if bo < uint(len(data)) {
+				copy(chunk, data[bo:])
+			}
 
-		// Read the data
-		rb := []byte(res)
-		rb = append(rb, []byte(data[:toread])...)
-		res = string(rb)
+			res = append(res, chunk...)
+			offset += toread
+			count -= toread
+		}
+	}
+	return string(res)
+}
 
-		// Get the next block. If there isn't one,
-		// return as we are
-		blk.Brelse()
-		if j == uint(len(i.Addrs))-1 {
-			return res
+// What's in blocks first through last, with "" for
+// holes. Outside a transaction they're fetched in
+// one batch
+func (i *Inode) readRun(pc *ptrCache, first uint, last uint) []string {
+	res := make([]string, last-first+1)
+	addrs, idxs := []uint{}, []uint{}
+	for bn := first; bn <= last; bn++ {
+		if addr := i.bmap(pc, bn); addr != hole {
+			addrs = append(addrs, addr)
+			idxs = append(idxs, bn-first)
 		}
 	}
 
+	if pc.t == nil {
+		for k, data := range bio.Bread(addrs) {
+			res[idxs[k]] = data
+		}
+		return res
+	}
+	for k, addr := range addrs {
+		blk := pc.t.ReadBlock(addr)
+		res[idxs[k]] = blk.Data
+		blk.Brelse()
+	}
 	return res
 }
 
 // The same as readi, with a few exceptions:
-// - writes that start at or cross the end of
-// the file grow the file, up to the maximum file siz
+// - writes that start at or past the end of the
+// file grow the file, up to the maximum file size,
+// leaving a hole between the old end and the write
 // - loop copies data into buffers obviously, then buffers are enqueued
 // into log (BUT NOT WRITTEN THROUGH!!)
 func Writei(t *jrnl.TxnHandle, inum uint16, offset uint, data string) (uint, error) {
@@ -131,84 +309,79 @@ func Writei(t *jrnl.TxnHandle, inum uint16, offset uint, data string) (uint, err
 	// Panics if this fails
 	i := Geti(inum)
 	defer i.Relse()
+	return i.Write(t, offset, data)
+}
 
+// Writei for an inode you already hold. Data blocks
+// are read through the transaction, so writing the
+// same inode twice in one transaction works out.
+// Only the blocks the write lands in get allocated,
+// and none at all while the file stays small enough
+// to be inline
+func (i *Inode) Write(t *jrnl.TxnHandle, offset uint, data string) (uint, error) {
 	fmt.Printf("Writing inode w/ serial num %d\n", i.Serialnum)
-	// Setup the first block
-	bn := offset / 4096
-	bo := offset % 4096
-
-	// Check that the first block exists
-	// == is ok if the last block takes up all 4096 bytes or whatever
-	fmt.Printf("bn: %d, bo: %d\n", bn, bo)
-	if bn >= nDirectBlocks {
+	tb := uint(len(data))
+	if offset/4096 >= maxBlocks {
 		return 0, errors.New("maximum valid blocks exceeded")
-	} else if offset > i.Filesize && (offset != 0 && i.Filesize != 0) {
-		return 0, errors.New("tried to append past the end of the file")
+	} else if offset+tb > maxBlocks*bio.BlockSize {
+		return 0, errors.New("that write too big")
+	} else if tb == 0 {
+		return 0, nil
 	}
 
-	totalbytes := uint(len([]byte(data)))
-	tb := totalbytes
-
-	if offset+tb > nDirectBlocks*bio.BlockSize {
-		return 0, errors.New("that write too big")
+	if i.isInline() && offset+tb <= maxInline {
+		return tb, i.writeInline(t, offset, data)
 	}
 	if offset+tb > i.Filesize {
-		i.increaseSize(t, offset+tb)
+		if err := i.increaseSize(t, offset+tb); err != nil {
+			return 0, err
+		}
 	}
+	if err := i.unInline(t); err != nil {
+		return 0, err
+	}
+	return tb, i.writeBlocks(t, offset, data)
+}
 
-	for j := bn; totalbytes > 0; j++ {
-		blk := bio.Bget(i.Addrs[j])
-		bdata := blk.Data
-
-		// If the block offset is > 0, regardless of data's length...
-		// Leave bdata up to bo standing, trim data appropriately
-		if bo > 0 {
-			// We've already checked that the offset doesn't
-			// go over the end of the file. Therefore, bdata[:bo]
-			// will work out no matter what
-			// If len(data) <= 4096 - bo, write all of data (CHECKME)
-			// Otherwise, write data[:4096-bo]
-			if totalbytes > 4096-bo {
-				bdata = bdata[:bo] + data[:4096-bo]
-				data = data[4096-bo:]
-				totalbytes -= (4096 - bo)
-			} else {
-				if uint(len(bdata)) <= bo+uint(len(data)) {
-					bdata = bdata[:bo] + data
-				} else {
-					bdata = bdata[:bo] + data + bdata[uint(len(data))+bo:]
-				}
-				totalbytes = 0
-				// Will break, don't change data
-			}
+// Write, to the file's blocks
+func (i *Inode) writeBlocks(t *jrnl.TxnHandle, offset uint, data string) error {
+	tb := uint(len(data))
+	pc := newPtrCache(t)
+	fresh, err := i.fillHoles(pc, offset/4096, (offset+tb-1)/4096)
+	if err != nil {
+		return err
+	}
 
-			// Reset the block offset
-			bo = 0
-
-		} else if totalbytes < 4096 {
-			// We are towards the end of the data. Write what's left
-			// of data (data[:totalbytes]) and leave bdata[totalbytes:]
-			// if the bdata is long enough
-			if len(bdata) > int(totalbytes) {
-				bdata = data[:totalbytes] + bdata[totalbytes:]
-			} else {
-				bdata = data[:totalbytes]
-			}
+	for len(data) > 0 {
+		bn := offset / 4096
+		bo := offset % 4096
+		n := 4096 - bo
+		if uint(len(data)) < n {
+			n = uint(len(data))
+		}
 
-			// Cause the break, don't touch data cuz we don't need to
-			totalbytes = 0
-		} else {
-			// We are not towards the end of the data. Overwrite the block
-			// and trim the data
-			bdata = data[:4096]
-			totalbytes -= 4096
-			data = data[4096:]
+		blk := t.ReadBlock(i.bmap(pc, bn))
+		bdata := blk.Data
+		if fresh[bn] {
+			bdata = ""
+		}
+		if uint(len(bdata)) < bo {
+			bdata += strings.Repeat("\x00", int(bo)-len(bdata))
+		}
+		rest := ""
+		if uint(len(bdata)) > bo+n {
+			rest = bdata[bo+n:]
 		}
 
-		blk.Data = bdata
-		t.WriteBlock(blk)
+		blk.Data = bdata[:bo] + data[:n] + rest
+		if err := t.WriteBlock(blk); err != nil {
+			blk.Brelse()
+			return err
+		}
 		blk.Brelse()
-	}
 
-	return tb, nil
+		data = data[n:]
+		offset += n
+	}
+	return nil
 }
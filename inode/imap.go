@@ -0,0 +1,141 @@
+package inode
+
+import (
+	"fmt"
+	"pp2/bio"
+	"pp2/jrnl"
+)
+
+// The inode map: one bit per inode, set if it's in
+// use, so Alloci can find a free one in a block fetch
+// or two instead of trying every inode. It sits in
+// the spare block just past the inodes and goes
+// through the journal like the balloc bitmap. Alloci
+// still checks the inode it picks, so a map that's
+// behind (say, from a client that predates it) costs
+// a retry, never a clobbered inode. Volumes from before
+// the map get one built the first time they allocate
+const imapBlock = firstInodeAddr + numInodes
+
+// Marks a block as holding a map, so an old
+// volume's empty block isn't taken for all free
+const imapMagic = 'M'
+
+type imap []byte
+
+func (m imap) used(inum uint16) bool {
+	return m[1+inum/8]&(1<<(inum%8)) != 0
+}
+
+func (m imap) mark(inum uint16, used bool) {
+	if used {
+		m[1+inum/8] |= 1 << (inum % 8)
+	} else {
+		m[1+inum/8] &^= 1 << (inum % 8)
+	}
+}
+
+// The first free inode not in held
+func (m imap) firstFree(held map[uint16]bool) (uint16, bool) {
+	for inum := 0; inum < numInodes; inum++ {
+		if !m.used(uint16(inum)) && !held[uint16(inum)] {
+			return uint16(inum), true
+		}
+	}
+	return 0, false
+}
+
+func newImap() imap {
+	m := make(imap, 1+numInodes/8)
+	m[0] = imapMagic
+	return m
+}
+
+func isImap(data string) bool {
+	return len(data) == 1+numInodes/8 && data[0] == imapMagic
+}
+
+// Reads the map through t. The caller has
+// to let go of it with putImap
+func getImap(t *jrnl.TxnHandle, held map[uint16]bool) imap {
+	blk := t.ReadBlock(imapBlock)
+	if isImap(blk.Data) {
+		return imap(blk.Data)
+	}
+	return buildImap(t, held)
+}
+
+func putImap(t *jrnl.TxnHandle, m imap) error {
+	blk := &bio.Block{
+		Nr:   imapBlock,
+		Data: string(m),
+	}
+	err := t.WriteBlock(blk)
+	blk.Brelse()
+	return err
+}
+
+// Probes every inode, the old way, to make a map
+// for a volume without one. Inodes in held are in
+// use, or the caller wouldn't be holding them. A
+// volume with no root yet has nothing to probe
+func buildImap(t *jrnl.TxnHandle, held map[uint16]bool) imap {
+	m := newImap()
+	for inum := 0; inum < numInodes; inum++ {
+		if held[uint16(inum)] {
+			m.mark(uint16(inum), true)
+			continue
+		}
+		blk := t.ReadBlock(firstInodeAddr + uint(inum))
+		data := blk.Data
+		blk.Brelse()
+		if inum == RootInum && data == "" {
+			break
+		}
+		m.mark(uint16(inum), data != "" && IDecode(data).Refcnt > 0)
+	}
+	fmt.Printf("Built the inode map\n")
+	return m
+}
+
+// Clears inum's bit once it's free. Without a map
+// there's nothing to do; building one here could
+// wait on inodes the caller holds
+func unmapi(t *jrnl.TxnHandle, inum uint16) error {
+	blk := t.ReadBlock(imapBlock)
+	if !isImap(blk.Data) {
+		blk.Brelse()
+		return nil
+	}
+	m := imap(blk.Data)
+	m.mark(inum, false)
+	return putImap(t, m)
+}
+
+// For fsck: whether the map has each inode in
+// use, or nil if the volume doesn't have a map yet
+func SnapshotMap() []bool {
+	blk := bio.Bget(imapBlock)
+	defer blk.Brelse()
+	if !isImap(blk.Data) {
+		return nil
+	}
+
+	res := make([]bool, numInodes)
+	for inum := range res {
+		res[inum] = imap(blk.Data).used(uint16(inum))
+	}
+	return res
+}
+
+// For fsck: marks inums used or free in the map
+func MarkMap(t *jrnl.TxnHandle, inums []uint16, used bool) {
+retry:
+	m := getImap(t, nil)
+	for _, inum := range inums {
+		m.mark(inum, used)
+	}
+	if err := putImap(t, m); err != nil {
+		goto retry
+	}
+}
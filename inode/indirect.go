@@ -0,0 +1,316 @@
+package inode
+
+import (
+	"encoding/binary"
+	"pp2/bio"
+	"pp2/jrnl"
+)
+
+// Past the direct blocks (see extent.go), a file's
+// blocks are found through pointer blocks: Indirect holds the
+// addresses of the next nIndirect blocks, and DIndirect
+// the addresses of up to nIndirect more pointer blocks
+// holding the rest. Addresses are 4 bytes, little endian.
+// Like data blocks, a pointer block that isn't there
+// (or is short) is all holes, and only gets allocated
+// once something under it is written. That's offsets
+// of up to about 4 GiB, but the whole volume only has
+// the balloc bitmap's 4096 data blocks, 16 MiB, so only
+// sparse files get anywhere near the end
+const nIndirect = bio.BlockSize / 4
+const maxBlocks = nDirectBlocks + nIndirect + nIndirect*nIndirect
+
+func parsePtrs(data string) []uint {
+	res := make([]uint, nIndirect)
+	for k := 0; k < nIndirect && 4*k+4 <= len(data); k++ {
+		res[k] = uint(binary.LittleEndian.Uint32([]byte(data[4*k : 4*k+4])))
+	}
+	return res
+}
+
+func flattenPtrs(ptrs []uint) string {
+	buf := make([]byte, 4*len(ptrs))
+	for k, p := range ptrs {
+		binary.LittleEndian.PutUint32(buf[4*k:], uint32(p))
+	}
+	return string(buf)
+}
+
+// The pointer blocks one operation reads or
+// changes, so each is read and logged once
+type ptrCache struct {
+	t     *jrnl.TxnHandle // Can be nil when only reading
+	ptrs  map[uint][]uint
+	dirty map[uint]bool
+}
+
+func newPtrCache(t *jrnl.TxnHandle) *ptrCache {
+	return &ptrCache{
+		t:     t,
+		ptrs:  make(map[uint][]uint),
+		dirty: make(map[uint]bool),
+	}
+}
+
+func (pc *ptrCache) get(bn uint) []uint {
+	if ptrs, ok := pc.ptrs[bn]; ok {
+		return ptrs
+	}
+	var blk *bio.Block
+	if pc.t != nil {
+		blk = pc.t.ReadBlock(bn)
+	} else {
+		blk = bio.Bget(bn)
+	}
+	pc.ptrs[bn] = parsePtrs(blk.Data)
+	blk.Brelse()
+	return pc.ptrs[bn]
+}
+
+func (pc *ptrCache) set(bn uint, idx uint, addr uint) {
+	pc.get(bn)[idx] = addr
+	pc.dirty[bn] = true
+}
+
+// Starts a new pointer block at bn, taken from
+// pool. Whatever was in it before is garbage
+func (pc *ptrCache) take(pool *[]uint) uint {
+	bn := (*pool)[0]
+	*pool = (*pool)[1:]
+	pc.ptrs[bn] = make([]uint, nIndirect)
+	pc.dirty[bn] = true
+	return bn
+}
+
+// Drops bn without writing it, it's being freed
+func (pc *ptrCache) forget(bn uint) {
+	delete(pc.ptrs, bn)
+	delete(pc.dirty, bn)
+}
+
+// Logs every changed pointer block
+func (pc *ptrCache) flush() error {
+	for bn := range pc.dirty {
+		blk := pc.t.ReadBlock(bn)
+		blk.Data = flattenPtrs(pc.ptrs[bn])
+		err := pc.t.WriteBlock(blk)
+		blk.Brelse()
+		if err != nil {
+			return err
+		}
+		delete(pc.dirty, bn)
+	}
+	return nil
+}
+
+// Where the address of block bn is kept: direct block
+// idx if ptr is a hole, or entry idx of pointer block ptr.
+// Missing pointer blocks come out of pool, or with a
+// nil pool, ok is false and bn is a hole
+func (i *Inode) slot(pc *ptrCache, bn uint, pool *[]uint) (ptr uint, idx uint, ok bool) {
+	if bn < nDirectBlocks {
+		return hole, bn, true
+	}
+
+	bn -= nDirectBlocks
+	if bn < nIndirect {
+		if i.Indirect == hole && pool == nil {
+			return hole, 0, false
+		} else if i.Indirect == hole {
+			i.Indirect = pc.take(pool)
+		}
+		return i.Indirect, bn, true
+	}
+
+	bn -= nIndirect
+	if i.DIndirect == hole && pool == nil {
+		return hole, 0, false
+	} else if i.DIndirect == hole {
+		i.DIndirect = pc.take(pool)
+	}
+	mid := pc.get(i.DIndirect)[bn/nIndirect]
+	if mid == hole && pool == nil {
+		return hole, 0, false
+	} else if mid == hole {
+		mid = pc.take(pool)
+		pc.set(i.DIndirect, bn/nIndirect, mid)
+	}
+	return mid, bn % nIndirect, true
+}
+
+// The address of block bn, or a hole
+func (i *Inode) bmap(pc *ptrCache, bn uint) uint {
+	ptr, idx, ok := i.slot(pc, bn, nil)
+	if !ok {
+		return hole
+	} else if ptr != hole {
+		return pc.get(ptr)[idx]
+	}
+	return i.direct(idx)
+}
+
+// Points block bn at addr, making any pointer
+// blocks on the way out of pool
+func (i *Inode) setBmap(pc *ptrCache, bn uint, addr uint, pool *[]uint) {
+	ptr, idx, _ := i.slot(pc, bn, pool)
+	if ptr != hole {
+		pc.set(ptr, idx, addr)
+		return
+	}
+	i.setDirect(idx, addr)
+}
+
+// How many pointer blocks setBmap would
+// have to make to reach every block in bns
+func (i *Inode) ptrsNeeded(pc *ptrCache, bns []uint) int {
+	const ind, dind = -1, -2
+	need := make(map[int]bool)
+	for _, bn := range bns {
+		if bn < nDirectBlocks {
+			continue
+		}
+		bn -= nDirectBlocks
+		if bn < nIndirect {
+			if i.Indirect == hole {
+				need[ind] = true
+			}
+			continue
+		}
+
+		bn -= nIndirect
+		if i.DIndirect == hole {
+			need[dind] = true
+			need[int(bn/nIndirect)] = true
+		} else if pc.get(i.DIndirect)[bn/nIndirect] == hole {
+			need[int(bn/nIndirect)] = true
+		}
+	}
+	return len(need)
+}
+
+// Frees nothing itself: drops every block from keep
+// on out of the inode, pointer blocks left with nothing
+// in them included, and returns what was dropped
+func (i *Inode) dropFrom(pc *ptrCache, keep uint) []uint {
+	res := i.dropDirect(keep)
+
+	// Everything past keep in a pointer block, and the
+	// block itself if that's all of it
+	dropPtrs := func(ptr uint, first uint, from uint) bool {
+		if from <= first {
+			res = append(res, allocated(pc.get(ptr))...)
+			res = append(res, ptr)
+			pc.forget(ptr)
+			return true
+		}
+		ptrs := pc.get(ptr)
+		for k := from - first; k < nIndirect; k++ {
+			if ptrs[k] != hole {
+				res = append(res, ptrs[k])
+				pc.set(ptr, k, hole)
+			}
+		}
+		return false
+	}
+
+	first := uint(nDirectBlocks)
+	if i.Indirect != hole && dropPtrs(i.Indirect, first, keep) {
+		i.Indirect = hole
+	}
+
+	first += nIndirect
+	if i.DIndirect == hole {
+		return res
+	}
+	top := pc.get(i.DIndirect)
+	for k := uint(0); k < nIndirect; k++ {
+		start := first + k*nIndirect
+		if top[k] == hole || keep >= start+nIndirect {
+			continue
+		}
+		if dropPtrs(top[k], start, keep) {
+			pc.set(i.DIndirect, k, hole)
+		}
+	}
+	if keep <= first {
+		res = append(res, i.DIndirect)
+		pc.forget(i.DIndirect)
+		i.DIndirect = hole
+	}
+	return res
+}
+
+// Calls fn on every block i has, pointer blocks
+// included, each pointer block before what's in it.
+// If fn returns false for a pointer block, what's in
+// it is skipped. Reads through t if it isn't nil
+func (i *Inode) EachBlock(t *jrnl.TxnHandle, fn func(bn uint) bool) {
+	pc := newPtrCache(t)
+	for _, bn := range allocated(i.directMap()) {
+		fn(bn)
+	}
+	if i.Indirect != hole && fn(i.Indirect) {
+		for _, bn := range allocated(pc.get(i.Indirect)) {
+			fn(bn)
+		}
+	}
+	if i.DIndirect != hole && fn(i.DIndirect) {
+		for _, mid := range allocated(pc.get(i.DIndirect)) {
+			if fn(mid) {
+				for _, bn := range allocated(pc.get(mid)) {
+					fn(bn)
+				}
+			}
+		}
+	}
+}
+
+// Replaces each block address in i, pointer blocks
+// included, with what fn returns for it. A pointer
+// block is replaced before what's in it is, and if fn
+// turns it into a hole, everything under it goes too.
+// Nothing is freed or allocated here; that's for fn
+// and the caller, e.g. fsck's repairs. The block count
+// is redone from what's left, so fsck can fix it this way.
+// Enqueues inode and pointer block changes for writing
+func (i *Inode) Remap(t *jrnl.TxnHandle, fn func(bn uint) uint) error {
+	pc := newPtrCache(t)
+	remapPtrs := func(ptr uint) {
+		ptrs := pc.get(ptr)
+		for k, bn := range ptrs {
+			if bn != hole {
+				if nb := fn(bn); nb != bn {
+					pc.set(ptr, uint(k), nb)
+				}
+			}
+		}
+	}
+
+	addrs := i.directMap()
+	for k, bn := range addrs {
+		if bn != hole {
+			addrs[k] = fn(bn)
+		}
+	}
+	i.setDirectMap(addrs)
+	if i.Indirect != hole {
+		if i.Indirect = fn(i.Indirect); i.Indirect != hole {
+			remapPtrs(i.Indirect)
+		}
+	}
+	if i.DIndirect != hole {
+		if i.DIndirect = fn(i.DIndirect); i.DIndirect != hole {
+			remapPtrs(i.DIndirect)
+			for _, mid := range allocated(pc.get(i.DIndirect)) {
+				remapPtrs(mid)
+			}
+		}
+	}
+
+	if err := pc.flush(); err != nil {
+		return err
+	}
+	i.Blocks = i.CountBlocks(t)
+	i.HasBlocks = true
+	return i.EnqWrite(t)
+}
@@ -0,0 +1,61 @@
+package inode
+
+import (
+	"pp2/jrnl"
+	"strings"
+)
+
+// Small files keep their data in Inline, in the inode
+// record itself, and have no blocks at all: they cost
+// no balloc calls and no quota blocks, and read in the
+// one fetch that gets the inode. Like a short block,
+// whatever's missing off the end of Inline reads as
+// zeroes, up to Filesize. A file is inline while it has
+// no blocks and is at most maxInline bytes; the first
+// write or resize that takes it past that moves what's
+// in Inline out to block 0 and goes on as usual
+const maxInline = 2048
+
+func (i *Inode) isInline() bool {
+	return i.Filesize <= maxInline && len(i.Extents) == 0 &&
+		len(i.Addrs) == 0 && i.Indirect == hole && i.DIndirect == hole
+}
+
+func (i *Inode) readInline(offset uint, count uint) string {
+	data := i.Inline
+	if uint(len(data)) < offset+count {
+		data += strings.Repeat("\x00", int(offset+count)-len(data))
+	}
+	return data[offset : offset+count]
+}
+
+// Splices data into Inline at offset, growing
+// the file if it ends past Filesize
+// Enqueues inode changes for writing
+func (i *Inode) writeInline(t *jrnl.TxnHandle, offset uint, data string) error {
+	old := i.Inline
+	if uint(len(old)) < offset {
+		old += strings.Repeat("\x00", int(offset)-len(old))
+	}
+	rest := ""
+	if end := offset + uint(len(data)); uint(len(old)) > end {
+		rest = old[end:]
+	}
+	i.Inline = old[:offset] + data + rest
+	if end := offset + uint(len(data)); end > i.Filesize {
+		i.Filesize = end
+	}
+	return i.EnqWrite(t)
+}
+
+// Moves Inline out to block 0, before the
+// file stops being small enough for it
+// Enqueues inode and block changes for writing
+func (i *Inode) unInline(t *jrnl.TxnHandle) error {
+	if i.Inline == "" {
+		return nil
+	}
+	data := i.Inline
+	i.Inline = ""
+	return i.writeBlocks(t, 0, data)
+}
@@ -7,11 +7,14 @@ import (
 	"pp2/bio"
 	"pp2/jrnl"
 	"pp2/labgob"
+	"pp2/quota"
+	"time"
 )
 
 const nDirectBlocks = 511
 const firstInodeAddr = jrnl.EndJrnl + 2
 const numInodes = 16384
+const NumInodes = numInodes
 const RootInum = 0
 
 const EndInode = firstInodeAddr + numInodes + 1
@@ -21,71 +24,180 @@ type IType byte
 const (
 	Dir IType = iota
 	File
+	Symlink // Data is the target path
 )
 
+func (m IType) String() string {
+	switch m {
+	case Dir:
+		return "dir"
+	case File:
+		return "file"
+	case Symlink:
+		return "symlink"
+	}
+	return "unknown"
+}
+
 type Inode struct {
 	Serialnum uint16
+	Gen       uint32 // Bumped each time Serialnum is reused
 	Refcnt    uint16
 	Filesize  uint
-	Addrs     []uint
+	Inline    string   // The whole file, while it's small, see inline.go
+	Extents   []Extent // The first nDirectBlocks blocks, see extent.go
+	Addrs     []uint   // Them again, if there'd be too many extents
+	Indirect  uint     // See indirect.go
+	DIndirect uint
 	Mode      IType
-	// timestamp Time
+	Atime     int64 // All unix nanoseconds
+	Mtime     int64
+	Ctime     int64
+	Xattrs    map[string]string // See xattr.go
+	Uid       uint32
+	Gid       uint32
+	Perm      uint16 // rwxrwxrwx, see Perms
+	HasPerm   bool   // Unset on inodes from before permissions
+	Tree      uint16 // The quota tree it was made in, 0 for none
+	Blocks    uint   // What NBlocks returns, kept so Stat needn't walk the map
+	HasBlocks bool   // Unset on inodes from before Blocks
+}
+
+// Who gets charged for the inode and its blocks
+func (i *Inode) quotaKeys() []string {
+	keys := []string{quota.UserKey(i.Uid)}
+	if i.Tree != 0 {
+		keys = append(keys, quota.TreeKey(i.Tree))
+	}
+	return keys
+}
+
+// Charges the inode's owner and tree for blocks and
+// inodes more of it, or credits them if negative.
+// Fails with quota.ErrQuota if that's over a limit
+func (i *Inode) Charge(t *jrnl.TxnHandle, blocks int, inodes int) error {
+	return quota.Charge(t, i.quotaKeys(), blocks, inodes)
+}
+
+// The permission bits. Inodes written before
+// there were any are open to everyone
+func (i *Inode) Perms() uint16 {
+	if !i.HasPerm {
+		if i.Mode == File {
+			return 0666
+		}
+		return 0777
+	}
+	return i.Perm
+}
+
+// Sets the owner and permission bits. Enqueues the
+// inode for writing with a new Ctime, like Touch
+func (i *Inode) SetOwner(t *jrnl.TxnHandle, uid uint32, gid uint32, perm uint16) error {
+	i.Uid = uid
+	i.Gid = gid
+	i.Perm = perm & 0777
+	i.HasPerm = true
+	return i.Touch(t, CTime)
 }
 
+// Picks timestamps for Touch
+type TimeFlags byte
+
+const (
+	ATime TimeFlags = 1 << iota
+	MTime
+	CTime
+)
+
 // Always succeeds, might take awhile
 func Alloci(t *jrnl.TxnHandle, mode IType) *Inode {
+	return AllociExcept(t, mode, nil)
+}
+
+// Alloci, skipping over the inodes in held. It might
+// have to look at inodes the map gets wrong, so anyone
+// holding some inodes must say which, or they'll wait
+// on themselves. Like any block written in t, hold the
+// new inode until t ends: the map on disk has it free
+// until then, and only the lock keeps others off it
+func AllociExcept(t *jrnl.TxnHandle, mode IType, held map[uint16]bool) *Inode {
 retry:
-	for i := firstInodeAddr; i < firstInodeAddr+numInodes; i++ {
-		blk := bio.Bget(uint(i))
-		if blk.Data == "" {
-			ni := &Inode{
-				Serialnum: uint16(i - firstInodeAddr),
-				Refcnt:    1,
-				Addrs:     []uint{},
-				Mode:      mode,
-			}
-			if ni.EnqWrite(t) != nil {
-				goto retry
+	m := getImap(t, held)
+	for {
+		inum, ok := m.firstFree(held)
+		if !ok {
+			log.Fatal("no allocatable Inodes")
+		}
+		m.mark(inum, true)
+
+		// Read through t so that inodes allocated earlier
+		// in this same transaction don't look free
+		blk := t.ReadBlock(firstInodeAddr + uint(inum))
+		gen := uint32(0)
+		if blk.Data != "" {
+			old := IDecode(blk.Data)
+			if old.Refcnt > 0 {
+				// The map was behind
+				blk.Brelse()
+				continue
 			}
-			fmt.Printf("Acquired inode w/ serial num %d from empty\n", ni.Serialnum)
-			return ni
+			gen = old.Gen + 1
+		}
+		if err := putImap(t, m); err != nil {
+			blk.Brelse()
+			goto retry
+		}
 
+		ni := &Inode{
+			Serialnum: inum,
+			Gen:       gen,
+			Refcnt:    1,
+			Addrs:     []uint{},
+			Mode:      mode,
+			HasBlocks: true,
 		}
-		ni := IDecode(blk.Data)
-		if ni.Refcnt == 0 {
-			ni = &Inode{
-				Serialnum: uint16(i - firstInodeAddr),
-				Refcnt:    1,
-				Addrs:     []uint{},
-				Mode:      mode,
-			}
-			if ni.EnqWrite(t) != nil {
-				goto retry
-			}
-			fmt.Printf("Acquired inode w/ serial num %d from non-empty, refcnt %d\n", ni.Serialnum, ni.Refcnt)
-			return ni
+		if ni.EnqWrite(t) != nil {
+			blk.Brelse()
+			goto retry
 		}
-		blk.Brelse()
+		fmt.Printf("Acquired inode w/ serial num %d, gen %d\n", ni.Serialnum, ni.Gen)
+		return ni
 	}
-	log.Fatal("no allocatable Inodes")
-	// Never reached
-	return nil
 }
 
 // Decrement the refcount on the inode. If it
-// hits zero, further allocs might pick it up.
+// hits zero, its data blocks go back to balloc
+// and further allocs might pick it up.
 // Then, relse. The decrement may fail if blkPerSys
 // is exceeded, but this is unlikely
 func (i *Inode) Free(t *jrnl.TxnHandle) error {
+	if err := i.Unref(t); err != nil {
+		return err
+	}
+	i.Relse()
+	return nil
+}
+
+// Free, but keeps holding the inode
+func (i *Inode) Unref(t *jrnl.TxnHandle) error {
 	if i.Refcnt == 0 {
 		log.Fatal("double free")
 	}
 
 	i.Refcnt--
+	if i.Refcnt == 0 {
+		i.Truncate(t)
+		if err := i.Charge(t, 0, -1); err != nil {
+			return err
+		}
+		if err := unmapi(t, i.Serialnum); err != nil {
+			return err
+		}
+	}
 	if err := i.EnqWrite(t); err != nil {
 		return err
 	}
-	i.Relse()
 	fmt.Printf("Freed inode w/ serial num %d, refcnt %d\n", i.Serialnum, i.Refcnt)
 	return nil
 }
@@ -113,6 +225,22 @@ func Probei(inum uint16) bool {
 	return blk.Data != ""
 }
 
+// For fsck: reads inum without keeping it locked.
+// Returns nil if it was never allocated
+func Peeki(inum uint16) *Inode {
+	id := firstInodeAddr + uint(inum)
+	if id >= firstInodeAddr+numInodes {
+		log.Fatal("inode id out of range")
+	}
+
+	blk := bio.Bget(id)
+	defer blk.Brelse()
+	if blk.Data == "" {
+		return nil
+	}
+	return IDecode(blk.Data)
+}
+
 // Always succeeds
 // Panics if the inode doesn't exist
 func Geti(inum uint16) *Inode {
@@ -146,6 +274,23 @@ func (i *Inode) EnqWrite(t *jrnl.TxnHandle) error {
 	return nil
 }
 
+// Sets the timestamps picked by which to now,
+// then enqueues the inode for writing. May fail
+// like EnqWrite
+func (i *Inode) Touch(t *jrnl.TxnHandle, which TimeFlags) error {
+	now := time.Now().UnixNano()
+	if which&ATime != 0 {
+		i.Atime = now
+	}
+	if which&MTime != 0 {
+		i.Mtime = now
+	}
+	if which&CTime != 0 {
+		i.Ctime = now
+	}
+	return i.EnqWrite(t)
+}
+
 // May fail if we've lost the lock by this point
 func (i *Inode) Renew() error {
 	b := &bio.Block{
@@ -161,4 +306,5 @@ func (i *Inode) Renew() error {
 
 func InodeInit() {
 	labgob.Register(&Inode{})
+	bio.Bcache(firstInodeAddr, firstInodeAddr+numInodes)
 }
@@ -20,13 +20,37 @@ import (
 //		-> offset = 0; offset <= len(file); > end
 //		-> count = 0; count <= len(file); count > len(file)
 //	-> Writei
-//		-> offset = 0; <= len(file); > end (=FAIL)
+//		-> offset = 0; <= len(file); > end (leaves a hole)
 //		-> len(data) = 0; > 0; >maxValid (=FAIL)
 //	-> Alloci
 //		-> 1 alloc, many allocs
 //		-> previously released blocks alloced
 //	-> Freei
 //		-> 1 alloc, many allocs
+//		-> refcnt hits zero with data blocks
+//	-> Resize
+//		-> shrink mid-block, grow, to zero
+//	-> Holes
+//		-> read as zeroes, take no blocks
+//		-> filled by a later write, freed by truncate
+//		-> shrink into a hole, grow after shrinking mid-block
+//	-> Indirect blocks
+//		-> direct, indirect, double-indirect, past the max (=FAIL)
+//		-> pointer blocks counted, freed when emptied by a shrink
+//		-> write across the direct/indirect boundary
+//	-> Block count
+//		-> kept through writes, shrinks and truncates
+//		-> inode from before the count
+//	-> Extents
+//		-> one write, appended to, filling a hole between two
+//		-> too fragmented (falls back to Addrs), truncated back
+//	-> Inline data
+//		-> small write takes no blocks, leaves a hole, overwritten
+//		-> grows past maxInline by write, by resize; shrunk and grown back
+//	-> Inode map
+//		-> alloc marks, free clears and the inode is reused
+//		   with the next generation
+//		-> map behind (in-use inode marked free), no map yet
 
 func initUut() {
 	bio.Binit("", true)
@@ -52,6 +76,7 @@ func TestEmptyReadWrite(tt *testing.T) {
 		Filesize:  0,
 		Addrs:     []uint{},
 		Mode:      File,
+		HasBlocks: true,
 	}
 
 	if !cmp.Equal(expect, *i) {
@@ -93,6 +118,7 @@ func TestBasicReadWrite(tt *testing.T) {
 		Filesize:  0,
 		Addrs:     []uint{},
 		Mode:      File,
+		HasBlocks: true,
 	}
 
 	if !cmp.Equal(expect, *i) {
@@ -135,6 +161,7 @@ func TestMassiveWrite(tt *testing.T) {
 		Filesize:  0,
 		Addrs:     []uint{},
 		Mode:      File,
+		HasBlocks: true,
 	}
 
 	if !cmp.Equal(expect, *i) {
@@ -273,12 +300,484 @@ func TestBigOffsets(tt *testing.T) {
 
 	t = jrnl.BeginTransaction()
 	_, err = Writei(t, i1.Serialnum, 500, "what")
-	if err == nil {
-		tt.Errorf("somehow wrote off the end")
+	if err != nil {
+		tt.Errorf("error writing off the end: %s", err)
+	}
+	t.EndTransaction(false)
+
+	data = Readi(i1.Serialnum, 0, 1000)
+	want := strings.Repeat("a", 10) + strings.Repeat("\x00", 490) + "what"
+	if data != want {
+		tt.Errorf("read %q after writing off the end", data)
 	}
 
-	t.AbortTransaction()
 	t = jrnl.BeginTransaction()
+	i1 = Geti(i1.Serialnum)
 	i1.Free(t)
 	t.EndTransaction(false)
 }
+
+// Covers:
+//	-> freei/datablocks
+func TestFreeRelsesBlocks(tt *testing.T) {
+	initUut()
+	t := jrnl.BeginTransaction()
+	i1 := Alloci(t, File)
+	t.EndTransaction(false)
+
+	t = jrnl.BeginTransaction()
+	_, err := i1.Write(t, 0, strings.Repeat("a", 8192))
+	if err != nil {
+		tt.Errorf("error during initial write")
+	}
+	t.EndTransaction(false)
+	old := append([]Extent{}, i1.Extents...)
+
+	t = jrnl.BeginTransaction()
+	if i1.Free(t) != nil {
+		tt.Errorf("error freeing inode")
+	}
+	t.EndTransaction(false)
+
+	i1 = Geti(i1.Serialnum)
+	if i1.Refcnt != 0 || i1.Filesize != 0 || len(i1.Extents) != 0 {
+		tt.Errorf("freed inode still has data: %v", *i1)
+	}
+	i1.Relse()
+
+	// The blocks should be up for grabs again
+	t = jrnl.BeginTransaction()
+	i2 := Alloci(t, File)
+	_, err = i2.Write(t, 0, strings.Repeat("b", 8192))
+	if err != nil {
+		tt.Errorf("error during second write")
+	}
+	t.EndTransaction(false)
+	if !cmp.Equal(old, i2.Extents) {
+		tt.Errorf("blocks weren't reused, got %v/wanted %v", i2.Extents, old)
+	}
+	i2.Relse()
+}
+
+// Covers:
+//	-> resize/shrink
+//	-> resize/grow
+//	-> resize/zero
+func TestResize(tt *testing.T) {
+	initUut()
+	t := jrnl.BeginTransaction()
+	i := Alloci(t, File)
+	if _, err := i.Write(t, 0, strings.Repeat("a", 8292)); err != nil {
+		tt.Errorf("error during initial write")
+	}
+	t.EndTransaction(false)
+
+	t = jrnl.BeginTransaction()
+	if err := i.Resize(t, 5000); err != nil {
+		tt.Errorf("error shrinking: %s", err)
+	}
+	t.EndTransaction(false)
+	if i.NBlocks() != 2 || i.Filesize != 5000 {
+		tt.Errorf("%d blocks, size %d after shrinking", i.NBlocks(), i.Filesize)
+	}
+	if res := i.Read(0, 10000); res != strings.Repeat("a", 5000) {
+		tt.Errorf("read %d bytes after shrinking, wanted 5000", len(res))
+	}
+
+	// Growing in the same transaction as a write
+	// has to see the write
+	t = jrnl.BeginTransaction()
+	if _, err := i.Write(t, 4999, "b"); err != nil {
+		tt.Errorf("error during write")
+	}
+	if err := i.Resize(t, 9000); err != nil {
+		tt.Errorf("error growing: %s", err)
+	}
+	t.EndTransaction(false)
+	want := strings.Repeat("a", 4999) + "b" + strings.Repeat("\x00", 4000)
+	if res := i.Read(0, 10000); res != want {
+		tt.Errorf("read %q after growing", res[4990:])
+	}
+
+	t = jrnl.BeginTransaction()
+	if err := i.Resize(t, 0); err != nil {
+		tt.Errorf("error emptying: %s", err)
+	}
+	t.EndTransaction(false)
+	if i.NBlocks() != 0 || i.Read(0, 10) != "" {
+		tt.Errorf("data left after resizing to zero: %v", *i)
+	}
+	i.Relse()
+}
+
+// Covers:
+//	-> holes/zeroes, holes/noblocks
+//	-> holes/fill, holes/truncate
+//	-> holes/shrink, holes/regrow
+func TestHoles(tt *testing.T) {
+	initUut()
+	t := jrnl.BeginTransaction()
+	i := Alloci(t, File)
+	if _, err := i.Write(t, 1<<20, "tail"); err != nil {
+		tt.Fatalf("error writing at 1MiB: %s", err)
+	}
+	t.EndTransaction(false)
+
+	if i.Filesize != 1<<20+4 || i.NBlocks() != 1 {
+		tt.Errorf("size %d with %d blocks, wanted %d with 1", i.Filesize, i.NBlocks(), 1<<20+4)
+	}
+	if res := i.Read(4000, 200); res != strings.Repeat("\x00", 200) {
+		tt.Errorf("read %q from a hole", res)
+	}
+	if res := i.Read(1<<20-2, 10); res != "\x00\x00tail" {
+		tt.Errorf("read %q across the end of a hole", res)
+	}
+
+	// Filling one in takes one block
+	t = jrnl.BeginTransaction()
+	if _, err := i.Write(t, 8195, "mid"); err != nil {
+		tt.Errorf("error filling a hole: %s", err)
+	}
+	if err := i.Resize(t, 2000000); err != nil {
+		tt.Errorf("error growing: %s", err)
+	}
+	t.EndTransaction(false)
+	if i.NBlocks() != 2 {
+		tt.Errorf("%d blocks after filling a hole and growing, wanted 2", i.NBlocks())
+	}
+	want := strings.Repeat("\x00", 8195) + "mid" + strings.Repeat("\x00", 10)
+	if res := i.Read(0, 8208); res != want {
+		tt.Errorf("read %q around a filled hole", res[8190:])
+	}
+
+	// Shrink into a hole, then mid-block, then grow
+	t = jrnl.BeginTransaction()
+	if err := i.Resize(t, 5000); err != nil {
+		tt.Errorf("error shrinking into a hole: %s", err)
+	}
+	t.EndTransaction(false)
+	t = jrnl.BeginTransaction()
+	if err := i.Resize(t, 8197); err != nil {
+		tt.Errorf("error growing: %s", err)
+	}
+	t.EndTransaction(false)
+	if i.NBlocks() != 0 || i.Read(0, 9000) != strings.Repeat("\x00", 8197) {
+		tt.Errorf("%d blocks after shrinking past every write", i.NBlocks())
+	}
+
+	t = jrnl.BeginTransaction()
+	i.Write(t, 0, strings.Repeat("z", 100))
+	i.Resize(t, 50)
+	i.Resize(t, 100)
+	t.EndTransaction(false)
+	if res := i.Read(0, 100); res != strings.Repeat("z", 50)+strings.Repeat("\x00", 50) {
+		tt.Errorf("read %q after shrinking and growing", res)
+	}
+
+	t = jrnl.BeginTransaction()
+	i.Truncate(t)
+	t.EndTransaction(false)
+	if i.NBlocks() != 0 || len(i.Extents) != 0 {
+		tt.Errorf("blocks left after truncating: %v", i.Extents)
+	}
+	i.Relse()
+}
+
+// Covers:
+//	-> indirect/direct, indirect/indirect, indirect/double, indirect/max
+//	-> indirect/counted, indirect/shrink, indirect/boundary
+func TestIndirect(tt *testing.T) {
+	initUut()
+	t := jrnl.BeginTransaction()
+	i := Alloci(t, File)
+	t.EndTransaction(false)
+
+	single := uint(nDirectBlocks+10) * 4096
+	double := uint(nDirectBlocks+nIndirect+3*nIndirect+7) * 4096
+	writes := map[uint]string{
+		0:      "direct",
+		single: "single",
+		double: "double",
+		// Last direct block into the first indirect one
+		nDirectBlocks*4096 - 3: "across",
+	}
+	for off, data := range writes {
+		t = jrnl.BeginTransaction()
+		if _, err := i.Write(t, off, data); err != nil {
+			tt.Fatalf("error writing at %d: %s", off, err)
+		}
+		t.EndTransaction(false)
+	}
+
+	// Five data blocks, the indirect block and two
+	// levels of double-indirect ones
+	if i.Filesize != double+6 || i.NBlocks() != 8 {
+		tt.Errorf("size %d with %d blocks, wanted %d with 8", i.Filesize, i.NBlocks(), double+6)
+	}
+	i.Relse()
+	for off, data := range writes {
+		if res := Readi(i.Serialnum, off, uint(len(data))); res != data {
+			tt.Errorf("read %q at %d, wanted %q", res, off, data)
+		}
+	}
+	if res := Readi(i.Serialnum, double-4096, 8); res != strings.Repeat("\x00", 8) {
+		tt.Errorf("read %q from a hole under a pointer block", res)
+	}
+
+	i = Geti(i.Serialnum)
+	t = jrnl.BeginTransaction()
+	if _, err := i.Write(t, maxBlocks*4096, "x"); err == nil {
+		tt.Errorf("wrote past the maximum file size")
+	}
+	t.EndTransaction(false)
+
+	// Back to four data blocks and the indirect one
+	t = jrnl.BeginTransaction()
+	if err := i.Resize(t, single+3); err != nil {
+		tt.Errorf("error shrinking: %s", err)
+	}
+	t.EndTransaction(false)
+	if i.NBlocks() != 5 || i.DIndirect != hole {
+		tt.Errorf("%d blocks after shrinking, double-indirect %d", i.NBlocks(), i.DIndirect)
+	}
+	if res := i.Read(single, 10); res != "sin" {
+		tt.Errorf("read %q after shrinking", res)
+	}
+
+	t = jrnl.BeginTransaction()
+	i.Truncate(t)
+	t.EndTransaction(false)
+	if i.NBlocks() != 0 || i.Indirect != hole {
+		tt.Errorf("%d blocks left after truncating", i.NBlocks())
+	}
+
+	// Everything went back to the bitmap
+	t = jrnl.BeginTransaction()
+	bns := balloc.AllocBlocks(t, 5)
+	t.AbortTransaction()
+	if bns[4] != EndInode+4 {
+		tt.Errorf("blocks weren't freed, got %v", bns)
+	}
+	i.Relse()
+}
+
+// Covers:
+//	-> extents/onewrite, extents/append, extents/fill
+//	-> extents/fragmented, extents/truncated
+func TestExtents(tt *testing.T) {
+	initUut()
+	t := jrnl.BeginTransaction()
+	i := Alloci(t, File)
+	t.EndTransaction(false)
+	t = jrnl.BeginTransaction()
+	j := Alloci(t, File)
+	t.EndTransaction(false)
+
+	t = jrnl.BeginTransaction()
+	i.Write(t, 0, strings.Repeat("a", 40*4096))
+	t.EndTransaction(false)
+	t = jrnl.BeginTransaction()
+	i.Write(t, 40*4096, strings.Repeat("b", 10*4096))
+	t.EndTransaction(false)
+	if len(i.Extents) != 1 || i.Extents[0].Len != 50 || len(i.Addrs) != 0 {
+		tt.Errorf("got extents %v for 50 blocks written in a row", i.Extents)
+	}
+	flat := *i
+	flat.Addrs, flat.Extents = i.directMap(), nil
+	if n, m := len(i.Encode()), len(flat.Encode()); n >= m {
+		tt.Errorf("inode takes %d bytes with extents, %d without", n, m)
+	}
+
+	// A hole, and then filling it in between the two
+	t = jrnl.BeginTransaction()
+	i.Write(t, 60*4096, "c")
+	j.Write(t, 0, "x")
+	i.Write(t, 50*4096, strings.Repeat("d", 10*4096))
+	t.EndTransaction(false)
+	if len(i.Extents) != 3 {
+		tt.Errorf("got extents %v after filling a hole", i.Extents)
+	}
+
+	// Two files growing a block at a time
+	// in turn can't keep their runs
+	for k := uint(1); k <= maxExtents; k++ {
+		t = jrnl.BeginTransaction()
+		i.Write(t, (60+k)*4096, "c")
+		j.Write(t, k*4096, "x")
+		t.EndTransaction(false)
+	}
+	if len(i.Extents) != 0 || len(i.Addrs) != 61+maxExtents {
+		tt.Errorf("got %d extents and %d addresses when fragmented", len(i.Extents), len(i.Addrs))
+	}
+	want := strings.Repeat("a", 40*4096) + strings.Repeat("b", 10*4096) + strings.Repeat("d", 10*4096) + "c"
+	if res := i.Read(0, 60*4096+1); res != want {
+		tt.Errorf("read back the wrong data when fragmented")
+	}
+	if res := i.Read((60+maxExtents)*4096, 2); res != "c" {
+		tt.Errorf("read %q from the last block", res)
+	}
+
+	t = jrnl.BeginTransaction()
+	i.Truncate(t)
+	j.Truncate(t)
+	i.Write(t, 0, strings.Repeat("e", 5000))
+	t.EndTransaction(false)
+	if len(i.Extents) != 1 || len(i.Addrs) != 0 {
+		tt.Errorf("got extents %v, addresses %v after truncating", i.Extents, i.Addrs)
+	}
+	i.Relse()
+	j.Relse()
+}
+
+// Covers:
+//	-> imap/alloc, imap/free
+//	-> imap/behind, imap/nomap
+func TestInodeMap(tt *testing.T) {
+	initUut()
+	alloc := func() *Inode {
+		t := jrnl.BeginTransaction()
+		defer t.EndTransaction(false)
+		return Alloci(t, File)
+	}
+	i := alloc()
+	j := alloc()
+	if m := SnapshotMap(); m == nil || !m[i.Serialnum] || !m[j.Serialnum] {
+		tt.Fatalf("allocated inodes aren't in the map")
+	}
+
+	jnum := j.Serialnum
+	t := jrnl.BeginTransaction()
+	j.Free(t)
+	t.EndTransaction(false)
+	if SnapshotMap()[jnum] {
+		tt.Errorf("freed inode %d is still in the map", jnum)
+	}
+	if j = alloc(); j.Serialnum != jnum {
+		tt.Errorf("got inode %d, wanted freed inode %d back", j.Serialnum, jnum)
+	} else if i.Gen != 0 || j.Gen != 1 {
+		tt.Errorf("got generations %d and %d, wanted 0 and 1", i.Gen, j.Gen)
+	}
+	j.Relse()
+
+	// The map has i free, but it isn't
+	i.Relse()
+	t = jrnl.BeginTransaction()
+	MarkMap(t, []uint16{i.Serialnum}, false)
+	t.EndTransaction(false)
+	k := alloc()
+	if k.Serialnum == i.Serialnum {
+		tt.Errorf("allocated in-use inode %d", i.Serialnum)
+	}
+	if !SnapshotMap()[i.Serialnum] {
+		tt.Errorf("inode %d wasn't marked used after skipping it", i.Serialnum)
+	}
+	k.Relse()
+
+	// A volume from before the map
+	t = jrnl.BeginTransaction()
+	t.WriteBlock(&bio.Block{Nr: imapBlock, Data: ""})
+	t.EndTransaction(false)
+	if SnapshotMap() != nil {
+		tt.Errorf("got a map for a volume without one")
+	}
+	l := alloc()
+	if l.Serialnum <= k.Serialnum {
+		tt.Errorf("got inode %d, but %d through %d are in use", l.Serialnum, i.Serialnum, k.Serialnum)
+	}
+	if m := SnapshotMap(); m == nil || !m[i.Serialnum] || !m[jnum] || !m[k.Serialnum] || !m[l.Serialnum] {
+		tt.Errorf("built map is missing inodes in use")
+	}
+	l.Relse()
+}
+
+// Covers:
+//	-> inline/small, inline/hole, inline/overwrite
+//	-> inline/growwrite, inline/growresize, inline/shrink
+func TestInline(tt *testing.T) {
+	initUut()
+	t := jrnl.BeginTransaction()
+	i := Alloci(t, File)
+	t.EndTransaction(false)
+
+	t = jrnl.BeginTransaction()
+	i.Write(t, 0, "small")
+	i.Write(t, 10, "file")
+	i.Write(t, 1, "ME")
+	t.EndTransaction(false)
+	want := "sMEll\x00\x00\x00\x00\x00file"
+	if res := i.Read(0, 100); res != want || i.NBlocks() != 0 {
+		tt.Errorf("read %q from %d blocks, wanted %q from none", res, i.NBlocks(), want)
+	}
+
+	// Shrinking cuts the data off, so growing
+	// again within maxInline reads zeroes
+	t = jrnl.BeginTransaction()
+	i.Resize(t, 3)
+	i.Resize(t, 6)
+	t.EndTransaction(false)
+	if res := i.Read(0, 100); res != "sME\x00\x00\x00" {
+		tt.Errorf("read %q after shrinking and growing", res)
+	}
+
+	// Past maxInline, the data moves to a block
+	t = jrnl.BeginTransaction()
+	i.Write(t, maxInline, "!")
+	t.EndTransaction(false)
+	want = "sME" + strings.Repeat("\x00", maxInline-3) + "!"
+	if res := i.Read(0, maxInline+10); res != want || i.NBlocks() != 1 || i.Inline != "" {
+		tt.Errorf("read %d bytes from %d blocks after growing", len(res), i.NBlocks())
+	}
+
+	t = jrnl.BeginTransaction()
+	i.Truncate(t)
+	i.Write(t, 0, "tiny")
+	i.Resize(t, 3*4096)
+	t.EndTransaction(false)
+	if res := i.Read(0, 6); res != "tiny\x00\x00" || i.NBlocks() != 1 {
+		tt.Errorf("read %q from %d blocks after resizing past maxInline", res, i.NBlocks())
+	}
+	i.Relse()
+}
+
+// Covers:
+//	-> count/kept, count/old
+func TestBlockCount(tt *testing.T) {
+	initUut()
+	t := jrnl.BeginTransaction()
+	i := Alloci(t, File)
+	t.EndTransaction(false)
+
+	steps := []func(t *jrnl.TxnHandle){
+		func(t *jrnl.TxnHandle) { i.Write(t, 0, strings.Repeat("a", 3*4096)) },
+		func(t *jrnl.TxnHandle) { i.Write(t, (nDirectBlocks+nIndirect+5)*4096, "far") },
+		func(t *jrnl.TxnHandle) { i.Resize(t, (nDirectBlocks+2)*4096) },
+		func(t *jrnl.TxnHandle) { i.Write(t, 4096*nDirectBlocks, "in") },
+		func(t *jrnl.TxnHandle) { i.Truncate(t) },
+	}
+	for idx, step := range steps {
+		t = jrnl.BeginTransaction()
+		step(t)
+		t.EndTransaction(false)
+		if n := i.CountBlocks(nil); i.NBlocks() != n {
+			tt.Errorf("step %d: counted %d blocks, map has %d", idx, i.NBlocks(), n)
+		}
+	}
+
+	// An inode from before the count is walked,
+	// and gets one the next time it changes
+	t = jrnl.BeginTransaction()
+	i.Write(t, 0, strings.Repeat("b", 2*4096))
+	i.HasBlocks, i.Blocks = false, 0
+	i.EnqWrite(t)
+	t.EndTransaction(false)
+	if i.NBlocks() != 2 {
+		tt.Errorf("old inode counted %d blocks, wanted 2", i.NBlocks())
+	}
+	t = jrnl.BeginTransaction()
+	i.Write(t, 2*4096, "c")
+	t.EndTransaction(false)
+	if !i.HasBlocks || i.Blocks != 3 {
+		tt.Errorf("old inode kept %d blocks (%v), wanted 3", i.Blocks, i.HasBlocks)
+	}
+	i.Relse()
+}
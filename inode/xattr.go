@@ -0,0 +1,84 @@
+package inode
+
+import (
+	"errors"
+	"pp2/jrnl"
+	"sort"
+)
+
+// Extended attributes live in the inode record itself,
+// so they're journaled along with everything else in
+// it. Together they have to leave room in the inode's
+// block for a file's worth of Addrs, or of Inline
+const maxXattrName = 255
+const maxXattrSpace = 1024
+
+var (
+	ErrNoXattr    = errors.New("no such attribute")
+	ErrXattrSpace = errors.New("no space left for attributes")
+)
+
+func checkXattrName(name string) error {
+	if name == "" || len(name) > maxXattrName {
+		return errors.New("invalid attribute name")
+	}
+	return nil
+}
+
+func (i *Inode) xattrSpace() int {
+	total := 0
+	for name, value := range i.Xattrs {
+		total += len(name) + len(value)
+	}
+	return total
+}
+
+func (i *Inode) GetXattr(name string) (string, error) {
+	value, ok := i.Xattrs[name]
+	if !ok {
+		return "", ErrNoXattr
+	}
+	return value, nil
+}
+
+// Sorted by name
+func (i *Inode) ListXattrs() []string {
+	res := make([]string, 0, len(i.Xattrs))
+	for name := range i.Xattrs {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Sets name to value, replacing any old value.
+// Enqueues the inode for writing with a new Ctime
+func (i *Inode) SetXattr(t *jrnl.TxnHandle, name string, value string) error {
+	if err := checkXattrName(name); err != nil {
+		return err
+	}
+
+	old, had := i.Xattrs[name]
+	space := i.xattrSpace() + len(name) + len(value)
+	if had {
+		space -= len(name) + len(old)
+	}
+	if space > maxXattrSpace {
+		return ErrXattrSpace
+	}
+
+	if i.Xattrs == nil {
+		i.Xattrs = make(map[string]string)
+	}
+	i.Xattrs[name] = value
+	return i.Touch(t, CTime)
+}
+
+// Like SetXattr
+func (i *Inode) RemoveXattr(t *jrnl.TxnHandle, name string) error {
+	if _, ok := i.Xattrs[name]; !ok {
+		return ErrNoXattr
+	}
+	delete(i.Xattrs, name)
+	return i.Touch(t, CTime)
+}
@@ -1,6 +1,7 @@
 package jrnl
 
 import (
+	"fmt"
 	"pp2/bio"
 	"testing"
 )
@@ -20,10 +21,14 @@ import (
 //	-> WriteBlock
 //		-> blk
 //			-> Same block number is written twice in a txn
+//			-> Same block number is written > blkPerSys times in a txn
+//			-> Data contains the log's separator
 //			-> Same block number is written twice across txns
 //		-> t
 //			-> No other, some other transactions running
 //			-> Transaction length == 1, >1 (and >> 1)
+//	-> ReadBlock
+//		-> Block written in this txn, not written
 
 func initUut() {
 	bio.Binit("", true)
@@ -229,6 +234,37 @@ func TestManyWrites(tt *testing.T) {
 	}
 }
 
+// Covers:
+//	- write/blk/manyrewrites
+func TestManyRewrites(tt *testing.T) {
+	initUut()
+	t := BeginTransaction()
+	for i := 0; i < 3*blkPerSys; i++ {
+		if err := t.WriteBlock(&bio.Block{
+			Nr:   EndJrnl + uint(i%2),
+			Data: fmt.Sprintf("version %d", i),
+		}); err != nil {
+			tt.Fatalf("failed to rewrite block on write %d", i)
+		}
+	}
+	if t.offset != 2 {
+		tt.Errorf("two blocks took %d log slots, wanted 2", t.offset)
+	}
+	t.EndTransaction(false)
+
+	for i := uint(0); i < 2; i++ {
+		b := bio.Bget(EndJrnl + i)
+		expect := bio.Block{
+			Nr:   EndJrnl + i,
+			Data: fmt.Sprintf("version %d", 3*blkPerSys-2+i),
+		}
+		if *b != expect {
+			tt.Errorf("incorrect block: got %v/expected %v", *b, expect)
+		}
+		b.Brelse()
+	}
+}
+
 // Covers:
 //	- end/txns/many
 func TestManyTransactions(tt *testing.T) {
@@ -333,3 +369,62 @@ func TestMultipleAbort(tt *testing.T) {
 	b.Brelse()
 
 }
+
+// Covers:
+//	- readblock/written
+//	- readblock/notwritten
+func TestReadOwnWrites(tt *testing.T) {
+	initUut()
+	t := BeginTransaction()
+	if err := t.WriteBlock(&bio.Block{
+		Nr:   0,
+		Data: "pending",
+	}); err != nil {
+		tt.Errorf("failed to write to block")
+	}
+
+	b := t.ReadBlock(0)
+	expect := bio.Block{
+		Nr:   0,
+		Data: "pending",
+	}
+	if *b != expect {
+		tt.Errorf("incorrect block: got %v/expected %v", *b, expect)
+	}
+	b.Brelse()
+
+	b = t.ReadBlock(1)
+	expect = bio.Block{
+		Nr:   1,
+		Data: "",
+	}
+	if *b != expect {
+		tt.Errorf("incorrect block: got %v/expected %v", *b, expect)
+	}
+	b.Brelse()
+	t.EndTransaction(false)
+}
+
+// Covers:
+//	- write/blk/separator
+func TestSlashData(tt *testing.T) {
+	initUut()
+	t := BeginTransaction()
+	if err := t.WriteBlock(&bio.Block{
+		Nr:   0,
+		Data: "a/b/1/",
+	}); err != nil {
+		tt.Errorf("failed to write to block")
+	}
+	t.EndTransaction(false)
+
+	b := bio.Bget(0)
+	expect := bio.Block{
+		Nr:   0,
+		Data: "a/b/1/",
+	}
+	if *b != expect {
+		tt.Errorf("incorrect block: got %v/expected %v", *b, expect)
+	}
+	b.Brelse()
+}
@@ -31,24 +31,22 @@ func flattenSb(sb *logSB) *bio.Block {
 	}
 }
 
+// The data in the middle may well contain slashes
+// itself, so only split on the first and last ones
 func parseLb(blk *bio.Block) *logBlock {
-	lst := strings.Split(blk.Data, "/")
-	if len(lst) < 3 {
+	first := strings.Index(blk.Data, "/")
+	last := strings.LastIndex(blk.Data, "/")
+	if first < 0 || first == last {
 		return &logBlock{lnr: blk.Nr}
 	}
 
-	rnr, _ := strconv.ParseUint(lst[0], 10, 64)
-
-	var last bool
-	if lst[2] == "1" {
-		last = true
-	}
+	rnr, _ := strconv.ParseUint(blk.Data[:first], 10, 64)
 
 	return &logBlock{
 		lnr:   blk.Nr,
 		rnr:   uint(rnr),
-		rdata: lst[1],
-		last:  last,
+		rdata: blk.Data[first+1 : last],
+		last:  blk.Data[last+1:] == "1",
 	}
 }
 
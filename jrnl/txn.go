@@ -14,6 +14,8 @@ func getLogSegmentStart(blkSeg uint) uint {
 type TxnHandle struct {
 	blkSeg uint
 	offset uint
+	dirty  map[uint]string
+	slots  map[uint]uint // Where in the log each dirty block went
 }
 
 // Attempt to write a block to the log.
@@ -21,11 +23,16 @@ type TxnHandle struct {
 // This is highly unlikely, so assume this passes okay
 // It is recommended to hold all blocks you write here,
 // and to keep them through the duration of your log.
+// Writing a block again reuses its place in the log,
+// so only distinct blocks count against blkPerSys
 func (t *TxnHandle) WriteBlock(blk *bio.Block) error {
-	if t.offset >= blkPerSys {
+	off, again := t.slots[blk.Nr]
+	if !again && t.offset >= blkPerSys {
 		return errors.New("too many blocks written")
+	} else if !again {
+		off = t.offset
 	}
-	lbn := getLogSegmentStart(t.blkSeg) + t.offset
+	lbn := getLogSegmentStart(t.blkSeg) + off
 
 retry:
 	// Acquires and releases LOG BLOCK
@@ -42,10 +49,28 @@ retry:
 
 	nlb.Brelse()
 
-	t.offset++
+	t.dirty[blk.Nr] = blk.Data
+	if !again {
+		t.slots[blk.Nr] = off
+		t.offset++
+	}
 	return nil
 }
 
+// Acquire a block just like bio.Bget, except that
+// if this transaction already wrote the block, you
+// get that data back instead of what's on disk. Logged
+// writes don't hit disk until commit, so anyone doing
+// more than one read-modify-write of a block in a
+// single transaction needs to read through here.
+func (t *TxnHandle) ReadBlock(nr uint) *bio.Block {
+	blk := bio.Bget(nr)
+	if data, ok := t.dirty[nr]; ok {
+		blk.Data = data
+	}
+	return blk
+}
+
 // Start a transaction. Updates internal
 // metadata to ensure consistency and
 // returns the syscall log subset in which
@@ -86,6 +111,8 @@ done:
 	return &TxnHandle{
 		blkSeg: res,
 		offset: 0,
+		dirty:  make(map[uint]string),
+		slots:  make(map[uint]uint),
 	}
 }
 
@@ -3,7 +3,9 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
 	"pp2/balloc"
 	"pp2/bio"
@@ -12,16 +14,21 @@ import (
 	"pp2/jrnl"
 	"pp2/kvraft"
 	"pp2/netdrv"
+	"pp2/ninep"
+	"pp2/quota"
 	"pp2/raft"
 	"strconv"
 	"strings"
 )
 
+// How many entries ls asks for at once
+const lsPageSize = 64
+
 func runCli() {
 	rdr := bufio.NewReader(os.Stdin)
 	inTxn := false
 	var t *jrnl.TxnHandle
-	f := fs.Mount()
+	f := fs.Mount(processCred())
 
 	for {
 		fmt.Print("> ")
@@ -31,11 +38,293 @@ func runCli() {
 
 		switch i[0] {
 		case "open":
+			// open <path> [rdonly|wronly|rdwr|creat|excl|trunc|append]...
+			// With no flags, opens read-write and creates
+			if len(i) < 2 {
+				goto badcmd
+			}
+			flags, ok := parseOpenFlags(i[2:])
+			if !ok {
+				goto badcmd
+			}
+			res, err := f.Open(i[1], flags)
+			if err != nil {
+				fmt.Printf("Open error: %s\n", err)
+			} else {
+				fmt.Printf("Opened file %s -> fd %d\n", i[1], res)
+			}
+			continue
+
+		case "mkdir":
+			if len(i) != 2 {
+				goto badcmd
+			}
+			if err := f.Mkdir(i[1]); err != nil {
+				fmt.Printf("Mkdir error: %s\n", err)
+			} else {
+				fmt.Printf("Made directory %s\n", i[1])
+			}
+			continue
+
+		case "rmdir":
+			if len(i) != 2 {
+				goto badcmd
+			}
+			if err := f.Rmdir(i[1]); err != nil {
+				fmt.Printf("Rmdir error: %s\n", err)
+			} else {
+				fmt.Printf("Removed directory %s\n", i[1])
+			}
+			continue
+
+		case "unlink":
+			if len(i) != 2 {
+				goto badcmd
+			}
+			if err := f.Unlink(i[1]); err != nil {
+				fmt.Printf("Unlink error: %s\n", err)
+			} else {
+				fmt.Printf("Unlinked %s\n", i[1])
+			}
+			continue
+
+		case "rename":
+			if len(i) != 3 {
+				goto badcmd
+			}
+			if err := f.Rename(i[1], i[2]); err != nil {
+				fmt.Printf("Rename error: %s\n", err)
+			} else {
+				fmt.Printf("Renamed %s -> %s\n", i[1], i[2])
+			}
+			continue
+
+		case "link":
+			if len(i) != 3 {
+				goto badcmd
+			}
+			if err := f.Link(i[1], i[2]); err != nil {
+				fmt.Printf("Link error: %s\n", err)
+			} else {
+				fmt.Printf("Linked %s -> %s\n", i[2], i[1])
+			}
+			continue
+
+		case "symlink":
+			if len(i) != 3 {
+				goto badcmd
+			}
+			if err := f.Symlink(i[1], i[2]); err != nil {
+				fmt.Printf("Symlink error: %s\n", err)
+			} else {
+				fmt.Printf("Symlinked %s -> %s\n", i[2], i[1])
+			}
+			continue
+
+		case "readlink":
+			if len(i) != 2 {
+				goto badcmd
+			}
+			res, err := f.Readlink(i[1])
+			if err != nil {
+				fmt.Printf("Readlink error: %s\n", err)
+			} else {
+				fmt.Printf("%s -> %s\n", i[1], res)
+			}
+			continue
+
+		case "ls":
+			if len(i) > 2 {
+				goto badcmd
+			}
+			path := "/"
+			if len(i) == 2 {
+				path = i[1]
+			}
+
+			// Print a page at a time, rather than
+			// holding the whole listing
+			cursor := uint(0)
+			for {
+				ents, next, err := f.ReadDirPage(path, cursor, lsPageSize)
+				if err != nil {
+					fmt.Printf("Ls error: %s\n", err)
+					break
+				}
+				for _, ent := range ents {
+					fmt.Printf("%-8s %5d %s\n", ent.Mode, ent.Inum, ent.Name)
+				}
+				if next == 0 {
+					break
+				}
+				cursor = next
+			}
+			continue
+
+		case "chmod":
+			if len(i) != 3 {
+				goto badcmd
+			}
+			perm, err := strconv.ParseUint(i[2], 8, 16)
+			if err != nil || perm > 0777 {
+				goto badcmd
+			}
+			if err := f.Chmod(i[1], uint16(perm)); err != nil {
+				fmt.Printf("Chmod error: %s\n", err)
+			} else {
+				fmt.Printf("Set %s to %04o\n", i[1], perm)
+			}
+			continue
+
+		case "chown":
+			if len(i) != 4 {
+				goto badcmd
+			}
+			uid, err := strconv.ParseUint(i[2], 10, 32)
+			if err != nil {
+				goto badcmd
+			}
+			gid, err := strconv.ParseUint(i[3], 10, 32)
+			if err != nil {
+				goto badcmd
+			}
+			if err := f.Chown(i[1], uint32(uid), uint32(gid)); err != nil {
+				fmt.Printf("Chown error: %s\n", err)
+			} else {
+				fmt.Printf("Gave %s to %d:%d\n", i[1], uid, gid)
+			}
+			continue
+
+		case "setxattr":
+			if len(i) != 4 {
+				goto badcmd
+			}
+			if err := f.Setxattr(i[1], i[2], i[3]); err != nil {
+				fmt.Printf("Setxattr error: %s\n", err)
+			} else {
+				fmt.Printf("Set %s on %s\n", i[2], i[1])
+			}
+			continue
+
+		case "getxattr":
+			if len(i) != 3 {
+				goto badcmd
+			}
+			res, err := f.Getxattr(i[1], i[2])
+			if err != nil {
+				fmt.Printf("Getxattr error: %s\n", err)
+			} else {
+				fmt.Printf("%s = %s\n", i[2], res)
+			}
+			continue
+
+		case "listxattr":
+			if len(i) != 2 {
+				goto badcmd
+			}
+			names, err := f.Listxattr(i[1])
+			if err != nil {
+				fmt.Printf("Listxattr error: %s\n", err)
+			}
+			for _, name := range names {
+				fmt.Printf("%s\n", name)
+			}
+			continue
+
+		case "rmxattr":
+			if len(i) != 3 {
+				goto badcmd
+			}
+			if err := f.Removexattr(i[1], i[2]); err != nil {
+				fmt.Printf("Removexattr error: %s\n", err)
+			} else {
+				fmt.Printf("Removed %s from %s\n", i[2], i[1])
+			}
+			continue
+
+		case "quota":
+			if len(i) != 1 {
+				goto badcmd
+			}
+			for _, q := range f.Quotas() {
+				kind := "user"
+				if q.Tree {
+					kind = "tree"
+				}
+				fmt.Printf("%s %d: %d/%d blocks, %d/%d inodes\n", kind, q.Id,
+					q.Blocks, q.BlockLimit, q.Inodes, q.InodeLimit)
+			}
+			continue
+
+		case "setquota":
+			// setquota user <uid> <blocks> <inodes>
+			// setquota tree <path> <blocks> <inodes>
+			// A limit of 0 is no limit
+			if len(i) != 5 || (i[1] != "user" && i[1] != "tree") {
+				goto badcmd
+			}
+			blocks, err := strconv.ParseUint(i[3], 10, 64)
+			if err != nil {
+				goto badcmd
+			}
+			inodes, err := strconv.ParseUint(i[4], 10, 64)
+			if err != nil {
+				goto badcmd
+			}
+
+			if i[1] == "user" {
+				uid, perr := strconv.ParseUint(i[2], 10, 32)
+				if perr != nil {
+					goto badcmd
+				}
+				err = f.SetUserQuota(uint32(uid), uint(blocks), uint(inodes))
+			} else {
+				err = f.SetTreeQuota(i[2], uint(blocks), uint(inodes))
+			}
+			if err != nil {
+				fmt.Printf("Setquota error: %s\n", err)
+			} else {
+				fmt.Printf("Set quota on %s %s\n", i[1], i[2])
+			}
+			continue
+
+		case "fsck":
+			// Checks only, since other clients might
+			// be working. Repair with ./pp2 fsck
+			if len(i) != 1 {
+				goto badcmd
+			}
+			printFsck(f.Fsck(false))
+			continue
+
+		case "stat":
+			if len(i) != 2 {
+				goto badcmd
+			}
+			st, err := f.Stat(i[1])
+			if err != nil {
+				fmt.Printf("Stat error: %s\n", err)
+			} else {
+				printStat(st)
+			}
+			continue
+
+		case "fstat":
 			if len(i) != 2 {
 				goto badcmd
 			}
-			res := f.Open(i[1])
-			fmt.Printf("Opened file %s -> fd %d\n", i[1], res)
+
+			fd, err := strconv.ParseInt(i[1], 10, 64)
+			if err != nil {
+				goto badcmd
+			}
+
+			st, err := f.Fstat(int(fd))
+			if err != nil {
+				fmt.Printf("Stat error: %s\n", err)
+			} else {
+				printStat(st)
+			}
 			continue
 
 		case "read":
@@ -79,6 +368,169 @@ func runCli() {
 			}
 			continue
 
+		case "pread":
+			if len(i) != 4 {
+				goto badcmd
+			}
+
+			fd, err := strconv.ParseInt(i[1], 10, 64)
+			if err != nil {
+				goto badcmd
+			}
+			offset, err := strconv.ParseUint(i[2], 10, 64)
+			if err != nil {
+				goto badcmd
+			}
+			cnt, err := strconv.ParseUint(i[3], 10, 64)
+			if err != nil {
+				goto badcmd
+			}
+
+			res, err := f.ReadAt(int(fd), uint(offset), uint(cnt))
+			if err != nil {
+				fmt.Printf("Read error: %s\n", err)
+			} else {
+				fmt.Printf("Read data: %s\n", res)
+			}
+			continue
+
+		case "pwrite":
+			if len(i) != 4 {
+				goto badcmd
+			}
+
+			fd, err := strconv.ParseInt(i[1], 10, 64)
+			if err != nil {
+				goto badcmd
+			}
+			offset, err := strconv.ParseUint(i[2], 10, 64)
+			if err != nil {
+				goto badcmd
+			}
+
+			res, err := f.WriteAt(int(fd), uint(offset), i[3])
+			if err != nil {
+				fmt.Printf("Write error: %s\n", err)
+			} else {
+				fmt.Printf("Wrote %d bytes of data\n", res)
+			}
+			continue
+
+		case "truncate":
+			if len(i) != 3 {
+				goto badcmd
+			}
+			size, err := strconv.ParseUint(i[2], 10, 64)
+			if err != nil {
+				goto badcmd
+			}
+
+			if err := f.Truncate(i[1], uint(size)); err != nil {
+				fmt.Printf("Truncate error: %s\n", err)
+			} else {
+				fmt.Printf("Truncated %s to %d bytes\n", i[1], size)
+			}
+			continue
+
+		case "ftruncate":
+			if len(i) != 3 {
+				goto badcmd
+			}
+			fd, err := strconv.ParseInt(i[1], 10, 64)
+			if err != nil {
+				goto badcmd
+			}
+			size, err := strconv.ParseUint(i[2], 10, 64)
+			if err != nil {
+				goto badcmd
+			}
+
+			if err := f.Ftruncate(int(fd), uint(size)); err != nil {
+				fmt.Printf("Truncate error: %s\n", err)
+			} else {
+				fmt.Printf("Truncated fd %d to %d bytes\n", fd, size)
+			}
+			continue
+
+		case "seek":
+			if len(i) != 4 {
+				goto badcmd
+			}
+
+			fd, err := strconv.ParseInt(i[1], 10, 64)
+			if err != nil {
+				goto badcmd
+			}
+			offset, err := strconv.ParseInt(i[2], 10, 64)
+			if err != nil {
+				goto badcmd
+			}
+
+			var whence int
+			switch i[3] {
+			case "set":
+				whence = io.SeekStart
+			case "cur":
+				whence = io.SeekCurrent
+			case "end":
+				whence = io.SeekEnd
+			default:
+				goto badcmd
+			}
+
+			res, err := f.Seek(int(fd), offset, whence)
+			if err != nil {
+				fmt.Printf("Seek error: %s\n", err)
+			} else {
+				fmt.Printf("Offset now %d\n", res)
+			}
+			continue
+
+		case "lock":
+			// lock <fd> <shared|exclusive> [nb]
+			if len(i) != 3 && (len(i) != 4 || i[3] != "nb") {
+				goto badcmd
+			}
+
+			fd, err := strconv.ParseInt(i[1], 10, 64)
+			if err != nil {
+				goto badcmd
+			}
+
+			var mode fs.LockMode
+			switch i[2] {
+			case "shared":
+				mode = fs.LockShared
+			case "exclusive":
+				mode = fs.LockExclusive
+			default:
+				goto badcmd
+			}
+
+			if err := f.Lock(int(fd), mode, len(i) == 4); err != nil {
+				fmt.Printf("Lock error: %s\n", err)
+			} else {
+				fmt.Printf("Locked fd %d\n", fd)
+			}
+			continue
+
+		case "unlock":
+			if len(i) != 2 {
+				goto badcmd
+			}
+
+			fd, err := strconv.ParseInt(i[1], 10, 64)
+			if err != nil {
+				goto badcmd
+			}
+
+			if err := f.Unlock(int(fd)); err != nil {
+				fmt.Printf("Unlock error: %s\n", err)
+			} else {
+				fmt.Printf("Unlocked fd %d\n", fd)
+			}
+			continue
+
 		case "close":
 			if len(i) != 2 {
 				goto badcmd
@@ -326,29 +778,129 @@ func runCli() {
 	}
 }
 
+func printStat(st *fs.Stat) {
+	fmt.Printf("inode %d: %s, %d bytes in %d blocks, %d links\n", st.Inum, st.Mode, st.Size, st.Blocks, st.Nlink)
+	fmt.Printf("\towner: %d, group: %d, perm: %04o\n", st.Uid, st.Gid, st.Perm)
+	fmt.Printf("\taccess: %s\n\tmodify: %s\n\tchange: %s\n", st.Atime, st.Mtime, st.Ctime)
+}
+
+func printFsck(rep *fs.FsckReport) {
+	fmt.Printf("%d inodes, %d blocks in use, %d problems\n", rep.Inodes, rep.Blocks, len(rep.Problems))
+	for _, p := range rep.Problems {
+		fmt.Printf("\t%s\n", p)
+	}
+	if rep.Repaired {
+		fmt.Printf("Repaired, %d problems left\n", len(rep.Left))
+		for _, p := range rep.Left {
+			fmt.Printf("\t%s\n", p)
+		}
+	}
+}
+
+func parseOpenFlags(args []string) (int, bool) {
+	if len(args) == 0 {
+		return fs.O_RDWR | fs.O_CREAT, true
+	}
+
+	flags := 0
+	for _, a := range args {
+		switch a {
+		case "rdonly":
+			flags |= fs.O_RDONLY
+		case "wronly":
+			flags |= fs.O_WRONLY
+		case "rdwr":
+			flags |= fs.O_RDWR
+		case "creat":
+			flags |= fs.O_CREAT
+		case "excl":
+			flags |= fs.O_EXCL
+		case "trunc":
+			flags |= fs.O_TRUNC
+		case "append":
+			flags |= fs.O_APPEND
+		default:
+			return 0, false
+		}
+	}
+	return flags, true
+}
+
 func printUsageMsgAndDie(err string) {
 	fmt.Printf("Usage: ./pp2 <client | server | ns> <nsAddr (localhost if args[1] == 'ns')>\n")
+	fmt.Printf("       ./pp2 9p <nsAddr> <listenAddr>\n")
+	fmt.Printf("       ./pp2 fsck <nsAddr> [repair]\n")
 	fmt.Printf("Error: %s\n", err)
 	os.Exit(1)
 }
 
+// Clients act as whoever runs them
+func processCred() fs.Cred {
+	c := fs.Cred{
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+		Umask: 022,
+	}
+	groups, _ := os.Getgroups()
+	for _, g := range groups {
+		c.Groups = append(c.Groups, uint32(g))
+	}
+	return c
+}
+
+// Brings up every layer a client needs
+func initClient(nsAddr string) {
+	bio.Binit(nsAddr, false)
+	jrnl.InitSb()
+	balloc.InitBalloc(inode.EndInode)
+	quota.InitQuota(balloc.EndData())
+	inode.InodeInit()
+}
+
 func main() {
 	a := os.Args
-	if len(a) != 3 {
+	if len(a) < 2 {
 		printUsageMsgAndDie("invalid number of arguments")
-	} else if a[1] != "client" && a[1] != "server" && a[1] != "ns" {
+	} else if a[1] != "client" && a[1] != "server" && a[1] != "ns" && a[1] != "9p" && a[1] != "fsck" {
 		printUsageMsgAndDie("invalid second argument")
+	} else if a[1] == "9p" && len(a) != 4 {
+		printUsageMsgAndDie("invalid number of arguments")
+	} else if a[1] == "fsck" && len(a) != 3 && (len(a) != 4 || a[3] != "repair") {
+		printUsageMsgAndDie("invalid arguments to fsck")
+	} else if a[1] != "9p" && a[1] != "fsck" && len(a) != 3 {
+		printUsageMsgAndDie("invalid number of arguments")
 	}
 
 	if a[1] == "ns" {
 		netdrv.RunNameserver()
 	} else if a[1] == "client" {
-		bio.Binit(a[2], false)
-		jrnl.InitSb()
-		balloc.InitBalloc(inode.EndInode)
-		inode.InodeInit()
+		initClient(a[2])
 		runCli()
 
+	} else if a[1] == "fsck" {
+		initClient(a[2])
+		repair := len(a) == 4
+		f := fs.MountReadOnly(fs.RootCred)
+		if repair {
+			f = fs.Mount(fs.RootCred)
+		}
+		rep := f.Fsck(repair)
+		printFsck(rep)
+		bio.Bflush()
+		if len(rep.Problems) > 0 && (!rep.Repaired || len(rep.Left) > 0) {
+			os.Exit(1)
+		}
+
+	} else if a[1] == "9p" {
+		initClient(a[2])
+		l, err := net.Listen("tcp", a[3])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Serving 9P on %s\n", l.Addr())
+		log.Fatal(ninep.NewServer(fs.Mount(processCred())).Serve(l))
+
 	} else {
 		rc := netdrv.MkDefaultNetConfig(true, true, a[2])
 
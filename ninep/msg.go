@@ -0,0 +1,400 @@
+package ninep
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Message types, see intro(5) of the Plan 9 manual
+const (
+	Tversion uint8 = 100 + iota
+	Rversion
+	Tauth
+	Rauth
+	Tattach
+	Rattach
+	Terror // Never sent
+	Rerror
+	Tflush
+	Rflush
+	Twalk
+	Rwalk
+	Topen
+	Ropen
+	Tcreate
+	Rcreate
+	Tread
+	Rread
+	Twrite
+	Rwrite
+	Tclunk
+	Rclunk
+	Tremove
+	Rremove
+	Tstat
+	Rstat
+	Twstat
+	Rwstat
+)
+
+const (
+	NoTag uint16 = 0xffff
+	NoFid uint32 = 0xffffffff
+
+	QTDIR  uint8  = 0x80
+	QTFILE uint8  = 0x00
+	DMDIR  uint32 = 0x80000000
+
+	OREAD  uint8 = 0
+	OWRITE uint8 = 1
+	ORDWR  uint8 = 2
+	OEXEC  uint8 = 3
+	OTRUNC uint8 = 0x10
+
+	// size[4] type[1] tag[2] fid[4] offset[8] count[4]
+	ioHdrSz = 24
+)
+
+type Qid struct {
+	Type    uint8
+	Version uint32
+	Path    uint64
+}
+
+// One message in either direction. Only the fields
+// for Type mean anything
+type Fcall struct {
+	Type    uint8
+	Tag     uint16
+	Fid     uint32
+	Afid    uint32
+	Newfid  uint32
+	Oldtag  uint16
+	Msize   uint32
+	Version string
+	Uname   string
+	Aname   string
+	Ename   string
+	Name    string
+	Perm    uint32
+	Mode    uint8
+	Iounit  uint32
+	Offset  uint64
+	Count   uint32
+	Wnames  []string
+	Wqids   []Qid
+	Qid     Qid
+	Data    []byte
+	Stat    []byte
+}
+
+// The machine-independent directory entry
+// carried by stat, wstat and directory reads
+type Dir struct {
+	Type   uint16
+	Dev    uint32
+	Qid    Qid
+	Mode   uint32
+	Atime  uint32
+	Mtime  uint32
+	Length uint64
+	Name   string
+	Uid    string
+	Gid    string
+	Muid   string
+}
+
+var errShort = errors.New("short 9p message")
+
+// Little-endian packing helpers. Unpacking
+// latches the first error and returns zeros after
+type packer struct {
+	b []byte
+}
+
+func (p *packer) u8(v uint8) {
+	p.b = append(p.b, v)
+}
+
+func (p *packer) u16(v uint16) {
+	p.b = append(p.b, byte(v), byte(v>>8))
+}
+
+func (p *packer) u32(v uint32) {
+	p.b = append(p.b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (p *packer) u64(v uint64) {
+	p.u32(uint32(v))
+	p.u32(uint32(v >> 32))
+}
+
+func (p *packer) str(s string) {
+	p.u16(uint16(len(s)))
+	p.b = append(p.b, s...)
+}
+
+func (p *packer) qid(q Qid) {
+	p.u8(q.Type)
+	p.u32(q.Version)
+	p.u64(q.Path)
+}
+
+type unpacker struct {
+	b   []byte
+	err error
+}
+
+// Running out gives zeros, enough for any fixed-size
+// field. Counts come off the wire, so they're checked
+// against what's left before anything is made of them
+func (u *unpacker) take(n int) []byte {
+	if u.err != nil || n < 0 || len(u.b) < n {
+		u.err = errShort
+		if n < 0 || n > 8 {
+			return nil
+		}
+		return make([]byte, n)
+	}
+	res := u.b[:n]
+	u.b = u.b[n:]
+	return res
+}
+
+func (u *unpacker) u8() uint8 {
+	return u.take(1)[0]
+}
+
+func (u *unpacker) u16() uint16 {
+	return binary.LittleEndian.Uint16(u.take(2))
+}
+
+func (u *unpacker) u32() uint32 {
+	return binary.LittleEndian.Uint32(u.take(4))
+}
+
+func (u *unpacker) u64() uint64 {
+	return binary.LittleEndian.Uint64(u.take(8))
+}
+
+func (u *unpacker) str() string {
+	return string(u.take(int(u.u16())))
+}
+
+func (u *unpacker) qid() Qid {
+	return Qid{
+		Type:    u.u8(),
+		Version: u.u32(),
+		Path:    u.u64(),
+	}
+}
+
+func (d *Dir) Bytes() []byte {
+	p := &packer{}
+	p.u16(0) // Fixed up below
+	p.u16(d.Type)
+	p.u32(d.Dev)
+	p.qid(d.Qid)
+	p.u32(d.Mode)
+	p.u32(d.Atime)
+	p.u32(d.Mtime)
+	p.u64(d.Length)
+	p.str(d.Name)
+	p.str(d.Uid)
+	p.str(d.Gid)
+	p.str(d.Muid)
+	binary.LittleEndian.PutUint16(p.b, uint16(len(p.b)-2))
+	return p.b
+}
+
+func UnmarshalDir(b []byte) (*Dir, error) {
+	u := &unpacker{b: b}
+	u.u16()
+	d := &Dir{
+		Type:   u.u16(),
+		Dev:    u.u32(),
+		Qid:    u.qid(),
+		Mode:   u.u32(),
+		Atime:  u.u32(),
+		Mtime:  u.u32(),
+		Length: u.u64(),
+		Name:   u.str(),
+		Uid:    u.str(),
+		Gid:    u.str(),
+		Muid:   u.str(),
+	}
+	return d, u.err
+}
+
+func (f *Fcall) Bytes() []byte {
+	p := &packer{}
+	p.u32(0) // Fixed up below
+	p.u8(f.Type)
+	p.u16(f.Tag)
+
+	switch f.Type {
+	case Tversion, Rversion:
+		p.u32(f.Msize)
+		p.str(f.Version)
+	case Tauth:
+		p.u32(f.Afid)
+		p.str(f.Uname)
+		p.str(f.Aname)
+	case Rauth, Rattach, Ropen, Rcreate:
+		p.qid(f.Qid)
+		if f.Type == Ropen || f.Type == Rcreate {
+			p.u32(f.Iounit)
+		}
+	case Tattach:
+		p.u32(f.Fid)
+		p.u32(f.Afid)
+		p.str(f.Uname)
+		p.str(f.Aname)
+	case Rerror:
+		p.str(f.Ename)
+	case Tflush:
+		p.u16(f.Oldtag)
+	case Twalk:
+		p.u32(f.Fid)
+		p.u32(f.Newfid)
+		p.u16(uint16(len(f.Wnames)))
+		for _, n := range f.Wnames {
+			p.str(n)
+		}
+	case Rwalk:
+		p.u16(uint16(len(f.Wqids)))
+		for _, q := range f.Wqids {
+			p.qid(q)
+		}
+	case Topen:
+		p.u32(f.Fid)
+		p.u8(f.Mode)
+	case Tcreate:
+		p.u32(f.Fid)
+		p.str(f.Name)
+		p.u32(f.Perm)
+		p.u8(f.Mode)
+	case Tread:
+		p.u32(f.Fid)
+		p.u64(f.Offset)
+		p.u32(f.Count)
+	case Rread:
+		p.u32(uint32(len(f.Data)))
+		p.b = append(p.b, f.Data...)
+	case Twrite:
+		p.u32(f.Fid)
+		p.u64(f.Offset)
+		p.u32(uint32(len(f.Data)))
+		p.b = append(p.b, f.Data...)
+	case Rwrite:
+		p.u32(f.Count)
+	case Tclunk, Tremove, Tstat:
+		p.u32(f.Fid)
+	case Rstat:
+		p.u16(uint16(len(f.Stat)))
+		p.b = append(p.b, f.Stat...)
+	case Twstat:
+		p.u32(f.Fid)
+		p.u16(uint16(len(f.Stat)))
+		p.b = append(p.b, f.Stat...)
+	}
+
+	binary.LittleEndian.PutUint32(p.b, uint32(len(p.b)))
+	return p.b
+}
+
+func UnmarshalFcall(b []byte) (*Fcall, error) {
+	u := &unpacker{b: b}
+	u.u32()
+	f := &Fcall{
+		Type: u.u8(),
+		Tag:  u.u16(),
+	}
+
+	switch f.Type {
+	case Tversion, Rversion:
+		f.Msize = u.u32()
+		f.Version = u.str()
+	case Tauth:
+		f.Afid = u.u32()
+		f.Uname = u.str()
+		f.Aname = u.str()
+	case Rauth, Rattach, Ropen, Rcreate:
+		f.Qid = u.qid()
+		if f.Type == Ropen || f.Type == Rcreate {
+			f.Iounit = u.u32()
+		}
+	case Tattach:
+		f.Fid = u.u32()
+		f.Afid = u.u32()
+		f.Uname = u.str()
+		f.Aname = u.str()
+	case Rerror:
+		f.Ename = u.str()
+	case Tflush:
+		f.Oldtag = u.u16()
+	case Twalk:
+		f.Fid = u.u32()
+		f.Newfid = u.u32()
+		n := int(u.u16())
+		for i := 0; i < n && u.err == nil; i++ {
+			f.Wnames = append(f.Wnames, u.str())
+		}
+	case Rwalk:
+		n := int(u.u16())
+		for i := 0; i < n && u.err == nil; i++ {
+			f.Wqids = append(f.Wqids, u.qid())
+		}
+	case Topen:
+		f.Fid = u.u32()
+		f.Mode = u.u8()
+	case Tcreate:
+		f.Fid = u.u32()
+		f.Name = u.str()
+		f.Perm = u.u32()
+		f.Mode = u.u8()
+	case Tread:
+		f.Fid = u.u32()
+		f.Offset = u.u64()
+		f.Count = u.u32()
+	case Rread:
+		f.Data = u.take(int(u.u32()))
+	case Twrite:
+		f.Fid = u.u32()
+		f.Offset = u.u64()
+		f.Data = u.take(int(u.u32()))
+	case Rwrite:
+		f.Count = u.u32()
+	case Tclunk, Tremove, Tstat:
+		f.Fid = u.u32()
+	case Rstat:
+		f.Stat = u.take(int(u.u16()))
+	case Twstat:
+		f.Fid = u.u32()
+		f.Stat = u.take(int(u.u16()))
+	case Rflush, Rclunk, Rremove, Rwstat:
+	default:
+		return nil, errors.New("unknown 9p message type")
+	}
+	return f, u.err
+}
+
+// Reads one whole message off r
+func ReadFcall(r io.Reader, msize uint32) (*Fcall, error) {
+	var sz [4]byte
+	if _, err := io.ReadFull(r, sz[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.LittleEndian.Uint32(sz[:])
+	if n < 7 || n > msize {
+		return nil, errors.New("bad 9p message size")
+	}
+	b := make([]byte, n)
+	copy(b, sz[:])
+	if _, err := io.ReadFull(r, b[4:]); err != nil {
+		return nil, err
+	}
+	return UnmarshalFcall(b)
+}
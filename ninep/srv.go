@@ -0,0 +1,633 @@
+package ninep
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/user"
+	"path"
+	"pp2/fs"
+	"pp2/inode"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Serves a pp2 filesystem over 9P2000. Each attach
+// gets its own mount of the volume, acting as the
+// user named in it. Mounts aren't safe for concurrent
+// use, so requests are handled one at a time
+type Server struct {
+	mu sync.Mutex
+	fs *fs.Filesystem
+}
+
+const maxMsize = 65536
+
+// Anything smaller can't carry a read or
+// write with any data in it
+const minMsize = 256
+
+type fid struct {
+	fs   *fs.Filesystem // The mount of the attach it came from
+	path string
+	qid  Qid
+	fd   int
+	open bool
+	mode uint8
+
+	// Directories are read as a run of stat entries,
+	// snapshotted when the fid is opened. A read has to
+	// start at 0 or where the last one stopped
+	dirents []byte
+	diroff  uint64
+}
+
+type conn struct {
+	s     *Server
+	rw    io.ReadWriteCloser
+	msize uint32
+	fids  map[uint32]*fid
+}
+
+func NewServer(f *fs.Filesystem) *Server {
+	return &Server{fs: f}
+}
+
+// Accepts connections on l until it fails
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+// Handles one client until it hangs up
+func (s *Server) ServeConn(rw io.ReadWriteCloser) {
+	c := &conn{
+		s:     s,
+		rw:    rw,
+		msize: maxMsize,
+		fids:  make(map[uint32]*fid),
+	}
+	defer c.hangup()
+
+	for {
+		req, err := ReadFcall(rw, c.msize)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("9P: dropping client: %s\n", err)
+			}
+			return
+		}
+
+		resp := c.serve(req)
+		resp.Tag = req.Tag
+		if _, err := rw.Write(resp.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// Handles req under the server's lock. A request
+// that panics gets an Rerror instead of taking the
+// lock, and so every other connection, down with it
+func (c *conn) serve(req *Fcall) (resp *Fcall) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("9P: message %d failed: %v\n", req.Type, r)
+			resp = rerror(fmt.Errorf("internal error: %v", r))
+		}
+	}()
+	return c.handle(req)
+}
+
+func (c *conn) hangup() {
+	defer c.rw.Close()
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	for num := range c.fids {
+		c.clunk(num)
+	}
+}
+
+func rerror(err error) *Fcall {
+	return &Fcall{
+		Type:  Rerror,
+		Ename: err.Error(),
+	}
+}
+
+func (c *conn) handle(req *Fcall) *Fcall {
+	var resp *Fcall
+	var err error
+
+	switch req.Type {
+	case Tversion:
+		resp, err = c.version(req)
+	case Tauth:
+		err = errors.New("authentication not required")
+	case Tattach:
+		resp, err = c.attach(req)
+	case Tflush:
+		// Requests are answered in order, so anything
+		// being flushed has already been answered
+		resp = &Fcall{Type: Rflush}
+	case Twalk:
+		resp, err = c.walk(req)
+	case Topen:
+		resp, err = c.open(req)
+	case Tcreate:
+		resp, err = c.create(req)
+	case Tread:
+		resp, err = c.read(req)
+	case Twrite:
+		resp, err = c.write(req)
+	case Tclunk:
+		err = c.clunk(req.Fid)
+		resp = &Fcall{Type: Rclunk}
+	case Tremove:
+		resp, err = c.remove(req)
+	case Tstat:
+		resp, err = c.stat(req)
+	case Twstat:
+		resp, err = c.wstat(req)
+	default:
+		err = errors.New("bad message type")
+	}
+
+	if err != nil {
+		return rerror(err)
+	}
+	return resp
+}
+
+func (c *conn) getFid(num uint32) (*fid, error) {
+	f, ok := c.fids[num]
+	if !ok {
+		return nil, errors.New("unknown fid")
+	}
+	return f, nil
+}
+
+// Builds the 9P view of whatever is at p
+func dirOf(fsys *fs.Filesystem, p string) (*Dir, error) {
+	st, err := fsys.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// 9P names owners, pp2 numbers them
+	uid := strconv.FormatUint(uint64(st.Uid), 10)
+	d := &Dir{
+		Qid:    qidOf(st),
+		Mode:   uint32(st.Perm),
+		Atime:  uint32(st.Atime.Unix()),
+		Mtime:  uint32(st.Mtime.Unix()),
+		Length: uint64(st.Size),
+		Name:   path.Base(p),
+		Uid:    uid,
+		Gid:    strconv.FormatUint(uint64(st.Gid), 10),
+		Muid:   uid,
+	}
+	if st.Mode == inode.Dir {
+		d.Mode |= DMDIR
+		d.Length = 0
+	}
+	return d, nil
+}
+
+// The qid's path is the file's handle, so a file
+// made in a reused inode gets a different one
+func qidOf(st *fs.Stat) Qid {
+	q := Qid{
+		Type:    QTFILE,
+		Version: uint32(st.Mtime.UnixNano()),
+		Path:    st.Handle.Uint64(),
+	}
+	if st.Mode == inode.Dir {
+		q.Type = QTDIR
+	}
+	return q
+}
+
+// dirOf for what's at the fid's path, which has
+// to still be the file the fid was walked to
+func (c *conn) dirOfFid(f *fid) (*Dir, error) {
+	d, err := dirOf(f.fs, f.path)
+	if err == fs.ErrNotExist || (err == nil && d.Qid.Path != f.qid.Path) {
+		return nil, fs.ErrStale
+	}
+	return d, err
+}
+
+func (c *conn) version(req *Fcall) (*Fcall, error) {
+	if req.Msize < minMsize {
+		return nil, errors.New("msize too small")
+	}
+
+	// A version message resets the session
+	for num := range c.fids {
+		c.clunk(num)
+	}
+
+	c.msize = req.Msize
+	if c.msize > maxMsize {
+		c.msize = maxMsize
+	}
+	v := "unknown"
+	if strings.HasPrefix(req.Version, "9P2000") {
+		v = "9P2000"
+	}
+	return &Fcall{
+		Type:    Rversion,
+		Msize:   c.msize,
+		Version: v,
+	}, nil
+}
+
+func (c *conn) attach(req *Fcall) (*Fcall, error) {
+	if _, ok := c.fids[req.Fid]; ok {
+		return nil, errors.New("fid in use")
+	}
+	cred, err := c.s.credOf(req.Uname)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys := c.s.fs.As(cred)
+	d, err := dirOf(fsys, "/")
+	if err != nil {
+		return nil, err
+	}
+	c.fids[req.Fid] = &fid{fs: fsys, path: "/", qid: d.Qid}
+	return &Fcall{Type: Rattach, Qid: d.Qid}, nil
+}
+
+// Who uname acts as: a user name or uid known to this
+// machine, with its groups. Nothing checks that the
+// client is who it says, so a server not running as
+// root only lets its own user in. Clients apply their
+// own umask to the bits in a create, so there's none
+func (s *Server) credOf(uname string) (fs.Cred, error) {
+	u, err := user.Lookup(uname)
+	if err != nil {
+		u, err = user.LookupId(uname)
+	}
+	if err != nil {
+		return fs.Cred{}, fmt.Errorf("unknown user %s", uname)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return fs.Cred{}, fmt.Errorf("unknown user %s", uname)
+	}
+
+	me := s.fs.Cred()
+	me.Umask = 0
+	if uint32(uid) == me.Uid {
+		return me, nil
+	} else if me.Uid != 0 {
+		return fs.Cred{}, fs.ErrPerm
+	}
+
+	cred := fs.Cred{Uid: uint32(uid), Umask: me.Umask}
+	if gid, err := strconv.ParseUint(u.Gid, 10, 32); err == nil {
+		cred.Gid = uint32(gid)
+	}
+	gids, _ := u.GroupIds()
+	for _, g := range gids {
+		if gid, err := strconv.ParseUint(g, 10, 32); err == nil && uint32(gid) != cred.Gid {
+			cred.Groups = append(cred.Groups, uint32(gid))
+		}
+	}
+	return cred, nil
+}
+
+func (c *conn) walk(req *Fcall) (*Fcall, error) {
+	f, err := c.getFid(req.Fid)
+	if err != nil {
+		return nil, err
+	} else if f.open {
+		return nil, errors.New("fid is open")
+	} else if _, ok := c.fids[req.Newfid]; ok && req.Newfid != req.Fid {
+		return nil, errors.New("fid in use")
+	}
+
+	p := f.path
+	q := f.qid
+	qids := []Qid{}
+	for idx, name := range req.Wnames {
+		if q.Type&QTDIR == 0 {
+			err = errors.New("not a directory")
+		} else {
+			var d *Dir
+			d, err = dirOf(f.fs, path.Join(p, name))
+			if err == nil {
+				p = path.Join(p, name)
+				q = d.Qid
+				qids = append(qids, q)
+			}
+		}
+
+		if err != nil {
+			// Only the first step failing is an error,
+			// otherwise the short qid list says where
+			if idx == 0 {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	if len(qids) == len(req.Wnames) {
+		c.fids[req.Newfid] = &fid{fs: f.fs, path: p, qid: q}
+	}
+	return &Fcall{Type: Rwalk, Wqids: qids}, nil
+}
+
+// Fills in the listing for a directory fid
+func (c *conn) snapshotDir(f *fid) error {
+	ents, err := f.fs.ReadDir(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.dirents = []byte{}
+	for _, ent := range ents {
+		d, err := dirOf(f.fs, path.Join(f.path, ent.Name))
+		if err != nil {
+			// Gone since we listed it
+			continue
+		}
+		f.dirents = append(f.dirents, d.Bytes()...)
+	}
+	return nil
+}
+
+// Maps a 9P open mode onto fs.Open flags
+func openFlags(mode uint8) int {
+	flags := fs.O_RDONLY
+	switch mode & 3 {
+	case OWRITE:
+		flags = fs.O_WRONLY
+	case ORDWR:
+		flags = fs.O_RDWR
+	}
+	if mode&OTRUNC != 0 {
+		flags |= fs.O_TRUNC
+	}
+	return flags
+}
+
+func (c *conn) open(req *Fcall) (*Fcall, error) {
+	f, err := c.getFid(req.Fid)
+	if err != nil {
+		return nil, err
+	} else if f.open {
+		return nil, errors.New("fid already open")
+	}
+
+	if f.qid.Type&QTDIR != 0 {
+		if req.Mode&3 != OREAD {
+			return nil, errors.New("is a directory")
+		}
+		if _, err := c.dirOfFid(f); err != nil {
+			return nil, err
+		}
+		if err := c.snapshotDir(f); err != nil {
+			return nil, err
+		}
+	} else {
+		h := fs.HandleFromUint64(f.qid.Path)
+		fd, err := f.fs.OpenHandle(h, openFlags(req.Mode))
+		if err != nil {
+			return nil, err
+		}
+		f.fd = fd
+	}
+
+	f.open = true
+	f.mode = req.Mode
+	return &Fcall{
+		Type:   Ropen,
+		Qid:    f.qid,
+		Iounit: c.msize - ioHdrSz,
+	}, nil
+}
+
+func (c *conn) create(req *Fcall) (*Fcall, error) {
+	f, err := c.getFid(req.Fid)
+	if err != nil {
+		return nil, err
+	} else if f.open {
+		return nil, errors.New("fid already open")
+	} else if f.qid.Type&QTDIR == 0 {
+		return nil, errors.New("not a directory")
+	}
+
+	p := path.Join(f.path, req.Name)
+	if req.Name == "." || req.Name == ".." || strings.Contains(req.Name, "/") {
+		return nil, errors.New("invalid file name")
+	}
+	dir, err := c.dirOfFid(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// The new file only gets the bits its directory
+	// has, bar execute on files, which it keeps
+	perm := req.Perm & (^uint32(0666) | dir.Mode&0666)
+	if req.Perm&DMDIR != 0 {
+		perm = req.Perm & (^uint32(0777) | dir.Mode&0777)
+	}
+
+	// The fid now stands for the new file, opened
+	nf := &fid{fs: f.fs, path: p, open: true, mode: req.Mode}
+	if req.Perm&DMDIR != 0 {
+		if err := f.fs.MkdirPerm(p, uint16(perm&0777)); err != nil {
+			return nil, err
+		}
+		nf.dirents = []byte{}
+	} else {
+		fd, err := f.fs.OpenPerm(p, openFlags(req.Mode)|fs.O_CREAT|fs.O_EXCL, uint16(perm&0777))
+		if err != nil {
+			return nil, err
+		}
+		nf.fd = fd
+	}
+
+	d, err := dirOf(f.fs, p)
+	if err != nil {
+		return nil, err
+	}
+	nf.qid = d.Qid
+	c.fids[req.Fid] = nf
+	return &Fcall{
+		Type:   Rcreate,
+		Qid:    nf.qid,
+		Iounit: c.msize - ioHdrSz,
+	}, nil
+}
+
+func (c *conn) read(req *Fcall) (*Fcall, error) {
+	f, err := c.getFid(req.Fid)
+	if err != nil {
+		return nil, err
+	} else if !f.open || f.mode&3 == OWRITE {
+		return nil, errors.New("fid not open for reading")
+	}
+
+	count := req.Count
+	if count > c.msize-ioHdrSz {
+		count = c.msize - ioHdrSz
+	}
+
+	if f.qid.Type&QTDIR != 0 {
+		// Hand back whole entries only
+		if req.Offset != 0 && req.Offset != f.diroff {
+			return nil, errors.New("bad offset in directory read")
+		}
+		rest := f.dirents[req.Offset:]
+		n := 0
+		for n+1 < len(rest) {
+			sz := 2 + int(rest[n]) + int(rest[n+1])<<8
+			if n+sz > len(rest) || uint32(n+sz) > count {
+				break
+			}
+			n += sz
+		}
+		f.diroff = req.Offset + uint64(n)
+		return &Fcall{Type: Rread, Data: rest[:n]}, nil
+	}
+
+	data, err := f.fs.ReadAt(f.fd, uint(req.Offset), uint(count))
+	if err != nil {
+		return nil, err
+	}
+	return &Fcall{Type: Rread, Data: []byte(data)}, nil
+}
+
+func (c *conn) write(req *Fcall) (*Fcall, error) {
+	f, err := c.getFid(req.Fid)
+	if err != nil {
+		return nil, err
+	} else if !f.open || f.mode&3 == OREAD || f.mode&3 == OEXEC {
+		return nil, errors.New("fid not open for writing")
+	} else if f.qid.Type&QTDIR != 0 {
+		return nil, errors.New("is a directory")
+	}
+
+	cnt, err := f.fs.WriteAt(f.fd, uint(req.Offset), string(req.Data))
+	if err != nil {
+		return nil, err
+	}
+	return &Fcall{Type: Rwrite, Count: uint32(cnt)}, nil
+}
+
+func (c *conn) clunk(num uint32) error {
+	f, err := c.getFid(num)
+	if err != nil {
+		return err
+	}
+	if f.open && f.qid.Type&QTDIR == 0 {
+		f.fs.Close(f.fd)
+	}
+	delete(c.fids, num)
+	return nil
+}
+
+func (c *conn) remove(req *Fcall) (*Fcall, error) {
+	f, err := c.getFid(req.Fid)
+	if err != nil {
+		return nil, err
+	}
+
+	// The fid goes away whether or not this works
+	p, isDir := f.path, f.qid.Type&QTDIR != 0
+	_, err = c.dirOfFid(f)
+	c.clunk(req.Fid)
+	if err != nil {
+		return nil, err
+	} else if p == "/" {
+		return nil, errors.New("can't remove the root")
+	} else if isDir {
+		err = f.fs.Rmdir(p)
+	} else {
+		err = f.fs.Unlink(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Fcall{Type: Rremove}, nil
+}
+
+func (c *conn) stat(req *Fcall) (*Fcall, error) {
+	f, err := c.getFid(req.Fid)
+	if err != nil {
+		return nil, err
+	}
+	d, err := c.dirOfFid(f)
+	if err != nil {
+		return nil, err
+	}
+	return &Fcall{Type: Rstat, Stat: d.Bytes()}, nil
+}
+
+// Changes the length, mode bits and name, renaming
+// within the same directory only; nothing else can
+// be changed. Everything is checked first, then made
+// in one transaction, so either it all happens or
+// none of it does
+func (c *conn) wstat(req *Fcall) (*Fcall, error) {
+	f, err := c.getFid(req.Fid)
+	if err != nil {
+		return nil, err
+	}
+	d, err := UnmarshalDir(req.Stat)
+	if err != nil {
+		return nil, err
+	} else if _, err := c.dirOfFid(f); err != nil {
+		return nil, err
+	}
+
+	isDir := f.qid.Type&QTDIR != 0
+	setLength := d.Length != ^uint64(0)
+	setMode := d.Mode != ^uint32(0)
+	rename := d.Name != "" && d.Name != path.Base(f.path)
+	if setLength && isDir {
+		return nil, errors.New("can't change a directory's length")
+	} else if setMode && (d.Mode&DMDIR != 0) != isDir {
+		return nil, errors.New("can't change a file's type")
+	} else if rename && f.path == "/" {
+		return nil, errors.New("can't rename the root")
+	} else if rename && (d.Name == "." || d.Name == ".." || strings.Contains(d.Name, "/")) {
+		return nil, errors.New("invalid file name")
+	}
+
+	p := f.path
+	x := f.fs.Begin()
+	if rename {
+		p = path.Join(path.Dir(f.path), d.Name)
+		err = x.Rename(f.path, p)
+	}
+	if err == nil && setLength {
+		err = x.Truncate(p, uint(d.Length))
+	}
+	if err == nil && setMode {
+		err = x.Chmod(p, uint16(d.Mode&0777))
+	}
+	if err != nil {
+		// Some failures already aborted it
+		x.Abort()
+		return nil, err
+	}
+	x.Commit()
+	f.path = p
+	return &Fcall{Type: Rwstat}, nil
+}
@@ -0,0 +1,487 @@
+package ninep
+
+import (
+	"net"
+	"pp2/balloc"
+	"pp2/bio"
+	"pp2/fs"
+	"pp2/inode"
+	"pp2/jrnl"
+	"pp2/quota"
+	"testing"
+)
+
+// Drives the server over loopback TCP with
+// hand-built messages, on top of the mock disk
+
+// Partitions:
+//	-> Version/Attach
+//		-> 9P2000, anything else
+//		-> msize too small (=FAIL), message past msize (=FAIL)
+//		-> as root, as another user, unknown user (=FAIL)
+//		-> server not root: as its own user, as anyone else (=FAIL)
+//	-> Unmarshal
+//		-> count past the end of the message (=FAIL)
+//	-> Walk
+//		-> zero names (clone), one, many
+//		-> first name missing (=FAIL), later name missing
+//	-> Create/Open/Read/Write/Clunk
+//		-> file, directory
+//		-> create existing (=FAIL), open with OTRUNC
+//		-> create perm, limited by the directory's bits
+//		-> directory read at 0, where the last stopped, elsewhere (=FAIL)
+//	-> Stat/Wstat
+//		-> stat file, stat dir, rename
+//		-> later change fails, bad change (=FAIL, nothing changed)
+//	-> Remove
+//		-> file, dir
+//	-> Stale fids
+//		-> file removed and its inode reused: open, stat (=FAIL)
+//	-> Panics
+//		-> request that panics (=FAIL), then others on any connection
+
+type client struct {
+	tt  *testing.T
+	l   net.Listener
+	c   net.Conn
+	tag uint16
+}
+
+func initUut(tt *testing.T) *client {
+	return initUutAs(tt, fs.RootCred)
+}
+
+// A server running as cred
+func initUutAs(tt *testing.T, cred fs.Cred) *client {
+	bio.Binit("", true)
+	jrnl.InitSb()
+	balloc.InitBalloc(inode.EndInode)
+	quota.InitQuota(balloc.EndData())
+	inode.InodeInit()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tt.Fatalf("failed to listen: %s", err)
+	}
+	go NewServer(fs.Mount(cred)).Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tt.Fatalf("failed to dial: %s", err)
+	}
+	return &client{tt: tt, l: l, c: c}
+}
+
+func (c *client) close() {
+	c.c.Close()
+	c.l.Close()
+}
+
+func (c *client) rpc(req *Fcall) *Fcall {
+	c.tag++
+	req.Tag = c.tag
+	if _, err := c.c.Write(req.Bytes()); err != nil {
+		c.tt.Fatalf("failed to send: %s", err)
+	}
+	resp, err := ReadFcall(c.c, maxMsize)
+	if err != nil {
+		c.tt.Fatalf("failed to receive: %s", err)
+	} else if resp.Tag != req.Tag {
+		c.tt.Fatalf("got tag %d for request %d", resp.Tag, req.Tag)
+	}
+	return resp
+}
+
+// Fails the test unless resp is of type want
+func (c *client) expect(resp *Fcall, want uint8) *Fcall {
+	c.tt.Helper()
+	if resp.Type == Rerror {
+		c.tt.Fatalf("got error %q, wanted message %d", resp.Ename, want)
+	} else if resp.Type != want {
+		c.tt.Fatalf("got message %d, wanted %d", resp.Type, want)
+	}
+	return resp
+}
+
+func (c *client) attach() {
+	r := c.expect(c.rpc(&Fcall{Type: Tversion, Msize: 8192, Version: "9P2000"}), Rversion)
+	if r.Version != "9P2000" || r.Msize != 8192 {
+		c.tt.Fatalf("bad version reply %v", *r)
+	}
+	c.expect(c.rpc(&Fcall{Type: Tattach, Fid: 0, Afid: NoFid, Uname: "root"}), Rattach)
+}
+
+// Covers:
+//	-> version/9p2000
+//	-> version/other
+//	-> version/smallmsize
+//	-> version/overmsize
+func TestVersion(tt *testing.T) {
+	c := initUut(tt)
+	defer c.close()
+	if c.rpc(&Fcall{Type: Tversion, Msize: 16, Version: "9P2000"}).Type != Rerror {
+		tt.Errorf("took an msize too small for any I/O")
+	}
+	r := c.expect(c.rpc(&Fcall{Type: Tversion, Msize: 1 << 20, Version: "9P1999"}), Rversion)
+	if r.Version != "unknown" || r.Msize != maxMsize {
+		tt.Errorf("bad version reply %v", *r)
+	}
+	c.attach()
+
+	// Past the negotiated msize, the client is dropped
+	big := &Fcall{Type: Twrite, Tag: 1, Data: make([]byte, 8192)}
+	c.c.Write(big.Bytes())
+	if _, err := ReadFcall(c.c, maxMsize); err == nil {
+		tt.Errorf("answered a message bigger than msize")
+	}
+}
+
+// Covers:
+//	-> unmarshal/shortcount
+func TestUnmarshalShort(tt *testing.T) {
+	// A write claiming 4GB of data with none there
+	b := (&Fcall{Type: Twrite, Fid: 1}).Bytes()
+	b[len(b)-4], b[len(b)-3], b[len(b)-2], b[len(b)-1] = 0xff, 0xff, 0xff, 0xff
+	if _, err := UnmarshalFcall(b); err != errShort {
+		tt.Errorf("got %v for a short write vs. expected errShort", err)
+	}
+
+	// Every field of a stat cut short
+	d := (&Dir{Name: "name", Uid: "1"}).Bytes()
+	for n := 0; n < len(d); n++ {
+		if _, err := UnmarshalDir(d[:n]); err != errShort {
+			tt.Errorf("got %v for a stat cut to %d bytes", err, n)
+		}
+	}
+}
+
+// Covers:
+//	-> walk/clone
+//	-> walk/one
+//	-> walk/many
+//	-> walk/firstmissing
+//	-> walk/latermissing
+//	-> create/file
+//	-> create/dir
+//	-> read/file
+//	-> write/file
+//	-> create/existing
+//	-> open/trunc
+func TestReadWrite(tt *testing.T) {
+	c := initUut(tt)
+	defer c.close()
+	c.attach()
+
+	// mkdir /d, then create /d/f and write to it
+	c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 1}), Rwalk)
+	c.expect(c.rpc(&Fcall{Type: Tcreate, Fid: 1, Name: "d", Perm: DMDIR | 0755, Mode: OREAD}), Rcreate)
+	c.expect(c.rpc(&Fcall{Type: Tclunk, Fid: 1}), Rclunk)
+
+	c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 1, Wnames: []string{"d"}}), Rwalk)
+	c.expect(c.rpc(&Fcall{Type: Tcreate, Fid: 1, Name: "f", Perm: 0644, Mode: ORDWR}), Rcreate)
+	w := c.expect(c.rpc(&Fcall{Type: Twrite, Fid: 1, Offset: 0, Data: []byte("hello 9p")}), Rwrite)
+	if w.Count != 8 {
+		tt.Errorf("wrote %d bytes, wanted 8", w.Count)
+	}
+	c.expect(c.rpc(&Fcall{Type: Tclunk, Fid: 1}), Rclunk)
+
+	// Read it back from a fresh walk
+	r := c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 2, Wnames: []string{"d", "f"}}), Rwalk)
+	if len(r.Wqids) != 2 || r.Wqids[0].Type != QTDIR || r.Wqids[1].Type != QTFILE {
+		tt.Errorf("bad qids %v", r.Wqids)
+	}
+	c.expect(c.rpc(&Fcall{Type: Topen, Fid: 2, Mode: OREAD}), Ropen)
+	r = c.expect(c.rpc(&Fcall{Type: Tread, Fid: 2, Offset: 6, Count: 100}), Rread)
+	if string(r.Data) != "9p" {
+		tt.Errorf("read %q, wanted 9p", r.Data)
+	}
+	if c.rpc(&Fcall{Type: Twrite, Fid: 2, Data: []byte("x")}).Type != Rerror {
+		tt.Errorf("wrote to a fid opened for reading")
+	}
+	c.expect(c.rpc(&Fcall{Type: Tclunk, Fid: 2}), Rclunk)
+
+	c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 2, Wnames: []string{"d"}}), Rwalk)
+	if c.rpc(&Fcall{Type: Tcreate, Fid: 2, Name: "f", Perm: 0644, Mode: ORDWR}).Type != Rerror {
+		tt.Errorf("created over an existing file")
+	}
+	c.expect(c.rpc(&Fcall{Type: Tclunk, Fid: 2}), Rclunk)
+
+	c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 2, Wnames: []string{"d", "f"}}), Rwalk)
+	c.expect(c.rpc(&Fcall{Type: Topen, Fid: 2, Mode: OWRITE | OTRUNC}), Ropen)
+	r = c.expect(c.rpc(&Fcall{Type: Tstat, Fid: 2}), Rstat)
+	if d, _ := UnmarshalDir(r.Stat); d.Length != 0 {
+		tt.Errorf("length %d after OTRUNC, wanted 0", d.Length)
+	}
+	c.expect(c.rpc(&Fcall{Type: Tclunk, Fid: 2}), Rclunk)
+
+	if c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 3, Wnames: []string{"nope"}}).Type != Rerror {
+		tt.Errorf("walked to a missing file")
+	}
+	r = c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 3, Wnames: []string{"d", "nope"}}), Rwalk)
+	if len(r.Wqids) != 1 {
+		tt.Errorf("partial walk gave %d qids, wanted 1", len(r.Wqids))
+	}
+	if c.rpc(&Fcall{Type: Tstat, Fid: 3}).Type != Rerror {
+		tt.Errorf("partial walk made a fid")
+	}
+}
+
+// Covers:
+//	-> read/dir
+//	-> stat/file
+//	-> stat/dir
+//	-> wstat/rename
+//	-> remove/file
+//	-> remove/dir
+//	-> read/diroffset
+func TestDirsAndStat(tt *testing.T) {
+	c := initUut(tt)
+	defer c.close()
+	c.attach()
+
+	for idx, name := range []string{"a", "b"} {
+		nf := uint32(idx + 1)
+		c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: nf}), Rwalk)
+		c.expect(c.rpc(&Fcall{Type: Tcreate, Fid: nf, Name: name, Perm: 0644, Mode: OWRITE}), Rcreate)
+		c.expect(c.rpc(&Fcall{Type: Twrite, Fid: nf, Data: []byte(name + name)}), Rwrite)
+		c.expect(c.rpc(&Fcall{Type: Tclunk, Fid: nf}), Rclunk)
+	}
+
+	// List the root
+	c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 1}), Rwalk)
+	c.expect(c.rpc(&Fcall{Type: Topen, Fid: 1, Mode: OREAD}), Ropen)
+	r := c.expect(c.rpc(&Fcall{Type: Tread, Fid: 1, Offset: 0, Count: 8192}), Rread)
+	names := []string{}
+	for b := r.Data; len(b) > 0; {
+		sz := 2 + int(b[0]) + int(b[1])<<8
+		d, err := UnmarshalDir(b[:sz])
+		if err != nil {
+			tt.Fatalf("bad directory entry: %s", err)
+		}
+		names = append(names, d.Name)
+		if d.Length != 2 {
+			tt.Errorf("%s has length %d, wanted 2", d.Name, d.Length)
+		}
+		b = b[sz:]
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		tt.Errorf("listed %v, wanted [a b]", names)
+	}
+	end := uint64(len(r.Data))
+	if c.rpc(&Fcall{Type: Tread, Fid: 1, Offset: 1, Count: 8192}).Type != Rerror {
+		tt.Errorf("read a directory from the middle of an entry")
+	}
+	r = c.expect(c.rpc(&Fcall{Type: Tread, Fid: 1, Offset: 0, Count: 8192}), Rread)
+	if uint64(len(r.Data)) != end {
+		tt.Errorf("reread %d bytes of the listing, wanted %d", len(r.Data), end)
+	}
+	r = c.expect(c.rpc(&Fcall{Type: Tread, Fid: 1, Offset: end, Count: 8192}), Rread)
+	if len(r.Data) != 0 {
+		tt.Errorf("read past the end of the listing")
+	}
+	c.expect(c.rpc(&Fcall{Type: Tclunk, Fid: 1}), Rclunk)
+
+	r = c.expect(c.rpc(&Fcall{Type: Tstat, Fid: 0}), Rstat)
+	if d, _ := UnmarshalDir(r.Stat); d.Mode&DMDIR == 0 {
+		tt.Errorf("root isn't a directory: %v", *d)
+	}
+
+	// Rename a -> c through wstat
+	c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 1, Wnames: []string{"a"}}), Rwalk)
+	nd := &Dir{Name: "c", Length: ^uint64(0), Mode: ^uint32(0)}
+	c.expect(c.rpc(&Fcall{Type: Twstat, Fid: 1, Stat: nd.Bytes()}), Rwstat)
+	r = c.expect(c.rpc(&Fcall{Type: Tstat, Fid: 1}), Rstat)
+	if d, _ := UnmarshalDir(r.Stat); d.Name != "c" || d.Length != 2 {
+		tt.Errorf("bad stat after rename: %v", *d)
+	}
+
+	c.expect(c.rpc(&Fcall{Type: Tremove, Fid: 1}), Rremove)
+	if c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 1, Wnames: []string{"c"}}).Type != Rerror {
+		tt.Errorf("walked to a removed file")
+	}
+
+	c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 1}), Rwalk)
+	c.expect(c.rpc(&Fcall{Type: Tcreate, Fid: 1, Name: "d", Perm: DMDIR | 0755, Mode: OREAD}), Rcreate)
+	c.expect(c.rpc(&Fcall{Type: Tremove, Fid: 1}), Rremove)
+	if c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 1, Wnames: []string{"d"}}).Type != Rerror {
+		tt.Errorf("walked to a removed directory")
+	}
+}
+
+// Covers:
+//	-> stale/open
+//	-> stale/stat
+func TestStaleFid(tt *testing.T) {
+	c := initUut(tt)
+	defer c.close()
+	c.attach()
+
+	c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 1}), Rwalk)
+	c.expect(c.rpc(&Fcall{Type: Tcreate, Fid: 1, Name: "f", Perm: 0644, Mode: OWRITE}), Rcreate)
+	c.expect(c.rpc(&Fcall{Type: Tclunk, Fid: 1}), Rclunk)
+	r := c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 2, Wnames: []string{"f"}}), Rwalk)
+	old := r.Wqids[0]
+
+	// Remove f and make a new one, which gets its inode
+	c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 1, Wnames: []string{"f"}}), Rwalk)
+	c.expect(c.rpc(&Fcall{Type: Tremove, Fid: 1}), Rremove)
+	c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 1}), Rwalk)
+	r = c.expect(c.rpc(&Fcall{Type: Tcreate, Fid: 1, Name: "f", Perm: 0644, Mode: OWRITE}), Rcreate)
+	c.expect(c.rpc(&Fcall{Type: Twrite, Fid: 1, Data: []byte("new")}), Rwrite)
+	c.expect(c.rpc(&Fcall{Type: Tclunk, Fid: 1}), Rclunk)
+	if uint16(r.Qid.Path) != uint16(old.Path) || r.Qid.Path == old.Path {
+		tt.Errorf("new file has qid path %x, old one %x", r.Qid.Path, old.Path)
+	}
+
+	for _, req := range []*Fcall{
+		{Type: Topen, Fid: 2, Mode: OREAD},
+		{Type: Tstat, Fid: 2},
+	} {
+		r = c.rpc(req)
+		if r.Type != Rerror || r.Ename != fs.ErrStale.Error() {
+			tt.Errorf("got message %d (%q) for a stale fid", r.Type, r.Ename)
+		}
+	}
+}
+
+// Covers:
+//	-> attach/root
+//	-> attach/other
+//	-> attach/unknown
+//	-> attach/notroot
+func TestAttachUsers(tt *testing.T) {
+	c := initUut(tt)
+	defer c.close()
+	c.attach()
+
+	// New files belong to whoever attached
+	c.expect(c.rpc(&Fcall{Type: Tattach, Fid: 1, Afid: NoFid, Uname: "nobody"}), Rattach)
+	c.expect(c.rpc(&Fcall{Type: Tcreate, Fid: 1, Name: "f", Perm: 0600, Mode: OWRITE}), Rcreate)
+	r := c.expect(c.rpc(&Fcall{Type: Tstat, Fid: 1}), Rstat)
+	if d, _ := UnmarshalDir(r.Stat); d.Uid != "65534" {
+		tt.Errorf("file made as nobody belongs to %s", d.Uid)
+	}
+	c.expect(c.rpc(&Fcall{Type: Tclunk, Fid: 1}), Rclunk)
+
+	// Which is held to the file's bits, unlike root
+	c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 1, Wnames: []string{"f"}}), Rwalk)
+	c.expect(c.rpc(&Fcall{Type: Twstat, Fid: 1, Stat: (&Dir{Length: ^uint64(0), Mode: 0}).Bytes()}), Rwstat)
+	c.expect(c.rpc(&Fcall{Type: Topen, Fid: 1, Mode: OREAD}), Ropen)
+	c.expect(c.rpc(&Fcall{Type: Tattach, Fid: 2, Afid: NoFid, Uname: "nobody"}), Rattach)
+	c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 2, Newfid: 3, Wnames: []string{"f"}}), Rwalk)
+	if r := c.rpc(&Fcall{Type: Topen, Fid: 3, Mode: OREAD}); r.Type != Rerror || r.Ename != fs.ErrPerm.Error() {
+		tt.Errorf("got message %d (%q) opening a file with no bits as nobody", r.Type, r.Ename)
+	}
+
+	if c.rpc(&Fcall{Type: Tattach, Fid: 4, Afid: NoFid, Uname: "no such user"}).Type != Rerror {
+		tt.Errorf("attached as a user that doesn't exist")
+	}
+	c.close()
+
+	// A server that isn't root can't act as anyone else
+	c = initUutAs(tt, fs.Cred{Uid: 65534, Gid: 65534, Umask: 022})
+	defer c.close()
+	c.expect(c.rpc(&Fcall{Type: Tattach, Fid: 0, Afid: NoFid, Uname: "nobody"}), Rattach)
+	if r := c.rpc(&Fcall{Type: Tattach, Fid: 1, Afid: NoFid, Uname: "root"}); r.Type != Rerror {
+		tt.Errorf("attached as root to a server run by nobody")
+	}
+}
+
+// Covers:
+//	-> create/perm
+func TestCreatePerm(tt *testing.T) {
+	c := initUut(tt)
+	defer c.close()
+	c.attach()
+
+	for _, tc := range []struct {
+		dir  string
+		name string
+		perm uint32
+		want uint32
+	}{
+		{"", "f", 0600, 0600},
+		{"", "d", DMDIR | 0750, DMDIR | 0750},
+		{"d", "exec", 0777, 0751},
+		{"d", "sub", DMDIR | 0777, DMDIR | 0750},
+	} {
+		wnames := []string{}
+		if tc.dir != "" {
+			wnames = append(wnames, tc.dir)
+		}
+		c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 0, Newfid: 1, Wnames: wnames}), Rwalk)
+		c.expect(c.rpc(&Fcall{Type: Tcreate, Fid: 1, Name: tc.name, Perm: tc.perm, Mode: OREAD}), Rcreate)
+		r := c.expect(c.rpc(&Fcall{Type: Tstat, Fid: 1}), Rstat)
+		if d, _ := UnmarshalDir(r.Stat); d.Mode != tc.want {
+			tt.Errorf("%s made with %o has mode %o, wanted %o", tc.name, tc.perm, d.Mode, tc.want)
+		}
+		c.expect(c.rpc(&Fcall{Type: Tclunk, Fid: 1}), Rclunk)
+	}
+}
+
+// Covers:
+//	-> wstat/laterfails
+//	-> wstat/bad
+func TestWstatAtomic(tt *testing.T) {
+	c := initUut(tt)
+	defer c.close()
+	c.attach()
+
+	// As nobody, so the file's bits hold them back
+	c.expect(c.rpc(&Fcall{Type: Tattach, Fid: 1, Afid: NoFid, Uname: "nobody"}), Rattach)
+	c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 1, Newfid: 2}), Rwalk)
+	c.expect(c.rpc(&Fcall{Type: Tcreate, Fid: 2, Name: "f", Perm: 0644, Mode: OWRITE}), Rcreate)
+	c.expect(c.rpc(&Fcall{Type: Twrite, Fid: 2, Data: []byte("data")}), Rwrite)
+	c.expect(c.rpc(&Fcall{Type: Tclunk, Fid: 2}), Rclunk)
+	c.expect(c.rpc(&Fcall{Type: Twalk, Fid: 1, Newfid: 2, Wnames: []string{"f"}}), Rwalk)
+	c.expect(c.rpc(&Fcall{Type: Twstat, Fid: 2, Stat: (&Dir{Length: ^uint64(0), Mode: 0444}).Bytes()}), Rwstat)
+
+	// The rename goes through, then truncating a
+	// read-only file fails, taking the rename with it
+	for _, nd := range []*Dir{
+		{Name: "g", Length: 0, Mode: ^uint32(0)},
+		{Name: "g", Length: ^uint64(0), Mode: DMDIR | 0755},
+		{Name: "..", Length: ^uint64(0), Mode: ^uint32(0)},
+	} {
+		if r := c.rpc(&Fcall{Type: Twstat, Fid: 2, Stat: nd.Bytes()}); r.Type != Rerror {
+			tt.Errorf("wstat of %v went through", *nd)
+		}
+		r := c.expect(c.rpc(&Fcall{Type: Tstat, Fid: 2}), Rstat)
+		if d, _ := UnmarshalDir(r.Stat); d.Name != "f" || d.Length != 4 || d.Mode != 0444 {
+			tt.Errorf("failed wstat of %v left %v", *nd, *d)
+		}
+		if c.rpc(&Fcall{Type: Twalk, Fid: 1, Newfid: 3, Wnames: []string{"g"}}).Type != Rerror {
+			tt.Errorf("failed wstat of %v left g behind", *nd)
+		}
+	}
+}
+
+// Covers:
+//	-> panic/rerror
+func TestPanicReleasesLock(tt *testing.T) {
+	// With no filesystem, anything that touches
+	// one panics
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tt.Fatalf("failed to listen: %s", err)
+	}
+	go NewServer(nil).Serve(l)
+
+	var clients []*client
+	for i := 0; i < 2; i++ {
+		nc, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			tt.Fatalf("failed to dial: %s", err)
+		}
+		clients = append(clients, &client{tt: tt, l: l, c: nc})
+	}
+	defer clients[0].close()
+	defer clients[1].c.Close()
+
+	r := clients[0].rpc(&Fcall{Type: Tattach, Fid: 0, Afid: NoFid, Uname: "root"})
+	if r.Type != Rerror {
+		tt.Errorf("got message %d for a failed attach", r.Type)
+	}
+	clients[1].expect(clients[1].rpc(&Fcall{Type: Tversion, Msize: 8192, Version: "9P2000"}), Rversion)
+	clients[0].expect(clients[0].rpc(&Fcall{Type: Tversion, Msize: 8192, Version: "9P2000"}), Rversion)
+}
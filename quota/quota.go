@@ -0,0 +1,218 @@
+package quota
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"pp2/bio"
+	"pp2/jrnl"
+	"pp2/labgob"
+	"sort"
+)
+
+// Block and inode quotas. One block holds a table of
+// usage and limits, keyed by who's being charged: a
+// uid, or a directory tree. It's read and written
+// through the journal like the balloc bitmap, so a
+// charge commits or aborts along with whatever made
+// it. Only keys in the table are tracked at all, so
+// a volume without quotas pays one block fetch per
+// charge and nothing else
+
+var ErrQuota = errors.New("quota exceeded")
+
+type Usage struct {
+	Blocks     uint
+	Inodes     uint
+	BlockLimit uint // 0 for no limit
+	InodeLimit uint
+}
+
+var quotaBlock uint
+
+// Quotas stay off until this is called.
+// nr has to be outside every other region
+func InitQuota(nr uint) {
+	quotaBlock = nr
+}
+
+func UserKey(uid uint32) string {
+	return fmt.Sprintf("u%d", uid)
+}
+
+func TreeKey(inum uint16) string {
+	return fmt.Sprintf("t%d", inum)
+}
+
+func decode(data string) map[string]*Usage {
+	tbl := make(map[string]*Usage)
+	if data != "" {
+		dec := labgob.NewDecoder(bytes.NewBufferString(data))
+		dec.Decode(&tbl)
+	}
+	return tbl
+}
+
+func encode(tbl map[string]*Usage) string {
+	b := bytes.Buffer{}
+	labgob.NewEncoder(&b).Encode(tbl)
+	return b.String()
+}
+
+// Runs edit on the table through t, writing it back
+// if edit returns true. Like the bitmap, the block is
+// let go once the write is in t
+func update(t *jrnl.TxnHandle, edit func(map[string]*Usage) (bool, error)) error {
+	if quotaBlock == 0 {
+		return nil
+	}
+
+	blk := t.ReadBlock(quotaBlock)
+	tbl := decode(blk.Data)
+	changed, err := edit(tbl)
+	if err != nil || !changed {
+		blk.Brelse()
+		return err
+	}
+
+	blk.Data = encode(tbl)
+	if err := t.WriteBlock(blk); err != nil {
+		blk.Brelse()
+		return err
+	}
+	blk.Brelse()
+	return nil
+}
+
+// Adds blocks and inodes, either of which may be
+// negative, to every tracked key in keys. Fails with
+// ErrQuota, charging nobody, if that would take any
+// key over a limit. Giving back never fails on quota,
+// and usage never goes below zero
+func Charge(t *jrnl.TxnHandle, keys []string, blocks int, inodes int) error {
+	return charge(t, keys, blocks, inodes, true)
+}
+
+func charge(t *jrnl.TxnHandle, keys []string, blocks int, inodes int, enforce bool) error {
+	if blocks == 0 && inodes == 0 {
+		return nil
+	}
+	return update(t, func(tbl map[string]*Usage) (bool, error) {
+		tracked := []*Usage{}
+		for _, key := range keys {
+			if u, ok := tbl[key]; ok {
+				tracked = append(tracked, u)
+			}
+		}
+		if len(tracked) == 0 {
+			return false, nil
+		}
+
+		for _, u := range tracked {
+			if !enforce {
+				break
+			} else if blocks > 0 && u.BlockLimit > 0 && u.Blocks+uint(blocks) > u.BlockLimit {
+				return false, ErrQuota
+			} else if inodes > 0 && u.InodeLimit > 0 && u.Inodes+uint(inodes) > u.InodeLimit {
+				return false, ErrQuota
+			}
+		}
+		for _, u := range tracked {
+			u.Blocks = add(u.Blocks, blocks)
+			u.Inodes = add(u.Inodes, inodes)
+		}
+		return true, nil
+	})
+}
+
+func add(a uint, d int) uint {
+	if d < 0 && uint(-d) > a {
+		return 0
+	}
+	return uint(int(a) + d)
+}
+
+// Moves usage from one key to another regardless of
+// limits, e.g. when a file changes hands. Either key
+// may be "" for nobody
+func Move(t *jrnl.TxnHandle, from string, to string, blocks int, inodes int) error {
+	if from == to {
+		return nil
+	}
+	if err := charge(t, []string{from}, -blocks, -inodes, false); err != nil {
+		return err
+	}
+	return charge(t, []string{to}, blocks, inodes, false)
+}
+
+// Sets key's limits, starting to track it with the
+// given usage if it wasn't already. With no limits
+// at all, key stops being tracked
+func SetLimits(t *jrnl.TxnHandle, key string, blockLimit uint, inodeLimit uint, used Usage) error {
+	if quotaBlock == 0 {
+		return errors.New("quotas aren't enabled")
+	}
+	return update(t, func(tbl map[string]*Usage) (bool, error) {
+		if blockLimit == 0 && inodeLimit == 0 {
+			delete(tbl, key)
+			return true, nil
+		}
+		u, ok := tbl[key]
+		if !ok {
+			u = &Usage{Blocks: used.Blocks, Inodes: used.Inodes}
+			tbl[key] = u
+		}
+		u.BlockLimit = blockLimit
+		u.InodeLimit = inodeLimit
+		return true, nil
+	})
+}
+
+// For fsck: overwrites key's usage,
+// if it's tracked
+func SetUsage(t *jrnl.TxnHandle, key string, used Usage) error {
+	return update(t, func(tbl map[string]*Usage) (bool, error) {
+		u, ok := tbl[key]
+		if !ok {
+			return false, nil
+		}
+		u.Blocks = used.Blocks
+		u.Inodes = used.Inodes
+		return true, nil
+	})
+}
+
+// Whether key is tracked
+func Tracked(key string) bool {
+	_, ok := Snapshot()[key]
+	return ok
+}
+
+type Entry struct {
+	Key string
+	Usage
+}
+
+// Every tracked key
+func Snapshot() map[string]Usage {
+	res := make(map[string]Usage)
+	if quotaBlock == 0 {
+		return res
+	}
+	blk := bio.Bget(quotaBlock)
+	defer blk.Brelse()
+	for key, u := range decode(blk.Data) {
+		res[key] = *u
+	}
+	return res
+}
+
+// Snapshot, as a list sorted by key
+func List() []Entry {
+	res := []Entry{}
+	for key, u := range Snapshot() {
+		res = append(res, Entry{Key: key, Usage: u})
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].Key < res[b].Key })
+	return res
+}
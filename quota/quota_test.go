@@ -0,0 +1,123 @@
+package quota
+
+import (
+	"pp2/bio"
+	"pp2/jrnl"
+	"testing"
+)
+
+// Partitions
+//	-> Charge
+//		-> untracked key, tracked key, several keys
+//		-> under the limit, over it (=FAIL), no limit
+//		-> giving back, below zero
+//		-> aborted along with the transaction
+//	-> SetLimits
+//		-> new key, existing key, no limits left
+//	-> Move
+//		-> between tracked keys, over the limit
+
+func initUut() {
+	bio.Binit("", true)
+	jrnl.InitSb()
+	InitQuota(jrnl.EndJrnl + 1)
+}
+
+func mustSet(tt *testing.T, key string, blocks uint, inodes uint, used Usage) {
+	t := jrnl.BeginTransaction()
+	if err := SetLimits(t, key, blocks, inodes, used); err != nil {
+		tt.Fatalf("failed to set limits on %s: %s", key, err)
+	}
+	t.EndTransaction(false)
+}
+
+// Covers:
+//	-> charge/untracked, charge/tracked, charge/several
+//	-> charge/under, charge/over, charge/nolimit
+//	-> charge/giveback, charge/belowzero
+//	-> setlimits/new
+func TestCharge(tt *testing.T) {
+	initUut()
+	mustSet(tt, UserKey(1), 10, 0, Usage{Blocks: 2})
+	mustSet(tt, TreeKey(7), 0, 3, Usage{})
+
+	t := jrnl.BeginTransaction()
+	keys := []string{UserKey(1), TreeKey(7), UserKey(2)}
+	if err := Charge(t, keys, 8, 2); err != nil {
+		tt.Errorf("failed to charge up to the limit: %s", err)
+	}
+	if err := Charge(t, keys, 1, 0); err != ErrQuota {
+		tt.Errorf("got %v going over a block limit, wanted %v", err, ErrQuota)
+	}
+	if err := Charge(t, keys, 0, 2); err != ErrQuota {
+		tt.Errorf("got %v going over an inode limit, wanted %v", err, ErrQuota)
+	}
+	if err := Charge(t, []string{UserKey(2)}, 1000, 1000); err != nil {
+		tt.Errorf("failed to charge an untracked key: %s", err)
+	}
+	t.EndTransaction(false)
+
+	snap := Snapshot()
+	if u := snap[UserKey(1)]; u.Blocks != 10 || u.Inodes != 2 {
+		tt.Errorf("user has %v, wanted 10 blocks and 2 inodes", u)
+	}
+	if u := snap[TreeKey(7)]; u.Blocks != 8 || u.Inodes != 2 {
+		tt.Errorf("tree has %v, wanted 8 blocks and 2 inodes", u)
+	}
+	if _, ok := snap[UserKey(2)]; ok {
+		tt.Errorf("charging an untracked key started tracking it")
+	}
+
+	t = jrnl.BeginTransaction()
+	if err := Charge(t, keys, -20, -1); err != nil {
+		tt.Errorf("failed to give back: %s", err)
+	}
+	t.EndTransaction(false)
+	if u := Snapshot()[UserKey(1)]; u.Blocks != 0 || u.Inodes != 1 {
+		tt.Errorf("user has %v after giving back, wanted 0 blocks and 1 inode", u)
+	}
+}
+
+// Covers:
+//	-> charge/aborted
+//	-> setlimits/existing, setlimits/none
+//	-> move/tracked, move/overlimit
+func TestLimitsAndMove(tt *testing.T) {
+	initUut()
+	mustSet(tt, UserKey(1), 5, 5, Usage{Blocks: 4, Inodes: 1})
+	mustSet(tt, UserKey(2), 1, 1, Usage{})
+
+	t := jrnl.BeginTransaction()
+	Charge(t, []string{UserKey(1)}, 1, 1)
+	t.AbortTransaction()
+	if u := Snapshot()[UserKey(1)]; u.Blocks != 4 || u.Inodes != 1 {
+		tt.Errorf("aborted charge stuck: %v", u)
+	}
+
+	// Moves ignore limits
+	t = jrnl.BeginTransaction()
+	if err := Move(t, UserKey(1), UserKey(2), 4, 1); err != nil {
+		tt.Errorf("failed to move: %s", err)
+	}
+	t.EndTransaction(false)
+	snap := Snapshot()
+	if u := snap[UserKey(1)]; u.Blocks != 0 || u.Inodes != 0 {
+		tt.Errorf("moved from has %v", u)
+	}
+	if u := snap[UserKey(2)]; u.Blocks != 4 || u.Inodes != 1 {
+		tt.Errorf("moved to has %v", u)
+	}
+
+	// New limits keep the usage
+	mustSet(tt, UserKey(2), 10, 0, Usage{})
+	if u := Snapshot()[UserKey(2)]; u.Blocks != 4 || u.BlockLimit != 10 || u.InodeLimit != 0 {
+		tt.Errorf("reset limits gave %v", u)
+	}
+	mustSet(tt, UserKey(2), 0, 0, Usage{})
+	if _, ok := Snapshot()[UserKey(2)]; ok {
+		tt.Errorf("key with no limits is still tracked")
+	}
+	if len(List()) != 1 {
+		tt.Errorf("listed %v, wanted just user 1", List())
+	}
+}